@@ -0,0 +1,19 @@
+-- Wall-clock and relative time of metric points, and values that are not
+-- finite numbers (NaN/Inf, histograms, text)
+
+ALTER TABLE run_metrics ADD COLUMN wall_time REAL;
+ALTER TABLE run_metrics ADD COLUMN relative_time REAL;
+
+CREATE TABLE IF NOT EXISTS run_metric_extras (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    run_id TEXT NOT NULL REFERENCES runs(id),
+    step INTEGER NOT NULL,
+    metric_name TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    value TEXT,
+    wall_time REAL,
+    relative_time REAL,
+    logged_at TEXT NOT NULL DEFAULT (datetime('now'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_run_metric_extras_run_name ON run_metric_extras(run_id, metric_name);
@@ -0,0 +1,3 @@
+-- Machine-readable failure category reported by the agent (e.g. agent_restarted)
+
+ALTER TABLE runs ADD COLUMN failure_reason TEXT;
@@ -0,0 +1,3 @@
+-- The stop rule that ended an early_stopped run, as described by the agent
+
+ALTER TABLE runs ADD COLUMN stop_rule TEXT;
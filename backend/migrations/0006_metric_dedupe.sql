@@ -0,0 +1,11 @@
+-- A metric has one value per step, so metric batches the agent sends again,
+-- after a lost ack or a restart, are ignored. Drop the duplicates replays
+-- left behind, keeping the first of each.
+
+DELETE FROM run_metrics
+WHERE id NOT IN (SELECT MIN(id) FROM run_metrics GROUP BY run_id, metric_name, step);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_run_metrics_run_name_step ON run_metrics(run_id, metric_name, step);
+
+DELETE FROM run_metric_extras
+WHERE id NOT IN (SELECT MIN(id) FROM run_metric_extras GROUP BY run_id, metric_name, step);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_run_metric_extras_run_name_step ON run_metric_extras(run_id, metric_name, step);
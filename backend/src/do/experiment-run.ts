@@ -1,6 +1,7 @@
 import { DurableObject } from 'cloudflare:workers';
 import type { Env } from '../index';
-import type { RunStatus } from '../types';
+import { metricExtras } from '../lib/metrics';
+import type { FailureDiagnostics, MetricExtraKind, MetricPoint, RunEnvironment, RunPhase, RunStatus } from '../types';
 
 export class ExperimentRun extends DurableObject<Env> {
   sql: SqlStorage;
@@ -24,6 +25,10 @@ export class ExperimentRun extends DurableObject<Env> {
         git_branch TEXT,
         git_commit TEXT,
         error_message TEXT,
+        failure_reason TEXT,
+        diagnostics TEXT,
+        stop_rule TEXT,
+        environment TEXT,
         exit_code INTEGER,
         created_at TEXT NOT NULL DEFAULT (datetime('now')),
         started_at TEXT,
@@ -36,11 +41,25 @@ export class ExperimentRun extends DurableObject<Env> {
         step INTEGER NOT NULL,
         metric_name TEXT NOT NULL,
         metric_value REAL NOT NULL,
+        wall_time REAL,
+        relative_time REAL,
         logged_at TEXT NOT NULL DEFAULT (datetime('now'))
       );
       CREATE INDEX IF NOT EXISTS idx_mp_step ON metric_points(step);
       CREATE INDEX IF NOT EXISTS idx_mp_name ON metric_points(metric_name);
 
+      CREATE TABLE IF NOT EXISTS metric_extras (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        step INTEGER NOT NULL,
+        metric_name TEXT NOT NULL,
+        kind TEXT NOT NULL, -- nan | inf | -inf | histogram | text
+        value TEXT, -- JSON, null for non-finite numbers
+        wall_time REAL,
+        relative_time REAL,
+        logged_at TEXT NOT NULL DEFAULT (datetime('now'))
+      );
+      CREATE INDEX IF NOT EXISTS idx_me_name ON metric_extras(metric_name);
+
       CREATE TABLE IF NOT EXISTS metric_summary (
         metric_name TEXT PRIMARY KEY,
         last_value REAL NOT NULL,
@@ -50,13 +69,62 @@ export class ExperimentRun extends DurableObject<Env> {
         count INTEGER NOT NULL DEFAULT 1
       );
 
+      CREATE TABLE IF NOT EXISTS run_info (
+        kind TEXT NOT NULL, -- param | summary | tag | status | phase
+        key TEXT NOT NULL,
+        value TEXT NOT NULL, -- JSON
+        updated_at TEXT NOT NULL DEFAULT (datetime('now')),
+        PRIMARY KEY (kind, key)
+      );
+
       CREATE TABLE IF NOT EXISTS log_lines (
-        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        seq INTEGER PRIMARY KEY,
         line TEXT NOT NULL,
         stream TEXT NOT NULL DEFAULT 'stdout',
         logged_at TEXT NOT NULL DEFAULT (datetime('now'))
       );
     `);
+
+    // Runs created before metric points carried timestamps lack the time columns
+    const columns = this.sql.exec('PRAGMA table_info(metric_points)').toArray();
+    if (!columns.some((c) => c.name === 'wall_time')) {
+      this.sql.exec('ALTER TABLE metric_points ADD COLUMN wall_time REAL');
+      this.sql.exec('ALTER TABLE metric_points ADD COLUMN relative_time REAL');
+    }
+    // ...and before log lines carried the agent's seq. Their autoincrement
+    // id numbers them the same way, from 1.
+    const logColumns = this.sql.exec('PRAGMA table_info(log_lines)').toArray();
+    if (!logColumns.some((c) => c.name === 'seq')) {
+      this.sql.exec('ALTER TABLE log_lines RENAME COLUMN id TO seq');
+    }
+    // ...or before a metric had one value per step. Drop the duplicates
+    // replayed batches left behind, keeping the first of each.
+    const pointIndexes = this.sql.exec('PRAGMA index_list(metric_points)').toArray();
+    if (!pointIndexes.some((i) => i.name === 'idx_mp_name_step')) {
+      this.sql.exec(`
+        DELETE FROM metric_points WHERE id NOT IN (SELECT MIN(id) FROM metric_points GROUP BY metric_name, step);
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_mp_name_step ON metric_points(metric_name, step);
+        DELETE FROM metric_extras WHERE id NOT IN (SELECT MIN(id) FROM metric_extras GROUP BY metric_name, step);
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_me_name_step ON metric_extras(metric_name, step);
+      `);
+    }
+    // ...or before failures carried a reason
+    const stateColumns = this.sql.exec('PRAGMA table_info(run_state)').toArray();
+    if (!stateColumns.some((c) => c.name === 'failure_reason')) {
+      this.sql.exec('ALTER TABLE run_state ADD COLUMN failure_reason TEXT');
+    }
+    // ...or diagnostics
+    if (!stateColumns.some((c) => c.name === 'diagnostics')) {
+      this.sql.exec('ALTER TABLE run_state ADD COLUMN diagnostics TEXT');
+    }
+    // ...or could be stopped early
+    if (!stateColumns.some((c) => c.name === 'stop_rule')) {
+      this.sql.exec('ALTER TABLE run_state ADD COLUMN stop_rule TEXT');
+    }
+    // ...or had their environment recorded
+    if (!stateColumns.some((c) => c.name === 'environment')) {
+      this.sql.exec('ALTER TABLE run_state ADD COLUMN environment TEXT');
+    }
   }
 
   /** Initialize run state. */
@@ -84,6 +152,11 @@ export class ExperimentRun extends DurableObject<Env> {
     );
   }
 
+  /** Get the run's status. */
+  async getStatus(): Promise<RunStatus> {
+    return this.sql.exec('SELECT status FROM run_state WHERE id = 1').one().status as RunStatus;
+  }
+
   /** Mark run as started. */
   async markRunning(): Promise<void> {
     this.sql.exec(
@@ -91,16 +164,39 @@ export class ExperimentRun extends DurableObject<Env> {
     );
   }
 
-  /** Append metrics batch. */
-  async appendMetrics(metrics: Array<{ step: number; values: Record<string, number> }>): Promise<void> {
+  /**
+   * Append metrics batch. Only finite values count towards the summary;
+   * non-finite numbers, histograms and text go to metric_extras. A metric
+   * has one value per step: values already stored for their step, such as
+   * those of a batch sent again, are ignored.
+   */
+  async appendMetrics(metrics: MetricPoint[]): Promise<void> {
     for (const batch of metrics) {
-      for (const [name, value] of Object.entries(batch.values)) {
+      const wallTime = batch.time ?? null;
+      const relativeTime = batch.relative_time ?? null;
+      for (const extra of metricExtras(batch)) {
         this.sql.exec(
-          'INSERT INTO metric_points (step, metric_name, metric_value) VALUES (?, ?, ?)',
+          'INSERT OR IGNORE INTO metric_extras (step, metric_name, kind, value, wall_time, relative_time) VALUES (?, ?, ?, ?, ?, ?)',
+          batch.step,
+          extra.name,
+          extra.kind,
+          extra.value,
+          wallTime,
+          relativeTime,
+        );
+      }
+      for (const [name, value] of Object.entries(batch.values)) {
+        const inserted = this.sql.exec(
+          'INSERT OR IGNORE INTO metric_points (step, metric_name, metric_value, wall_time, relative_time) VALUES (?, ?, ?, ?, ?)',
           batch.step,
           name,
           value,
+          wallTime,
+          relativeTime,
         );
+        if (inserted.rowsWritten === 0) {
+          continue;
+        }
         // Upsert summary
         this.sql.exec(
           `INSERT INTO metric_summary (metric_name, last_value, last_step, min_value, max_value, count)
@@ -118,17 +214,60 @@ export class ExperimentRun extends DurableObject<Env> {
     }
   }
 
-  /** Append log lines. */
-  async appendLogs(lines: Array<{ line: string; stream?: string }>): Promise<void> {
+  /** Append log lines. Lines already stored under the same seq are ignored. */
+  async appendLogs(lines: Array<{ seq: number; line: string; stream?: string }>): Promise<void> {
     for (const entry of lines) {
       this.sql.exec(
-        'INSERT INTO log_lines (line, stream) VALUES (?, ?)',
+        'INSERT OR IGNORE INTO log_lines (seq, line, stream) VALUES (?, ?, ?)',
+        entry.seq,
         entry.line,
         entry.stream ?? 'stdout',
       );
     }
   }
 
+  /** Get log lines after the given seq, oldest first. */
+  async getLogs(after = 0, limit = 1000): Promise<Array<{ seq: number; stream: string; line: string; logged_at: string }>> {
+    const rows = this.sql
+      .exec('SELECT seq, stream, line, logged_at FROM log_lines WHERE seq > ? ORDER BY seq LIMIT ?', after, limit)
+      .toArray();
+    return rows as unknown as Array<{ seq: number; stream: string; line: string; logged_at: string }>;
+  }
+
+  /** Upsert params, summary values, tags, status or setup phases reported by the run. */
+  async setInfo(kind: 'param' | 'summary' | 'tag' | 'status' | 'phase', values: Record<string, unknown>): Promise<void> {
+    for (const [key, value] of Object.entries(values)) {
+      this.sql.exec(
+        `INSERT INTO run_info (kind, key, value) VALUES (?, ?, ?)
+         ON CONFLICT(kind, key) DO UPDATE SET value = excluded.value, updated_at = datetime('now')`,
+        kind,
+        key,
+        JSON.stringify(value),
+      );
+    }
+  }
+
+  /** Set the run's latest free-form status message. */
+  async setStatusMessage(message: string): Promise<void> {
+    await this.setInfo('status', { message });
+  }
+
+  /** Record how long the run spent in a phase of its setup. */
+  async setPhase(phase: string, result: RunPhase): Promise<void> {
+    await this.setInfo('phase', { [phase]: result });
+  }
+
+  /** Record what the run runs on. */
+  async setEnvironment(environment: RunEnvironment): Promise<void> {
+    this.sql.exec('UPDATE run_state SET environment = ? WHERE id = 1', JSON.stringify(environment));
+  }
+
+  /** Get what the run ran on, if the agent recorded it. */
+  async getEnvironment(): Promise<RunEnvironment | null> {
+    const row = this.sql.exec('SELECT environment FROM run_state WHERE id = 1').one();
+    return row.environment ? JSON.parse(row.environment as string) : null;
+  }
+
   /** Mark run completed. */
   async markCompleted(exitCode?: number): Promise<void> {
     this.sql.exec(
@@ -138,14 +277,38 @@ export class ExperimentRun extends DurableObject<Env> {
   }
 
   /** Mark run failed. */
-  async markFailed(error: string, exitCode?: number): Promise<void> {
+  async markFailed(
+    error: string,
+    exitCode?: number,
+    reason?: string,
+    diagnostics?: FailureDiagnostics,
+  ): Promise<void> {
     this.sql.exec(
-      `UPDATE run_state SET status = 'failed', completed_at = datetime('now'), error_message = ?, exit_code = ? WHERE id = 1`,
+      `UPDATE run_state SET status = 'failed', completed_at = datetime('now'), error_message = ?, failure_reason = ?, diagnostics = ?, exit_code = ? WHERE id = 1`,
       error,
+      reason ?? null,
+      diagnostics ? JSON.stringify(diagnostics) : null,
       exitCode ?? 1,
     );
   }
 
+  /** Mark run stopped early by the stop rule described by rule. */
+  async markEarlyStopped(rule: string, exitCode?: number): Promise<void> {
+    this.sql.exec(
+      `UPDATE run_state SET status = 'early_stopped', completed_at = datetime('now'), stop_rule = ?, exit_code = ? WHERE id = 1`,
+      rule,
+      exitCode ?? null,
+    );
+  }
+
+  /** Mark run cancelled. */
+  async markCancelled(exitCode?: number): Promise<void> {
+    this.sql.exec(
+      `UPDATE run_state SET status = 'cancelled', completed_at = datetime('now'), exit_code = ? WHERE id = 1`,
+      exitCode ?? null,
+    );
+  }
+
   /** Get current run state + latest metrics. */
   async getState(): Promise<{
     run_id: string | null;
@@ -157,11 +320,19 @@ export class ExperimentRun extends DurableObject<Env> {
     git_branch: string | null;
     git_commit: string | null;
     error_message: string | null;
+    failure_reason: string | null;
+    diagnostics: FailureDiagnostics | null;
+    stop_rule: string | null;
     exit_code: number | null;
     created_at: string;
     started_at: string | null;
     completed_at: string | null;
     metrics: Record<string, { value: number; step: number; min: number; max: number; count: number }>;
+    params: Record<string, unknown>;
+    summary: Record<string, unknown>;
+    tags: Record<string, string>;
+    status_message: string | null;
+    phases: Record<string, RunPhase>;
   }> {
     const row = this.sql.exec('SELECT * FROM run_state WHERE id = 1').one();
     const summaryRows = this.sql.exec('SELECT * FROM metric_summary').toArray();
@@ -176,6 +347,11 @@ export class ExperimentRun extends DurableObject<Env> {
       };
     }
 
+    const info: Record<string, Record<string, unknown>> = { param: {}, summary: {}, tag: {}, status: {}, phase: {} };
+    for (const r of this.sql.exec('SELECT kind, key, value FROM run_info').toArray()) {
+      info[r.kind as string][r.key as string] = JSON.parse(r.value as string);
+    }
+
     return {
       run_id: row.run_id as string | null,
       experiment_id: row.experiment_id as string | null,
@@ -186,25 +362,47 @@ export class ExperimentRun extends DurableObject<Env> {
       git_branch: row.git_branch as string | null,
       git_commit: row.git_commit as string | null,
       error_message: row.error_message as string | null,
+      failure_reason: row.failure_reason as string | null,
+      diagnostics: row.diagnostics ? JSON.parse(row.diagnostics as string) : null,
+      stop_rule: row.stop_rule as string | null,
       exit_code: row.exit_code as number | null,
       created_at: row.created_at as string,
       started_at: row.started_at as string | null,
       completed_at: row.completed_at as string | null,
       metrics,
+      params: info.param,
+      summary: info.summary,
+      tags: info.tag as Record<string, string>,
+      status_message: (info.status.message as string | undefined) ?? null,
+      phases: info.phase as Record<string, RunPhase>,
     };
   }
 
   /** Get metric history for a specific metric. */
-  async getMetrics(name?: string, since?: number): Promise<Array<{ step: number; metric_name: string; metric_value: number; logged_at: string }>> {
+  async getMetrics(name?: string, since?: number): Promise<Array<{ step: number; metric_name: string; metric_value: number; wall_time: number | null; relative_time: number | null; logged_at: string }>> {
     if (name) {
       const rows = since
         ? this.sql.exec('SELECT * FROM metric_points WHERE metric_name = ? AND id > ? ORDER BY step', name, since).toArray()
         : this.sql.exec('SELECT * FROM metric_points WHERE metric_name = ? ORDER BY step', name).toArray();
-      return rows as unknown as Array<{ step: number; metric_name: string; metric_value: number; logged_at: string }>;
+      return rows as unknown as Array<{ step: number; metric_name: string; metric_value: number; wall_time: number | null; relative_time: number | null; logged_at: string }>;
     }
     const rows = since
       ? this.sql.exec('SELECT * FROM metric_points WHERE id > ? ORDER BY step', since).toArray()
       : this.sql.exec('SELECT * FROM metric_points ORDER BY step').toArray();
-    return rows as unknown as Array<{ step: number; metric_name: string; metric_value: number; logged_at: string }>;
+    return rows as unknown as Array<{ step: number; metric_name: string; metric_value: number; wall_time: number | null; relative_time: number | null; logged_at: string }>;
+  }
+
+  /** Get non-finite, histogram and text values logged after the given id. */
+  async getMetricExtras(since = 0): Promise<Array<{ id: number; step: number; metric_name: string; kind: MetricExtraKind; value: unknown; wall_time: number | null; relative_time: number | null }>> {
+    const rows = this.sql.exec('SELECT * FROM metric_extras WHERE id > ? ORDER BY step', since).toArray();
+    return rows.map((r) => ({
+      id: r.id as number,
+      step: r.step as number,
+      metric_name: r.metric_name as string,
+      kind: r.kind as MetricExtraKind,
+      value: r.value === null ? null : JSON.parse(r.value as string),
+      wall_time: r.wall_time as number | null,
+      relative_time: r.relative_time as number | null,
+    }));
   }
 }
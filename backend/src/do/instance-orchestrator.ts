@@ -1,6 +1,6 @@
 import { DurableObject } from 'cloudflare:workers';
 import type { Env } from '../index';
-import type { InstanceState, AgentAssignment } from '../types';
+import type { InstanceState, AgentAssignment, AgentCheckin, AssignmentSpec } from '../types';
 import { createHyperstackClient, type HyperstackClient } from '../lib/hyperstack';
 
 type AlarmType = 'cooldown' | 'heartbeat_timeout' | 'wake_poll' | 'hibernate_poll';
@@ -12,9 +12,16 @@ interface QueueEntry {
   bundle_key: string;
   deps_hash: string | null;
   config: string | null; // JSON
+  spec: string | null; // JSON, extra AgentAssignment fields
   queued_at: string;
 }
 
+interface ActiveRun {
+  run_id: string;
+  gpus: number;
+  assigned_at: string;
+}
+
 export class InstanceOrchestrator extends DurableObject<Env> {
   sql: SqlStorage;
   private hyperstack: HyperstackClient | null = null;
@@ -37,6 +44,7 @@ export class InstanceOrchestrator extends DurableObject<Env> {
         instance_state TEXT NOT NULL DEFAULT 'idle',
         current_run_id TEXT,
         agent_last_seen TEXT,
+        agent_gpus INTEGER, -- GPUs on the agent's machine, as of its last checkin
         updated_at TEXT NOT NULL DEFAULT (datetime('now'))
       );
       INSERT OR IGNORE INTO state (id, instance_state) VALUES (1, 'idle');
@@ -49,39 +57,67 @@ export class InstanceOrchestrator extends DurableObject<Env> {
         bundle_key TEXT NOT NULL,
         deps_hash TEXT,
         config TEXT,
+        spec TEXT,
         queued_at TEXT NOT NULL DEFAULT (datetime('now'))
       );
 
+      CREATE TABLE IF NOT EXISTS active_runs (
+        run_id TEXT PRIMARY KEY,
+        gpus INTEGER NOT NULL DEFAULT 1,
+        assigned_at TEXT NOT NULL DEFAULT (datetime('now'))
+      );
+
+      CREATE TABLE IF NOT EXISTS cancel_requests (
+        run_id TEXT PRIMARY KEY,
+        requested_at TEXT NOT NULL DEFAULT (datetime('now'))
+      );
+
       CREATE TABLE IF NOT EXISTS alarms (
         id INTEGER PRIMARY KEY CHECK (id = 1),
         alarm_type TEXT
       );
       INSERT OR IGNORE INTO alarms (id) VALUES (1);
     `);
+
+    // Queues created before assignment specs existed lack the spec column
+    const columns = this.sql.exec('PRAGMA table_info(queue)').toArray();
+    if (!columns.some((c) => c.name === 'spec')) {
+      this.sql.exec('ALTER TABLE queue ADD COLUMN spec TEXT');
+    }
+    // ...and state before the agent's GPU count was kept
+    const stateColumns = this.sql.exec('PRAGMA table_info(state)').toArray();
+    if (!stateColumns.some((c) => c.name === 'agent_gpus')) {
+      this.sql.exec('ALTER TABLE state ADD COLUMN agent_gpus INTEGER');
+    }
+
+    // Runs are tracked in active_runs; move over one assigned before it existed
+    this.sql.exec(`
+      INSERT OR IGNORE INTO active_runs (run_id)
+        SELECT current_run_id FROM state WHERE id = 1 AND current_run_id IS NOT NULL;
+      UPDATE state SET current_run_id = NULL WHERE id = 1;
+    `);
   }
 
-  private getState(): { instance_state: InstanceState; current_run_id: string | null; agent_last_seen: string | null } {
-    const row = this.sql.exec('SELECT instance_state, current_run_id, agent_last_seen FROM state WHERE id = 1').one();
+  private getState(): { instance_state: InstanceState; agent_last_seen: string | null } {
+    const row = this.sql.exec('SELECT instance_state, agent_last_seen FROM state WHERE id = 1').one();
     return {
       instance_state: row.instance_state as InstanceState,
-      current_run_id: row.current_run_id as string | null,
       agent_last_seen: row.agent_last_seen as string | null,
     };
   }
 
-  private setState(state: InstanceState, currentRunId?: string | null) {
-    if (currentRunId !== undefined) {
-      this.sql.exec(
-        `UPDATE state SET instance_state = ?, current_run_id = ?, updated_at = datetime('now') WHERE id = 1`,
-        state,
-        currentRunId,
-      );
-    } else {
-      this.sql.exec(
-        `UPDATE state SET instance_state = ?, updated_at = datetime('now') WHERE id = 1`,
-        state,
-      );
-    }
+  private setState(state: InstanceState) {
+    this.sql.exec(
+      `UPDATE state SET instance_state = ?, updated_at = datetime('now') WHERE id = 1`,
+      state,
+    );
+  }
+
+  /** Runs assigned to the agent and not yet finished, oldest first. */
+  private getActiveRuns(): ActiveRun[] {
+    return this.sql
+      .exec('SELECT run_id, gpus, assigned_at FROM active_runs ORDER BY assigned_at ASC, rowid ASC')
+      .toArray() as unknown as ActiveRun[];
   }
 
   private setAlarm(type: AlarmType, delayMs: number) {
@@ -104,14 +140,32 @@ export class InstanceOrchestrator extends DurableObject<Env> {
     return rows.length > 0 ? (rows[0] as unknown as QueueEntry) : null;
   }
 
-  private dequeue(): QueueEntry | null {
-    const entry = this.peekQueue();
+  /**
+   * Remove and return the oldest queued run that fits on the agent. Agents
+   * that report GPUs take any run whose GPU request fits their free GPUs;
+   * others, including agents that predate GPU reporting, run one at a time.
+   */
+  private dequeueFitting(info: AgentCheckin, active: ActiveRun[]): QueueEntry | null {
+    let entry: QueueEntry | null = null;
+    if (!info.gpus) {
+      entry = active.length === 0 ? this.peekQueue() : null;
+    } else {
+      const free = info.free_gpus ?? 0;
+      const rows = this.sql.exec('SELECT * FROM queue ORDER BY id ASC').toArray() as unknown as QueueEntry[];
+      entry = rows.find((r) => requestedGPUs(r) <= free) ?? null;
+    }
     if (entry) {
       this.sql.exec('DELETE FROM queue WHERE run_id = ?', entry.run_id);
     }
     return entry;
   }
 
+  /** GPUs on the agent's machine, or null if it hasn't reported any. */
+  async agentGPUs(): Promise<number | null> {
+    const row = this.sql.exec('SELECT agent_gpus FROM state WHERE id = 1').one();
+    return (row.agent_gpus as number | null) || null;
+  }
+
   /** Enqueue a new experiment run. */
   async enqueue(params: {
     run_id: string;
@@ -120,15 +174,17 @@ export class InstanceOrchestrator extends DurableObject<Env> {
     bundle_key: string;
     deps_hash?: string;
     config?: Record<string, unknown>;
+    spec?: AssignmentSpec;
   }): Promise<{ position: number }> {
     this.sql.exec(
-      'INSERT INTO queue (run_id, experiment_id, entrypoint, bundle_key, deps_hash, config) VALUES (?, ?, ?, ?, ?, ?)',
+      'INSERT INTO queue (run_id, experiment_id, entrypoint, bundle_key, deps_hash, config, spec) VALUES (?, ?, ?, ?, ?, ?, ?)',
       params.run_id,
       params.experiment_id,
       params.entrypoint,
       params.bundle_key,
       params.deps_hash ?? null,
       params.config ? JSON.stringify(params.config) : null,
+      params.spec ? JSON.stringify(params.spec) : null,
     );
 
     const state = this.getState();
@@ -140,29 +196,28 @@ export class InstanceOrchestrator extends DurableObject<Env> {
   }
 
   /** Agent checks in — return assignment if available. */
-  async agentCheckin(_info: { agent_version: string; hostname: string }): Promise<AgentAssignment | null> {
+  async agentCheckin(info: AgentCheckin): Promise<AgentAssignment | null> {
     const state = this.getState();
-    this.sql.exec(`UPDATE state SET agent_last_seen = datetime('now') WHERE id = 1`);
+    this.sql.exec(`UPDATE state SET agent_last_seen = datetime('now'), agent_gpus = ? WHERE id = 1`, info.gpus ?? null);
 
-    if (state.current_run_id) {
-      // Already assigned
-      return null;
-    }
-
-    const entry = this.dequeue();
+    const active = this.getActiveRuns();
+    const entry = this.dequeueFitting(info, active);
     if (!entry) {
-      // No work — start cooldown
-      if (state.instance_state === 'running' || state.instance_state === 'waking') {
+      // No work and nothing running — start cooldown
+      if (active.length === 0 && this.getQueueDepth() === 0 &&
+        (state.instance_state === 'running' || state.instance_state === 'waking')) {
         this.setState('cooldown');
         this.setAlarm('cooldown', 5 * 60 * 1000); // 5 min cooldown
       }
       return null;
     }
 
-    this.setState('running', entry.run_id);
+    this.sql.exec('INSERT OR REPLACE INTO active_runs (run_id, gpus) VALUES (?, ?)', entry.run_id, requestedGPUs(entry));
+    this.setState('running');
     this.setAlarm('heartbeat_timeout', 5 * 60 * 1000); // 5 min timeout
 
     return {
+      ...(entry.spec ? (JSON.parse(entry.spec) as AssignmentSpec) : {}),
       run_id: entry.run_id,
       experiment_id: entry.experiment_id,
       entrypoint: entry.entrypoint,
@@ -172,25 +227,51 @@ export class InstanceOrchestrator extends DurableObject<Env> {
     };
   }
 
-  /** Agent heartbeat — reset timeout. */
-  async heartbeat(): Promise<void> {
+  /** Agent heartbeat — reset timeout, and tell the agent if its run was cancelled. */
+  async heartbeat(runId?: string): Promise<{ cancel: boolean }> {
     this.sql.exec(`UPDATE state SET agent_last_seen = datetime('now') WHERE id = 1`);
     const state = this.getState();
     if (state.instance_state === 'running') {
       this.setAlarm('heartbeat_timeout', 5 * 60 * 1000);
     }
+    if (!runId) return { cancel: false };
+    const rows = this.sql.exec('SELECT run_id FROM cancel_requests WHERE run_id = ?', runId).toArray();
+    return { cancel: rows.length > 0 };
   }
 
-  /** Run completed — try next in queue. */
-  async runCompleted(runId: string): Promise<void> {
-    const state = this.getState();
-    if (state.current_run_id !== runId) return;
+  /**
+   * Cancel a run. Queued runs are removed immediately; running runs are
+   * flagged and stopped by the agent on their next heartbeat.
+   */
+  async cancelRun(runId: string): Promise<'cancelled' | 'cancelling' | 'not_found'> {
+    const queued = this.sql.exec('SELECT run_id FROM queue WHERE run_id = ?', runId).toArray();
+    if (queued.length > 0) {
+      this.sql.exec('DELETE FROM queue WHERE run_id = ?', runId);
+      return 'cancelled';
+    }
+    const active = this.sql.exec('SELECT run_id FROM active_runs WHERE run_id = ?', runId).toArray();
+    if (active.length > 0) {
+      this.sql.exec('INSERT OR IGNORE INTO cancel_requests (run_id) VALUES (?)', runId);
+      return 'cancelling';
+    }
+    return 'not_found';
+  }
 
-    this.setState('running', null);
+  /** Remove every queued run, returning the cancelled run IDs. */
+  async drainQueue(): Promise<string[]> {
+    const rows = this.sql.exec('SELECT run_id FROM queue ORDER BY id ASC').toArray();
+    this.sql.exec('DELETE FROM queue');
+    return rows.map((r) => r.run_id as string);
+  }
+
+  /** Run completed — free its GPUs for the next in queue. */
+  async runCompleted(runId: string): Promise<void> {
+    const active = this.sql.exec('SELECT run_id FROM active_runs WHERE run_id = ?', runId).toArray();
+    if (active.length === 0) return;
+    this.sql.exec('DELETE FROM active_runs WHERE run_id = ?', runId);
 
     // Check for more work
-    const next = this.peekQueue();
-    if (!next) {
+    if (this.getActiveRuns().length === 0 && !this.peekQueue()) {
       this.setState('cooldown');
       this.setAlarm('cooldown', 5 * 60 * 1000);
     }
@@ -202,19 +283,28 @@ export class InstanceOrchestrator extends DurableObject<Env> {
     await this.runCompleted(runId);
   }
 
+  /** Run cancelled by the agent — clear the request and try next in queue. */
+  async runCancelled(runId: string): Promise<void> {
+    this.sql.exec('DELETE FROM cancel_requests WHERE run_id = ?', runId);
+    await this.runCompleted(runId);
+  }
+
   /** Get current orchestrator state (for status API). */
   async getStatus(): Promise<{
     instance_state: InstanceState;
     current_run_id: string | null;
+    active_runs: ActiveRun[];
     queue_depth: number;
     agent_last_seen: string | null;
     queue: Array<{ run_id: string; experiment_id: string; queued_at: string }>;
   }> {
     const state = this.getState();
+    const active = this.getActiveRuns();
     const queueEntries = this.sql.exec('SELECT run_id, experiment_id, queued_at FROM queue ORDER BY id ASC').toArray();
     return {
       instance_state: state.instance_state,
-      current_run_id: state.current_run_id,
+      current_run_id: active[0]?.run_id ?? null,
+      active_runs: active,
       queue_depth: this.getQueueDepth(),
       agent_last_seen: state.agent_last_seen,
       queue: queueEntries as unknown as Array<{ run_id: string; experiment_id: string; queued_at: string }>,
@@ -276,7 +366,7 @@ export class InstanceOrchestrator extends DurableObject<Env> {
     switch (alarmType) {
       case 'cooldown': {
         // Cooldown expired — if no new work, hibernate
-        if (this.getQueueDepth() === 0 && !state.current_run_id) {
+        if (this.getQueueDepth() === 0 && this.getActiveRuns().length === 0) {
           await this.hibernateInstance();
         } else {
           this.setState('running');
@@ -285,10 +375,13 @@ export class InstanceOrchestrator extends DurableObject<Env> {
       }
 
       case 'heartbeat_timeout': {
-        // Agent didn't heartbeat in time
-        if (state.instance_state === 'running' && state.current_run_id) {
-          console.error(`Heartbeat timeout for run ${state.current_run_id}`);
-          this.setState('running', null);
+        // Agent didn't heartbeat in time; its runs are presumed lost
+        const active = this.getActiveRuns();
+        if (state.instance_state === 'running' && active.length > 0) {
+          for (const run of active) {
+            console.error(`Heartbeat timeout for run ${run.run_id}`);
+          }
+          this.sql.exec('DELETE FROM active_runs');
           // Check queue for more work
           if (this.getQueueDepth() === 0) {
             this.setState('cooldown');
@@ -332,3 +425,9 @@ export class InstanceOrchestrator extends DurableObject<Env> {
     }
   }
 }
+
+/** GPUs a queued run asked for; runs that didn't ask get one. */
+function requestedGPUs(entry: QueueEntry): number {
+  const spec = entry.spec ? (JSON.parse(entry.spec) as AssignmentSpec) : {};
+  return spec.gpus && spec.gpus > 0 ? spec.gpus : 1;
+}
@@ -0,0 +1,20 @@
+import type { MetricExtraKind, MetricPoint } from '../types';
+
+/**
+ * Flatten the values of a point that don't fit a REAL column: non-finite
+ * numbers, histograms and text. value is null for non-finite numbers and JSON
+ * otherwise.
+ */
+export function metricExtras(point: MetricPoint): Array<{ name: string; kind: MetricExtraKind; value: string | null }> {
+  const extras: Array<{ name: string; kind: MetricExtraKind; value: string | null }> = [];
+  for (const [name, kind] of Object.entries(point.non_finite ?? {})) {
+    extras.push({ name, kind, value: null });
+  }
+  for (const [name, hist] of Object.entries(point.histograms ?? {})) {
+    extras.push({ name, kind: 'histogram', value: JSON.stringify(hist) });
+  }
+  for (const [name, text] of Object.entries(point.texts ?? {})) {
+    extras.push({ name, kind: 'text', value: JSON.stringify(text) });
+  }
+  return extras;
+}
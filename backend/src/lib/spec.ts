@@ -0,0 +1,31 @@
+import type { AssignmentSpec, ExperimentSubmission } from '../types';
+
+/** Extract the fields of a submission that are passed through to the agent. */
+export function assignmentSpec(body: ExperimentSubmission): AssignmentSpec {
+  return {
+    project: body.project,
+    config_args: body.config_args,
+    gpus: body.gpus,
+    python: body.python,
+    datasets: body.datasets,
+    image: body.image,
+    command: body.command,
+    launcher: body.launcher,
+    max_duration: body.max_duration,
+    max_rss_mb: body.max_rss_mb,
+    max_disk_write_mb: body.max_disk_write_mb,
+    stop_rules: body.stop_rules,
+  };
+}
+
+/**
+ * Why a submission can never run on an agent with agentGPUs GPUs, or null if
+ * it can. Runs on an agent without GPUs run one at a time whatever they ask
+ * for, as do all runs while the agent's GPUs aren't known yet.
+ */
+export function gpuRequestError(body: ExperimentSubmission, agentGPUs: number | null): string | null {
+  if (agentGPUs && body.gpus && body.gpus > agentGPUs) {
+    return `Run asks for ${body.gpus} GPUs but the agent has ${agentGPUs}`;
+  }
+  return null;
+}
@@ -3,15 +3,28 @@ import type { Env } from '../index';
 import { agentAuth } from '../middleware/auth';
 import type { InstanceOrchestrator } from '../do/instance-orchestrator';
 import type { ExperimentRun } from '../do/experiment-run';
-import type { MetricBatch } from '../types';
+import { metricExtras } from '../lib/metrics';
+import type { AgentCheckin, Artifact, DatasetObject, FailureDiagnostics, LogBatch, MetricBatch, RunEnvironment, RunPhase } from '../types';
 
 const agent = new Hono<{ Bindings: Env }>();
 
 agent.use('*', agentAuth);
 
+const artifactKey = (runId: string, path: string) => `artifacts/${runId}/${path}`;
+
+/** Record an artifact manifest in D1. */
+async function saveArtifacts(db: D1Database, runId: string, artifacts: Artifact[] | undefined) {
+  for (const a of artifacts ?? []) {
+    await db
+      .prepare('INSERT INTO run_artifacts (run_id, path, r2_key, size, sha256) VALUES (?, ?, ?, ?, ?)')
+      .bind(runId, a.path, artifactKey(runId, a.path), a.size, a.sha256)
+      .run();
+  }
+}
+
 /** Agent checks in for work. */
 agent.post('/checkin', async (c) => {
-  const body = await c.req.json<{ agent_version: string; hostname: string }>();
+  const body = await c.req.json<AgentCheckin>();
   const id = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
   const stub = c.env.INSTANCE_ORCHESTRATOR.get(id) as unknown as InstanceOrchestrator;
   const assignment = await stub.agentCheckin(body);
@@ -37,12 +50,22 @@ agent.post('/checkin', async (c) => {
   return c.json({ assignment });
 });
 
-/** Agent heartbeat. */
+/**
+ * Agent heartbeat. Response tells the agent whether to cancel its run, and
+ * the run's status, so an agent reattaching to a run after a restart can
+ * tell whether it has finished in the meantime.
+ */
 agent.post('/heartbeat', async (c) => {
+  const body = await c.req.json<{ run_id?: string }>().catch(() => ({} as { run_id?: string }));
   const id = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
   const stub = c.env.INSTANCE_ORCHESTRATOR.get(id) as unknown as InstanceOrchestrator;
-  await stub.heartbeat();
-  return c.json({ ok: true });
+  const { cancel } = await stub.heartbeat(body.run_id);
+  if (!body.run_id) {
+    return c.json({ ok: true, cancel });
+  }
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  return c.json({ ok: true, cancel, status: await runStub.getStatus() });
 });
 
 /** Agent reports metrics. */
@@ -58,11 +81,20 @@ agent.post('/metrics', async (c) => {
   c.executionCtx.waitUntil(
     (async () => {
       for (const batch of body.metrics) {
+        const wallTime = batch.time ?? null;
+        const relativeTime = batch.relative_time ?? null;
         for (const [name, value] of Object.entries(batch.values)) {
           await c.env.DB.prepare(
-            'INSERT INTO run_metrics (run_id, step, metric_name, metric_value) VALUES (?, ?, ?, ?)',
+            'INSERT OR IGNORE INTO run_metrics (run_id, step, metric_name, metric_value, wall_time, relative_time) VALUES (?, ?, ?, ?, ?, ?)',
+          )
+            .bind(body.run_id, batch.step, name, value, wallTime, relativeTime)
+            .run();
+        }
+        for (const extra of metricExtras(batch)) {
+          await c.env.DB.prepare(
+            'INSERT OR IGNORE INTO run_metric_extras (run_id, step, metric_name, kind, value, wall_time, relative_time) VALUES (?, ?, ?, ?, ?, ?, ?)',
           )
-            .bind(body.run_id, batch.step, name, value)
+            .bind(body.run_id, batch.step, extra.name, extra.kind, extra.value, wallTime, relativeTime)
             .run();
         }
       }
@@ -72,9 +104,121 @@ agent.post('/metrics', async (c) => {
   return c.json({ ok: true });
 });
 
+/** Agent reports run params. */
+agent.post('/params', async (c) => {
+  const body = await c.req.json<{ run_id: string; values: Record<string, unknown> }>();
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.setInfo('param', body.values);
+
+  c.executionCtx.waitUntil(
+    (async () => {
+      for (const [name, value] of Object.entries(body.values)) {
+        await c.env.DB.prepare('INSERT INTO run_params (run_id, param_name, param_value) VALUES (?, ?, ?)')
+          .bind(body.run_id, name, typeof value === 'string' ? value : JSON.stringify(value))
+          .run();
+      }
+    })(),
+  );
+
+  return c.json({ ok: true });
+});
+
+/** Agent reports run summary values. */
+agent.post('/summary', async (c) => {
+  const body = await c.req.json<{ run_id: string; values: Record<string, unknown> }>();
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.setInfo('summary', body.values);
+  return c.json({ ok: true });
+});
+
+/** Agent reports run tags. */
+agent.post('/tags', async (c) => {
+  const body = await c.req.json<{ run_id: string; tags: Record<string, string> }>();
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.setInfo('tag', body.tags);
+  return c.json({ ok: true });
+});
+
+/** Agent reports a free-form run status message. */
+agent.post('/status', async (c) => {
+  const body = await c.req.json<{ run_id: string; message: string }>();
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.setStatusMessage(body.message);
+  return c.json({ ok: true });
+});
+
+/** Agent reports subprocess console output. */
+agent.post('/logs', async (c) => {
+  const body = await c.req.json<LogBatch>();
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.appendLogs(body.lines);
+  return c.json({ ok: true });
+});
+
+/**
+ * Upload an artifact. A plain PUT stores the object in one go; larger files
+ * use R2 multipart: POST ?uploads, PUT ?upload_id=&part=, POST ?upload_id=.
+ */
+agent.put('/artifacts/:run_id/:path{.+}', async (c) => {
+  const key = artifactKey(c.req.param('run_id'), c.req.param('path'));
+  const uploadId = c.req.query('upload_id');
+  if (!uploadId) {
+    await c.env.R2.put(key, c.req.raw.body);
+    return c.json({ key });
+  }
+  const upload = c.env.R2.resumeMultipartUpload(key, uploadId);
+  const part = await upload.uploadPart(Number(c.req.query('part')), c.req.raw.body!);
+  return c.json({ part_number: part.partNumber, etag: part.etag });
+});
+
+agent.post('/artifacts/:run_id/:path{.+}', async (c) => {
+  const key = artifactKey(c.req.param('run_id'), c.req.param('path'));
+  const uploadId = c.req.query('upload_id');
+  if (!uploadId) {
+    const upload = await c.env.R2.createMultipartUpload(key);
+    return c.json({ upload_id: upload.uploadId });
+  }
+  const body = await c.req.json<{ parts: Array<{ part_number: number; etag: string }> }>();
+  const upload = c.env.R2.resumeMultipartUpload(key, uploadId);
+  await upload.complete(body.parts.map((p) => ({ partNumber: p.part_number, etag: p.etag })));
+  return c.json({ key });
+});
+
+agent.delete('/artifacts/:run_id/:path{.+}', async (c) => {
+  const key = artifactKey(c.req.param('run_id'), c.req.param('path'));
+  const uploadId = c.req.query('upload_id');
+  if (uploadId) {
+    await c.env.R2.resumeMultipartUpload(key, uploadId).abort();
+  }
+  return c.json({ ok: true });
+});
+
+/** Agent records what a run runs on. */
+agent.post('/environment', async (c) => {
+  const body = await c.req.json<{ run_id: string; environment: RunEnvironment }>();
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.setEnvironment(body.environment);
+  return c.json({ ok: true });
+});
+
+/** Agent reports how long a run spent in a phase of its setup. */
+agent.post('/phase', async (c) => {
+  const body = await c.req.json<{ run_id: string; phase: string } & RunPhase>();
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.setPhase(body.phase, { seconds: body.seconds, error: body.error });
+  return c.json({ ok: true });
+});
+
 /** Agent reports run completed. */
 agent.post('/completed', async (c) => {
-  const body = await c.req.json<{ run_id: string; exit_code?: number }>();
+  const body = await c.req.json<{ run_id: string; exit_code?: number; artifacts?: Artifact[] }>();
 
   // Update DO
   const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
@@ -94,18 +238,26 @@ agent.post('/completed', async (c) => {
       .bind('completed', new Date().toISOString(), body.exit_code ?? 0, body.run_id)
       .run(),
   );
+  c.executionCtx.waitUntil(saveArtifacts(c.env.DB, body.run_id, body.artifacts));
 
   return c.json({ ok: true });
 });
 
 /** Agent reports run failed. */
 agent.post('/failed', async (c) => {
-  const body = await c.req.json<{ run_id: string; error: string; exit_code?: number }>();
+  const body = await c.req.json<{
+    run_id: string;
+    error: string;
+    reason?: string;
+    exit_code?: number;
+    diagnostics?: FailureDiagnostics;
+    artifacts?: Artifact[];
+  }>();
 
   // Update DO
   const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
   const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
-  await runStub.markFailed(body.error, body.exit_code);
+  await runStub.markFailed(body.error, body.exit_code, body.reason, body.diagnostics);
 
   // Update orchestrator
   const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
@@ -115,15 +267,125 @@ agent.post('/failed', async (c) => {
   // Update D1
   c.executionCtx.waitUntil(
     c.env.DB.prepare(
-      'UPDATE runs SET status = ?, completed_at = datetime(?), error_message = ?, exit_code = ? WHERE id = ?',
+      'UPDATE runs SET status = ?, completed_at = datetime(?), error_message = ?, failure_reason = ?, exit_code = ? WHERE id = ?',
+    )
+      .bind('failed', new Date().toISOString(), body.error, body.reason ?? null, body.exit_code ?? 1, body.run_id)
+      .run(),
+  );
+  c.executionCtx.waitUntil(saveArtifacts(c.env.DB, body.run_id, body.artifacts));
+
+  return c.json({ ok: true });
+});
+
+/** Agent reports run stopped early by one of its stop rules. */
+agent.post('/early-stopped', async (c) => {
+  const body = await c.req.json<{ run_id: string; rule: string; exit_code?: number; artifacts?: Artifact[] }>();
+
+  // Update DO
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.markEarlyStopped(body.rule, body.exit_code);
+
+  // Update orchestrator
+  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
+  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
+  await orchStub.runCompleted(body.run_id);
+
+  // Update D1
+  c.executionCtx.waitUntil(
+    c.env.DB.prepare(
+      'UPDATE runs SET status = ?, completed_at = datetime(?), stop_rule = ?, exit_code = ? WHERE id = ?',
+    )
+      .bind('early_stopped', new Date().toISOString(), body.rule, body.exit_code ?? null, body.run_id)
+      .run(),
+  );
+  c.executionCtx.waitUntil(saveArtifacts(c.env.DB, body.run_id, body.artifacts));
+
+  return c.json({ ok: true });
+});
+
+/** Agent reports run cancelled. */
+agent.post('/cancelled', async (c) => {
+  const body = await c.req.json<{ run_id: string; exit_code?: number }>();
+
+  // Update DO
+  const runId = c.env.EXPERIMENT_RUN.idFromName(body.run_id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runId) as unknown as ExperimentRun;
+  await runStub.markCancelled(body.exit_code);
+
+  // Update orchestrator
+  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
+  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
+  await orchStub.runCancelled(body.run_id);
+
+  // Update D1
+  c.executionCtx.waitUntil(
+    c.env.DB.prepare(
+      'UPDATE runs SET status = ?, completed_at = datetime(?), exit_code = ? WHERE id = ?',
     )
-      .bind('failed', new Date().toISOString(), body.error, body.exit_code ?? 1, body.run_id)
+      .bind('cancelled', new Date().toISOString(), body.exit_code ?? null, body.run_id)
       .run(),
   );
 
   return c.json({ ok: true });
 });
 
+/**
+ * List the objects of a dataset: the object at ?key=, or every object under it
+ * if it is a prefix. Paths are relative to the prefix.
+ */
+agent.get('/datasets', async (c) => {
+  const key = c.req.query('key');
+  if (!key) {
+    return c.json({ error: 'key is required' }, 400);
+  }
+
+  const objects: DatasetObject[] = [];
+  const single = key.endsWith('/') ? null : await c.env.R2.head(key);
+  if (single) {
+    objects.push(datasetObject(single, key.slice(key.lastIndexOf('/') + 1)));
+  } else {
+    const prefix = key.endsWith('/') ? key : `${key}/`;
+    let cursor: string | undefined;
+    do {
+      const page = await c.env.R2.list({ prefix, cursor });
+      for (const o of page.objects) {
+        if (!o.key.endsWith('/')) {
+          objects.push(datasetObject(o, o.key.slice(prefix.length)));
+        }
+      }
+      cursor = page.truncated ? page.cursor : undefined;
+    } while (cursor);
+  }
+
+  if (objects.length === 0) {
+    return c.json({ error: 'Dataset not found' }, 404);
+  }
+  return c.json({ objects });
+});
+
+/** Serve a dataset object from R2. */
+agent.get('/datasets/object/:key{.+}', async (c) => {
+  const object = await c.env.R2.get(c.req.param('key'));
+  if (!object) {
+    return c.json({ error: 'Object not found' }, 404);
+  }
+  return new Response(object.body, {
+    headers: { 'Content-Type': 'application/octet-stream', 'Content-Length': String(object.size) },
+  });
+});
+
+function datasetObject(o: R2Object, path: string): DatasetObject {
+  const sha256 = o.checksums.sha256;
+  return {
+    key: o.key,
+    path,
+    size: o.size,
+    etag: o.etag,
+    sha256: sha256 ? [...new Uint8Array(sha256)].map((b) => b.toString(16).padStart(2, '0')).join('') : undefined,
+  };
+}
+
 /** Serve bundle from R2 (dev mode). */
 agent.get('/bundle/:key{.+}', async (c) => {
   const key = c.req.param('key');
@@ -2,6 +2,7 @@ import { Hono } from 'hono';
 import type { Env } from '../index';
 import { jwtAuth } from '../middleware/auth';
 import { ulid } from '../lib/ulid';
+import { assignmentSpec, gpuRequestError } from '../lib/spec';
 import type { InstanceOrchestrator } from '../do/instance-orchestrator';
 import type { ExperimentRun } from '../do/experiment-run';
 import type { ExperimentSubmission } from '../types';
@@ -13,6 +14,15 @@ api.use('*', jwtAuth);
 /** Submit a new experiment. */
 api.post('/experiments', async (c) => {
   const body = await c.req.json<ExperimentSubmission>();
+  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
+  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
+
+  // A run bigger than the agent's machine would wait in the queue forever
+  const gpuError = gpuRequestError(body, await orchStub.agentGPUs());
+  if (gpuError) {
+    return c.json({ error: gpuError }, 400);
+  }
+
   const experimentId = ulid();
   const runId = ulid();
 
@@ -54,8 +64,6 @@ api.post('/experiments', async (c) => {
   });
 
   // Enqueue in orchestrator
-  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
-  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
   const { position } = await orchStub.enqueue({
     run_id: runId,
     experiment_id: experimentId,
@@ -63,6 +71,7 @@ api.post('/experiments', async (c) => {
     bundle_key: body.bundle_key,
     deps_hash: body.deps_hash,
     config: body.config,
+    spec: assignmentSpec(body),
   });
 
   return c.json({ experiment_id: experimentId, run_id: runId, queue_position: position }, 201);
@@ -108,6 +117,7 @@ api.get('/runs/:id/stream', async (c) => {
     (async () => {
       try {
         let lastMetricId = 0;
+        let lastExtraId = 0;
         for (let i = 0; i < 300; i++) {
           // ~10 min max
           const state = await runStub.getState();
@@ -116,11 +126,22 @@ api.get('/runs/:id/stream', async (c) => {
           if (newMetrics.length > 0) {
             lastMetricId = Math.max(...newMetrics.map((m) => (m as unknown as { id: number }).id ?? lastMetricId));
             send({ type: 'metrics', data: newMetrics, state: state.status });
-          } else {
+          }
+          const newExtras = await runStub.getMetricExtras(lastExtraId);
+          if (newExtras.length > 0) {
+            lastExtraId = Math.max(...newExtras.map((m) => m.id));
+            send({ type: 'metric_extras', data: newExtras, state: state.status });
+          }
+          if (newMetrics.length === 0 && newExtras.length === 0) {
             send({ type: 'heartbeat', state: state.status });
           }
 
-          if (state.status === 'completed' || state.status === 'failed' || state.status === 'cancelled') {
+          if (
+            state.status === 'completed' ||
+            state.status === 'failed' ||
+            state.status === 'cancelled' ||
+            state.status === 'early_stopped'
+          ) {
             send({ type: 'done', state: state.status });
             break;
           }
@@ -2,6 +2,7 @@ import { Hono } from 'hono';
 import type { Env } from '../index';
 import { sdkAuth } from '../middleware/auth';
 import { ulid } from '../lib/ulid';
+import { assignmentSpec, gpuRequestError } from '../lib/spec';
 import type { ExperimentRun } from '../do/experiment-run';
 import type { InstanceOrchestrator } from '../do/instance-orchestrator';
 import type { SdkInitRequest, SdkLogRequest, SdkFinishRequest, ExperimentSubmission } from '../types';
@@ -80,7 +81,7 @@ sdk.post('/log', async (c) => {
     (async () => {
       for (const [name, value] of Object.entries(body.metrics)) {
         await c.env.DB.prepare(
-          'INSERT INTO run_metrics (run_id, step, metric_name, metric_value) VALUES (?, ?, ?, ?)',
+          'INSERT OR IGNORE INTO run_metrics (run_id, step, metric_name, metric_value) VALUES (?, ?, ?, ?)',
         )
           .bind(body.run_id, body.step, name, value)
           .run();
@@ -119,6 +120,15 @@ sdk.post('/finish', async (c) => {
 /** Submit experiment (CLI uses API token, not JWT). */
 sdk.post('/experiments', async (c) => {
   const body = await c.req.json<ExperimentSubmission>();
+  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
+  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
+
+  // A run bigger than the agent's machine would wait in the queue forever
+  const gpuError = gpuRequestError(body, await orchStub.agentGPUs());
+  if (gpuError) {
+    return c.json({ error: gpuError }, 400);
+  }
+
   const experimentId = ulid();
   const runId = ulid();
 
@@ -157,8 +167,6 @@ sdk.post('/experiments', async (c) => {
     git_commit: body.git_commit,
   });
 
-  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
-  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
   const { position } = await orchStub.enqueue({
     run_id: runId,
     experiment_id: experimentId,
@@ -166,6 +174,7 @@ sdk.post('/experiments', async (c) => {
     bundle_key: body.bundle_key,
     deps_hash: body.deps_hash,
     config: body.config,
+    spec: assignmentSpec(body),
   });
 
   return c.json({ experiment_id: experimentId, run_id: runId, queue_position: position }, 201);
@@ -179,7 +188,7 @@ sdk.get('/status', async (c) => {
 
   const recentRuns = await c.env.DB.prepare(
     `SELECT r.id, r.status, r.created_at, r.started_at, r.completed_at,
-            e.project, e.entrypoint
+            r.failure_reason, r.error_message, r.stop_rule, e.project, e.entrypoint
      FROM runs r JOIN experiments e ON r.experiment_id = e.id
      ORDER BY r.created_at DESC LIMIT 10`,
   ).all();
@@ -190,6 +199,77 @@ sdk.get('/status', async (c) => {
   });
 });
 
+/** Get console output of a run after the given seq. */
+sdk.get('/runs/:id/logs', async (c) => {
+  const id = c.req.param('id');
+  const after = Number(c.req.query('after') ?? 0);
+  const runDoId = c.env.EXPERIMENT_RUN.idFromName(id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runDoId) as unknown as ExperimentRun;
+  const [lines, state] = await Promise.all([runStub.getLogs(after), runStub.getState()]);
+  return c.json({ lines, status: state.status });
+});
+
+/** Get what a run ran on, as recorded by the agent. */
+sdk.get('/runs/:id/environment', async (c) => {
+  const id = c.req.param('id');
+  const runDoId = c.env.EXPERIMENT_RUN.idFromName(id);
+  const runStub = c.env.EXPERIMENT_RUN.get(runDoId) as unknown as ExperimentRun;
+  const environment = await runStub.getEnvironment();
+  if (!environment) {
+    return c.json({ error: 'Environment not recorded' }, 404);
+  }
+  return c.json(environment);
+});
+
+/** Cancel a queued or running run. */
+sdk.post('/runs/:id/cancel', async (c) => {
+  const id = c.req.param('id');
+  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
+  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
+  const status = await orchStub.cancelRun(id);
+
+  if (status === 'not_found') {
+    return c.json({ error: 'Run is not queued or running' }, 404);
+  }
+
+  if (status === 'cancelled') {
+    const runDoId = c.env.EXPERIMENT_RUN.idFromName(id);
+    const runStub = c.env.EXPERIMENT_RUN.get(runDoId) as unknown as ExperimentRun;
+    await runStub.markCancelled();
+    c.executionCtx.waitUntil(
+      c.env.DB.prepare('UPDATE runs SET status = ?, completed_at = datetime(?) WHERE id = ?')
+        .bind('cancelled', new Date().toISOString(), id)
+        .run(),
+    );
+  }
+
+  return c.json({ run_id: id, status });
+});
+
+/** Cancel every queued run. */
+sdk.post('/queue/drain', async (c) => {
+  const orchId = c.env.INSTANCE_ORCHESTRATOR.idFromName('singleton');
+  const orchStub = c.env.INSTANCE_ORCHESTRATOR.get(orchId) as unknown as InstanceOrchestrator;
+  const cancelled = await orchStub.drainQueue();
+
+  for (const id of cancelled) {
+    const runDoId = c.env.EXPERIMENT_RUN.idFromName(id);
+    const runStub = c.env.EXPERIMENT_RUN.get(runDoId) as unknown as ExperimentRun;
+    await runStub.markCancelled();
+  }
+  c.executionCtx.waitUntil(
+    (async () => {
+      for (const id of cancelled) {
+        await c.env.DB.prepare('UPDATE runs SET status = ?, completed_at = datetime(?) WHERE id = ?')
+          .bind('cancelled', new Date().toISOString(), id)
+          .run();
+      }
+    })(),
+  );
+
+  return c.json({ cancelled });
+});
+
 /** Upload bundle to R2 via Worker. */
 sdk.put('/bundle/:key{.+}', async (c) => {
   const key = c.req.param('key');
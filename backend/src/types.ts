@@ -11,7 +11,8 @@ export type RunStatus =
   | 'running'
   | 'completed'
   | 'failed'
-  | 'cancelled';
+  | 'cancelled'
+  | 'early_stopped';
 
 export interface ExperimentSubmission {
   project: string;
@@ -22,14 +23,68 @@ export interface ExperimentSubmission {
   git_dirty?: boolean;
   deps_hash?: string;
   bundle_key: string;
+  config_args?: boolean;
+  gpus?: number; // GPUs the run needs, default 1
+  python?: string; // Python version to run on, e.g. "3.11"
+  datasets?: Dataset[];
+  image?: string; // container image to run in
+  command?: string[]; // argv to run instead of the entrypoint script
+  launcher?: 'torchrun' | 'accelerate' | 'deepspeed'; // one process per GPU
+  max_duration?: number; // seconds before the run is stopped as failed
+  max_rss_mb?: number;
+  max_disk_write_mb?: number;
+  stop_rules?: StopRule[]; // end the run early when its metrics match one
+}
+
+/** A rule the agent ends a run early at, as early_stopped, once a metric matches it. */
+export interface StopRule {
+  metric: string;
+  kind: 'non_finite' | 'plateau' | 'above' | 'below';
+  patience?: number; // reports without improvement, for plateau
+  threshold?: number; // for above and below
+  maximize?: boolean; // higher is better, for plateau
+  after_step?: number; // ignore values reported before this step
+}
+
+/** An R2 object, or every object under a prefix, a run reads as input. */
+export interface Dataset {
+  name: string; // the run finds it at datasets/<name> in its work dir
+  key: string;
+}
+
+/** An object of a dataset, as listed for the agent. */
+export interface DatasetObject {
+  key: string;
+  path: string; // relative to the dataset's prefix
+  size: number;
+  etag: string;
+  sha256?: string; // hex, if the object was uploaded with one
 }
 
 export interface AgentCheckin {
   agent_version: string;
   hostname: string;
+  gpus?: number; // GPUs on the machine, 0 or missing if none
+  free_gpus?: number; // GPUs not held by a run
+}
+
+/** Per-run execution options passed through the queue to the agent. */
+export interface AssignmentSpec {
+  project?: string; // groups the run's files in the agent's workspace
+  config_args?: boolean;
+  gpus?: number;
+  python?: string;
+  datasets?: Dataset[];
+  image?: string;
+  command?: string[];
+  launcher?: 'torchrun' | 'accelerate' | 'deepspeed';
+  max_duration?: number;
+  max_rss_mb?: number;
+  max_disk_write_mb?: number;
+  stop_rules?: StopRule[];
 }
 
-export interface AgentAssignment {
+export interface AgentAssignment extends AssignmentSpec {
   run_id: string;
   experiment_id: string;
   entrypoint: string;
@@ -39,14 +94,75 @@ export interface AgentAssignment {
   config?: Record<string, unknown>;
 }
 
+export interface Histogram {
+  edges: number[];
+  counts: number[];
+}
+
+export interface MetricPoint {
+  step: number;
+  time?: number; // Unix seconds
+  relative_time?: number; // seconds since the run started
+  values: Record<string, number>;
+  non_finite?: Record<string, 'nan' | 'inf' | '-inf'>;
+  histograms?: Record<string, Histogram>;
+  texts?: Record<string, string>;
+}
+
+export type MetricExtraKind = 'nan' | 'inf' | '-inf' | 'histogram' | 'text';
+
 export interface MetricBatch {
   run_id: string;
-  metrics: Array<{
-    step: number;
-    values: Record<string, number>;
+  metrics: MetricPoint[];
+}
+
+export interface LogBatch {
+  run_id: string;
+  lines: Array<{
+    seq: number;
+    stream: 'stdout' | 'stderr';
+    line: string;
   }>;
 }
 
+export interface Artifact {
+  path: string;
+  size: number;
+  sha256: string;
+}
+
+/** How a run's process failed, worked out by the agent from its exit code and stderr. */
+export interface FailureDiagnostics {
+  exit_class: string;
+  signal?: string;
+  exception?: {
+    type: string;
+    message: string;
+    frames?: Array<{ file: string; line: number; function: string; code?: string }>;
+  };
+  stderr_tail?: string[];
+}
+
+/** What a run ran on, recorded by the agent before it starts the run's process. */
+export interface RunEnvironment {
+  hostname: string;
+  agent_version: string;
+  kernel?: string;
+  executor: string;
+  image?: string;
+  python?: string;
+  packages?: string[]; // pip freeze
+  driver_version?: string;
+  cuda_version?: string;
+  gpus?: string[]; // models of the GPUs the run was given
+}
+
+/** How long a run spent in a phase of its setup, such as installing_deps. */
+export interface RunPhase {
+  seconds: number;
+  error?: string;
+}
+
 export interface RunDetail {
   id: string;
   experiment_id: string;
@@ -60,7 +176,11 @@ export interface RunDetail {
   started_at?: string;
   completed_at?: string;
   error_message?: string;
+  failure_reason?: string;
+  diagnostics?: FailureDiagnostics;
+  stop_rule?: string;
   exit_code?: number;
+  phases?: Record<string, RunPhase>;
   metrics: Record<string, { value: number; step: number }>;
 }
 
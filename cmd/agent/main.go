@@ -12,6 +12,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == agent.SuperviseArg {
+		os.Exit(agent.Supervise(os.Args[2:]))
+	}
+
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
 	}))
@@ -22,6 +26,12 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "workspace" {
+		// Only warnings are logged, so they don't clutter the output
+		quiet := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+		os.Exit(runWorkspace(agent.New(cfg, quiet).Workspace(), os.Args[2:]))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/agent"
+)
+
+const workspaceUsage = `usage: mlflare-agent workspace <command>
+
+commands:
+  ls              list the runs in the workspace
+  gc [--dry-run]  delete the finished runs the retention policy doesn't keep
+`
+
+// runWorkspace runs a workspace subcommand and returns its exit code.
+func runWorkspace(w *agent.Workspace, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, workspaceUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "ls":
+		runs, err := w.List()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		printWorkspaceRuns(runs)
+		return 0
+
+	case "gc":
+		fs := flag.NewFlagSet("workspace gc", flag.ContinueOnError)
+		dryRun := fs.Bool("dry-run", false, "only list what would be deleted")
+		if err := fs.Parse(args[1:]); err != nil {
+			return 2
+		}
+		removed, err := w.GC(*dryRun)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return 1
+		}
+		if len(removed) == 0 {
+			fmt.Println("Nothing to delete.")
+			return 0
+		}
+		printWorkspaceRuns(removed)
+		var total int64
+		for _, r := range removed {
+			total += r.Size
+		}
+		verb := "Deleted"
+		if *dryRun {
+			verb = "Would delete"
+		}
+		fmt.Printf("\n%s %d runs, %s.\n", verb, len(removed), formatSize(total))
+		return 0
+	}
+
+	fmt.Fprint(os.Stderr, workspaceUsage)
+	return 2
+}
+
+func printWorkspaceRuns(runs []agent.WorkspaceRun) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tRUN\tSIZE\tAGE\tSTATUS")
+	for _, r := range runs {
+		status := "finished"
+		if r.Active {
+			status = "active"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			r.Project, r.RunID, formatSize(r.Size), formatAge(time.Since(r.ModTime)), status)
+	}
+	tw.Flush()
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+}
+
+func formatAge(d time.Duration) string {
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+}
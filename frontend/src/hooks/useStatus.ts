@@ -4,6 +4,7 @@ import { apiFetch } from '../lib/api';
 interface InstanceStatus {
   instance_state: string;
   current_run_id: string | null;
+  active_runs?: Array<{ run_id: string; gpus: number; assigned_at: string }>;
   queue_depth: number;
   agent_last_seen: string | null;
   queue: Array<{ run_id: string; experiment_id: string; queued_at: string }>;
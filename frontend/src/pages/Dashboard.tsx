@@ -16,6 +16,7 @@ const statusColors: Record<string, string> = {
   completed: 'bg-blue-500/20 text-blue-400',
   failed: 'bg-red-500/20 text-red-400',
   cancelled: 'bg-gray-500/20 text-gray-400',
+  early_stopped: 'bg-orange-500/20 text-orange-400',
 };
 
 export default function Dashboard() {
@@ -39,6 +40,9 @@ export default function Dashboard() {
   }
 
   const { instance, recent_runs } = data;
+  const activeRuns =
+    instance.active_runs ??
+    (instance.current_run_id ? [{ run_id: instance.current_run_id, gpus: 1, assigned_at: '' }] : []);
 
   return (
     <div className="min-h-screen bg-gray-950 text-white p-6 max-w-4xl mx-auto">
@@ -59,19 +63,24 @@ export default function Dashboard() {
             <p className="text-lg font-semibold text-white">{instance.queue_depth}</p>
           </div>
           <div>
-            <p className="text-gray-500 text-sm">Current Run</p>
-            <p className="text-sm font-mono text-white">
-              {instance.current_run_id ? (
-                <button
-                  onClick={() => navigate(`/runs/${instance.current_run_id}`)}
-                  className="text-orange-400 hover:underline"
-                >
-                  {instance.current_run_id.slice(0, 12)}...
-                </button>
+            <p className="text-gray-500 text-sm">Active Runs</p>
+            <div className="text-sm font-mono text-white">
+              {activeRuns.length > 0 ? (
+                activeRuns.map((r) => (
+                  <p key={r.run_id}>
+                    <button
+                      onClick={() => navigate(`/runs/${r.run_id}`)}
+                      className="text-orange-400 hover:underline"
+                    >
+                      {r.run_id.slice(0, 12)}...
+                    </button>
+                    <span className="text-gray-500"> {r.gpus} GPU{r.gpus === 1 ? '' : 's'}</span>
+                  </p>
+                ))
               ) : (
                 <span className="text-gray-500">-</span>
               )}
-            </p>
+            </div>
           </div>
           <div>
             <p className="text-gray-500 text-sm">Agent Last Seen</p>
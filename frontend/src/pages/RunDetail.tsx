@@ -13,11 +13,27 @@ interface RunState {
   git_branch: string | null;
   git_commit: string | null;
   error_message: string | null;
+  failure_reason: string | null;
+  diagnostics: Diagnostics | null;
+  stop_rule: string | null;
   exit_code: number | null;
   created_at: string;
   started_at: string | null;
   completed_at: string | null;
   metrics: Record<string, { value: number; step: number; min: number; max: number; count: number }>;
+  status_message: string | null;
+  phases: Record<string, { seconds: number; error?: string }>;
+}
+
+interface Diagnostics {
+  exit_class: string;
+  signal?: string;
+  exception?: {
+    type: string;
+    message: string;
+    frames?: Array<{ file: string; line: number; function: string; code?: string }>;
+  };
+  stderr_tail?: string[];
 }
 
 export default function RunDetail() {
@@ -79,6 +95,9 @@ export default function RunDetail() {
           <span className="w-2 h-2 rounded-full bg-green-400 animate-pulse" title="Live" />
         )}
       </div>
+      {run.status_message && (
+        <p className="text-yellow-400 text-sm -mt-4 mb-6">{run.status_message}</p>
+      )}
 
       {/* Info Grid */}
       <div className="bg-gray-900 rounded-lg border border-gray-800 p-6 mb-6">
@@ -89,15 +108,53 @@ export default function RunDetail() {
           <Info label="Started" value={run.started_at} />
           <Info label="Completed" value={run.completed_at} />
           <Info label="Exit Code" value={run.exit_code?.toString()} />
+          {run.phases?.installing_deps && (
+            <Info label="Deps Install" value={`${run.phases.installing_deps.seconds.toFixed(1)}s`} />
+          )}
           {run.git_branch && <Info label="Branch" value={run.git_branch} />}
           {run.git_commit && <Info label="Commit" value={run.git_commit.slice(0, 8)} mono />}
         </div>
       </div>
 
+      {/* Stop rule */}
+      {run.stop_rule && (
+        <div className="bg-orange-900/20 border border-orange-800 rounded-lg p-4 mb-6">
+          <p className="text-orange-400 text-sm">Stopped early: {run.stop_rule}</p>
+        </div>
+      )}
+
       {/* Error */}
       {run.error_message && (
         <div className="bg-red-900/20 border border-red-800 rounded-lg p-4 mb-6">
+          {run.diagnostics && (
+            <p className="text-red-300 text-xs uppercase tracking-wide mb-1">
+              {run.diagnostics.exit_class.replace('_', ' ')}
+              {run.diagnostics.signal && ` (${run.diagnostics.signal})`}
+            </p>
+          )}
           <p className="text-red-400 text-sm font-mono">{run.error_message}</p>
+          {run.diagnostics?.exception?.frames && run.diagnostics.exception.frames.length > 0 && (
+            <div className="mt-3 text-xs font-mono text-gray-300 space-y-1">
+              {run.diagnostics.exception.frames.map((f, i) => (
+                <div key={i}>
+                  <span className="text-gray-500">
+                    {f.file}:{f.line} in {f.function}
+                  </span>
+                  {f.code && <div className="pl-4">{f.code}</div>}
+                </div>
+              ))}
+            </div>
+          )}
+          {run.diagnostics?.stderr_tail && run.diagnostics.stderr_tail.length > 0 && (
+            <details className="mt-3">
+              <summary className="text-gray-400 text-xs cursor-pointer">
+                {run.diagnostics.exit_class === 'deps_install' ? 'install output' : 'stderr'}
+              </summary>
+              <pre className="mt-2 text-xs text-gray-300 overflow-x-auto max-h-80">
+                {run.diagnostics.stderr_tail.join('\n')}
+              </pre>
+            </details>
+          )}
         </div>
       )}
 
@@ -148,6 +205,7 @@ function StatusBadge({ status }: { status: string }) {
     completed: 'bg-blue-500/20 text-blue-400',
     failed: 'bg-red-500/20 text-red-400',
     cancelled: 'bg-gray-500/20 text-gray-400',
+    early_stopped: 'bg-orange-500/20 text-orange-400',
   };
   return (
     <span className={`text-xs px-2 py-1 rounded-full ${colors[status] ?? 'bg-gray-700 text-gray-300'}`}>
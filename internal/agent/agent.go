@@ -1,8 +1,17 @@
 package agent
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/foundling-ai/mlflare/internal/api"
@@ -10,24 +19,153 @@ import (
 	"github.com/foundling-ai/mlflare/internal/version"
 )
 
-const checkinInterval = 10 * time.Second
+const (
+	checkinInterval = 10 * time.Second
+
+	// checkpointInterval is how often a running run's batches are spooled
+	// and its state file updated. A restarted agent resumes reading the
+	// run's output from the last checkpoint.
+	checkpointInterval = 10 * time.Second
+)
+
+// Failure reasons reported by the agent.
+const (
+	// reasonAgentRestarted is for runs the agent lost track of because it
+	// was restarted.
+	reasonAgentRestarted = "agent_restarted"
+
+	// reasonInsufficientGPUs is for runs assigned more GPUs than were free.
+	reasonInsufficientGPUs = "insufficient_gpus"
+
+	// reasonTimeout is for runs stopped at their time limit.
+	reasonTimeout = "timeout"
+
+	// reasonResourceLimit is for runs stopped for going over their memory
+	// or disk write limit.
+	reasonResourceLimit = "resource_limit"
+
+	// reasonStalled is for runs killed for making no progress.
+	reasonStalled = "stalled"
+
+	// reasonDepsInstall is for runs whose dependencies failed to install.
+	reasonDepsInstall = "deps_install_failed"
+)
+
+// errRunCancelled is the cancel cause used when the Worker asks for a run to
+// be stopped, so it can be told apart from the agent shutting down.
+var errRunCancelled = errors.New("run cancelled")
+
+// finishedOnWorker is the cancel cause of a run found running after a restart
+// that the Worker already has a final status for. It unwraps to
+// errRunCancelled, so the process is stopped the way a cancelled run's is,
+// but nothing is reported over the status the Worker has.
+type finishedOnWorker struct {
+	status string
+}
+
+func (e *finishedOnWorker) Error() string { return "run already " + e.status + " on the worker" }
+func (e *finishedOnWorker) Unwrap() error { return errRunCancelled }
 
 type Agent struct {
-	cfg    *config.AgentConfig
-	client *api.Client
-	logger *slog.Logger
+	cfg       *config.AgentConfig
+	client    *api.Client
+	spool     *Spool
+	gpus      *gpuPool
+	venvs     *VenvPool
+	datasets  *DatasetCache
+	workspace *Workspace
+	executors map[string]Executor
+	logger    *slog.Logger
+
+	// runs tracks the goroutines following runs
+	runs sync.WaitGroup
 }
 
 func New(cfg *config.AgentConfig, logger *slog.Logger) *Agent {
-	return &Agent{
+	a := &Agent{
 		cfg:    cfg,
 		client: api.NewClient(cfg.WorkerURL, cfg.APIToken),
 		logger: logger,
 	}
+	a.executors = map[string]Executor{
+		executorLocal: localExecutor{},
+		executorContainer: containerExecutor{
+			runtime: cfg.ContainerRuntime,
+			mounts:  []string{filepath.Join(cfg.WorkDir, "cache")},
+		},
+		executorSlurm: slurmExecutor{
+			binDir:    cfg.SlurmBinDir,
+			partition: cfg.SlurmPartition,
+			args:      strings.Fields(cfg.SlurmArgs),
+		},
+	}
+	a.workspace = NewWorkspace(cfg.WorkspaceDir, a.stateDir(), RetentionPolicy{
+		KeepRuns: cfg.WorkspaceKeepRuns,
+		MaxAge:   cfg.WorkspaceMaxAge,
+		MaxBytes: int64(cfg.WorkspaceMaxMB) << 20,
+	}, logger)
+	return a
+}
+
+// Workspace returns the workspace holding the files of the agent's runs.
+func (a *Agent) Workspace() *Workspace {
+	return a.workspace
 }
 
 func (a *Agent) Run(ctx context.Context) error {
-	a.logger.Info("agent starting", "worker_url", a.cfg.WorkerURL, "hostname", a.cfg.Hostname)
+	a.logger.Info("agent starting", "worker_url", a.cfg.WorkerURL, "hostname", a.cfg.Hostname, "executor", a.cfg.Executor)
+	if a.executors[a.cfg.Executor] == nil {
+		return fmt.Errorf("unknown executor %q, want local, container or slurm", a.cfg.Executor)
+	}
+	if a.cfg.StallAction != stallActionAlert && a.cfg.StallAction != stallActionKill {
+		return fmt.Errorf("unknown stall_action %q, want alert or kill", a.cfg.StallAction)
+	}
+	if a.cfg.DepsFailure != depsFailureFail && a.cfg.DepsFailure != depsFailureWarn {
+		return fmt.Errorf("unknown deps_failure %q, want fail or warn", a.cfg.DepsFailure)
+	}
+
+	spool, err := OpenSpool(filepath.Join(a.cfg.WorkDir, "spool"), int64(a.cfg.SpoolMaxMB)<<20, a.client, a.logger)
+	if err != nil {
+		return fmt.Errorf("opening spool: %w", err)
+	}
+	defer spool.Close()
+	a.spool = spool
+	go spool.Run(ctx)
+
+	tools := EnvTools{
+		PythonBin: a.cfg.PythonBin,
+		UVBin:     a.cfg.UVBin,
+		PoetryBin: a.cfg.PoetryBin,
+		CondaBin:  a.cfg.CondaBin,
+	}
+	venvs, err := OpenVenvPool(filepath.Join(a.cfg.WorkDir, "cache", "venvs"), tools, int64(a.cfg.VenvCacheMB)<<20, a.logger)
+	if err != nil {
+		return fmt.Errorf("opening venv pool: %w", err)
+	}
+	a.venvs = venvs
+
+	datasets, err := OpenDatasetCache(filepath.Join(a.cfg.WorkDir, "cache", "datasets"), a.client, a.logger)
+	if err != nil {
+		return fmt.Errorf("opening dataset cache: %w", err)
+	}
+	a.datasets = datasets
+
+	gpus, err := a.detectGPUs(ctx)
+	if err != nil {
+		return err
+	}
+	a.gpus = newGPUPool(gpus)
+	a.logger.Info("scheduling runs", "gpus", gpus)
+
+	// Runs detach when ctx is done; wait for their final checkpoints before
+	// the spool is closed
+	defer a.runs.Wait()
+
+	// Finish or reattach to runs an earlier agent process left behind
+	a.recoverRuns(ctx)
+	if _, err := a.workspace.GC(false); err != nil {
+		a.logger.Warn("workspace cleanup failed", "error", err)
+	}
 
 	for {
 		select {
@@ -37,102 +175,645 @@ func (a *Agent) Run(ctx context.Context) error {
 		default:
 		}
 
+		// Wait for a run to finish if there's no room for another
+		if !a.gpus.available() {
+			select {
+			case <-ctx.Done():
+			case <-a.gpus.freed:
+			}
+			continue
+		}
+
+		total, free := a.gpus.counts()
 		resp, err := a.client.Checkin(ctx, api.CheckinRequest{
 			AgentVersion: version.Version,
 			Hostname:     a.cfg.Hostname,
+			GPUs:         total,
+			FreeGPUs:     free,
 		})
 		if err != nil {
 			a.logger.Error("checkin failed", "error", err)
-			select {
-			case <-ctx.Done():
-				return nil
-			case <-time.After(checkinInterval):
-			}
+			a.waitCheckin(ctx)
 			continue
 		}
 
 		if resp.Assignment == nil {
 			a.logger.Debug("no assignment, waiting")
-			select {
-			case <-ctx.Done():
-				return nil
-			case <-time.After(checkinInterval):
-			}
+			a.waitCheckin(ctx)
 			continue
 		}
 
+		assignment := resp.Assignment
 		a.logger.Info("received assignment",
-			"run_id", resp.Assignment.RunID,
-			"experiment_id", resp.Assignment.ExperimentID,
-			"entrypoint", resp.Assignment.Entrypoint,
+			"run_id", assignment.RunID,
+			"experiment_id", assignment.ExperimentID,
+			"entrypoint", assignment.Entrypoint,
+			"gpus", max(assignment.GPUs, 1),
 		)
 
-		if err := a.executeRun(ctx, resp.Assignment); err != nil {
-			a.logger.Error("run execution failed", "run_id", resp.Assignment.RunID, "error", err)
+		ids, ok := a.gpus.acquire(assignment.GPUs)
+		if !ok {
+			a.logger.Error("not enough free GPUs for run", "run_id", assignment.RunID, "gpus", assignment.GPUs, "free", free)
+			a.report(spoolFailed, api.FailedRequest{
+				RunID:    assignment.RunID,
+				Error:    fmt.Sprintf("run needs %d GPUs but only %d are free", assignment.GPUs, free),
+				Reason:   reasonInsufficientGPUs,
+				ExitCode: -1,
+			})
+			continue
 		}
+		a.goRun(assignment.RunID, ids, func() error {
+			return a.executeRun(ctx, assignment, ids)
+		})
 	}
 }
 
-func (a *Agent) executeRun(ctx context.Context, assignment *api.Assignment) error {
+// waitCheckin waits until the next checkin is due: after checkinInterval, or
+// sooner if a run finishes and frees its GPUs.
+func (a *Agent) waitCheckin(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-a.gpus.freed:
+	case <-time.After(checkinInterval):
+	}
+}
+
+// detectGPUs returns the GPUs runs are scheduled onto: those listed in the
+// config, or else every GPU nvidia-smi reports.
+func (a *Agent) detectGPUs(ctx context.Context) ([]int, error) {
+	if a.cfg.GPUs != "" {
+		ids, err := parseGPUList(a.cfg.GPUs)
+		if err != nil {
+			return nil, fmt.Errorf("parsing gpus: %w", err)
+		}
+		return ids, nil
+	}
+	ids, err := detectGPUs(ctx, a.cfg.NvidiaSMIBin)
+	if err != nil {
+		a.logger.Warn("detecting GPUs failed, running one run at a time", "error", err)
+		return nil, nil
+	}
+	return ids, nil
+}
+
+// goRun follows a run in its own goroutine. The run's GPUs go back to the
+// pool once it finishes or detaches.
+func (a *Agent) goRun(runID string, gpus []int, run func() error) {
+	a.runs.Add(1)
+	go func() {
+		defer a.runs.Done()
+		if err := run(); err != nil {
+			a.logger.Error("run execution failed", "run_id", runID, "error", err)
+		}
+		a.gpus.release(gpus)
+	}()
+}
+
+// runSession holds what a run reports through while the agent follows it.
+type runSession struct {
+	runCtx    context.Context
+	cancelRun context.CancelCauseFunc
+	stopHB    context.CancelFunc
+
+	batcher *MetricBatcher
+	info    *RunInfoBatcher
+	logs    *LogShipper
+}
+
+// startSession starts the heartbeat and batchers for a run. The heartbeat
+// cancels runCtx with errRunCancelled when the Worker asks for the run to
+// stop.
+func (a *Agent) startSession(ctx context.Context, st *runState) *runSession {
+	runID := st.Assignment.RunID
+	logger := a.logger.With("run_id", runID)
+	s := &runSession{}
+	s.runCtx, s.cancelRun = context.WithCancelCause(ctx)
+
 	// Start heartbeat
-	hbCtx, hbCancel := context.WithCancel(ctx)
-	defer hbCancel()
-	go RunHeartbeat(hbCtx, a.client, a.logger)
+	var hbCtx context.Context
+	hbCtx, s.stopHB = context.WithCancel(ctx)
+	go RunHeartbeat(hbCtx, a.client, runID, func() { s.cancelRun(errRunCancelled) }, logger)
 
 	// Start metric batcher
-	batcher := NewMetricBatcher(a.client, assignment.RunID, a.logger)
-	batcher.Start(ctx)
-	defer batcher.Stop()
+	s.batcher = NewMetricBatcher(a.spool, runID, st.StartedAt, logger)
+	s.batcher.SetNextStep(st.NextStep)
+	s.batcher.Start(ctx)
 
-	// Download and extract bundle
-	workDir, err := DownloadAndExtract(ctx, a.client, assignment.BundleURL, a.cfg.WorkDir)
-	if err != nil {
-		_ = a.client.ReportFailed(ctx, api.FailedRequest{
-			RunID:    assignment.RunID,
-			Error:    "bundle download failed: " + err.Error(),
-			ExitCode: 1,
-		})
+	// Start params/summary/tags/status batcher
+	s.info = NewRunInfoBatcher(a.client, runID, logger)
+	s.info.Start(ctx)
+
+	// Start console log shipper
+	s.logs = NewLogShipper(a.spool, runID, logger)
+	s.logs.SetSeq(st.LogSeq)
+	s.logs.Start(ctx)
+	return s
+}
+
+func (s *runSession) flush(ctx context.Context) {
+	s.batcher.Flush(ctx)
+	s.info.Flush(ctx)
+	s.logs.Flush(ctx)
+}
+
+func (s *runSession) stop() {
+	s.stopHB()
+	s.batcher.Stop()
+	s.info.Stop()
+	s.logs.Stop()
+	s.cancelRun(nil)
+}
+
+func (a *Agent) stateDir() string {
+	return filepath.Join(a.cfg.WorkDir, "state")
+}
+
+// endRun removes a finished run's state. Its files stay in the workspace
+// until the retention policy removes them.
+func (a *Agent) endRun(st *runState) {
+	if st.WorkDir != "" {
+		a.workspace.Finished(st.WorkDir)
+	}
+	st.remove()
+}
+
+func (a *Agent) executeRun(ctx context.Context, assignment *api.Assignment, gpus []int) error {
+	st := newRunState(a.stateDir(), assignment)
+	st.GPUs = gpus
+	if err := st.save(); err != nil {
+		a.logger.Warn("saving run state failed", "error", err)
+	}
+	sess := a.startSession(ctx, st)
+	defer sess.stop()
+	runCtx := sess.runCtx
+
+	// failBeforeStart reports a failure before the process was started
+	failBeforeStart := func(req api.FailedRequest, err error) error {
+		if isCancelled(runCtx) {
+			a.finishCancelled(st, 1)
+			return nil
+		}
+		req.RunID = assignment.RunID
+		req.ExitCode = 1
+		a.report(spoolFailed, req)
+		a.endRun(st)
 		return err
 	}
+	failPrep := func(msg string, err error) error {
+		return failBeforeStart(api.FailedRequest{Error: msg + ": " + err.Error()}, err)
+	}
+
+	// Make room, then download and extract bundle into the run's own dir in
+	// the workspace
+	if _, err := a.workspace.GC(false); err != nil {
+		a.logger.Warn("workspace cleanup failed", "error", err)
+	}
+	workDir := a.workspace.RunDir(assignment.Project, assignment.RunID)
+	st.WorkDir = workDir
+	if err := DownloadAndExtract(runCtx, a.client, assignment.BundleURL, workDir); err != nil {
+		return failPrep("bundle download failed", err)
+	}
+
+	executor, image, err := a.runExecutor(assignment)
+	if err != nil {
+		return failPrep("choosing executor failed", err)
+	}
+	st.Executor = executor
+
+	// Create/reuse the environment for this dependency set. Container images
+	// bring their own.
+	pythonBin := "python"
+	var venvEnv []string
+	if executor != executorContainer {
+		venv, err := a.venvs.Acquire(runCtx, workDir, assignment.Python)
+		if err != nil {
+			return failPrep("venv creation failed", err)
+		}
+		defer a.venvs.Release(venv)
+		st.Venv = venv.Key
+		pythonBin = venv.Python
+		venvEnv = venv.Env()
+
+		// Install deps into venv if needed. Unless told to run anyway, a
+		// failed install fails the run rather than its imports.
+		tail, err := a.installDeps(runCtx, sess, st, venv)
+		if err != nil && (a.cfg.DepsFailure == depsFailureFail || isCancelled(runCtx)) {
+			return failBeforeStart(api.FailedRequest{
+				Error:       "dependency install failed: " + err.Error(),
+				Reason:      reasonDepsInstall,
+				Diagnostics: &api.FailureDiagnostics{ExitClass: exitClassDeps, StderrTail: tail},
+			}, err)
+		}
+		if err != nil {
+			a.logger.Warn("dep install failed, running anyway", "error", err)
+		}
+	}
 
-	// Create/reuse venv for isolated dependencies
-	venvPython, err := EnsureVenv(ctx, a.cfg.WorkDir, a.cfg.PythonBin, a.logger)
+	// Link input datasets, downloading any that aren't cached
+	if err := a.datasets.Link(runCtx, workDir, assignment.Datasets); err != nil {
+		return failPrep("dataset download failed", err)
+	}
+
+	// Expose the experiment config to the training process
+	env, err := RunEnv(workDir, assignment.RunID, assignment.ExperimentID, assignment.Config)
 	if err != nil {
-		_ = a.client.ReportFailed(ctx, api.FailedRequest{
-			RunID:    assignment.RunID,
-			Error:    "venv creation failed: " + err.Error(),
-			ExitCode: 1,
+		return failPrep("writing run config failed", err)
+	}
+	env = append(env, a.cacheEnv()...)
+	env = append(env, venvEnv...)
+	// Let the stacks of a process on this host be dumped if it stalls
+	if executor == executorLocal {
+		dumpEnv, err := stackDumpEnv(st.dir)
+		if err != nil {
+			return failPrep("writing stack dump hook failed", err)
+		}
+		env = append(env, dumpEnv...)
+	}
+	var args []string
+	if assignment.ConfigArgs {
+		args = ConfigArgs(assignment.Config)
+	}
+
+	// Run one process per GPU through the launcher, if one was asked for
+	command := assignment.Command
+	if assignment.Launcher != "" {
+		script := command
+		if len(script) == 0 {
+			script = []string{assignment.Entrypoint}
+		}
+		nproc := len(gpus)
+		if nproc == 0 {
+			nproc = max(assignment.GPUs, 1)
+		}
+		var rdzvEnv []string
+		command, rdzvEnv, err = launcherCommand(assignment.Launcher, script, nproc)
+		if err != nil {
+			return failPrep("building launcher command failed", err)
+		}
+		env = append(env, rdzvEnv...)
+		a.logger.Info("starting through launcher", "launcher", assignment.Launcher, "processes", nproc)
+	}
+
+	// Record what the run runs on
+	a.report(spoolEnvironment, api.EnvironmentRequest{
+		RunID:       assignment.RunID,
+		Environment: a.captureEnvironment(runCtx, executor, image, pythonBin, gpus),
+	})
+
+	// Start the experiment subprocess using venv Python, or the command
+	proc, err := a.executors[executor].Start(SubprocessSpec{
+		Name:       assignment.RunID,
+		WorkDir:    workDir,
+		ControlDir: st.dir,
+		PythonBin:  pythonBin,
+		Entrypoint: assignment.Entrypoint,
+		Command:    command,
+		Args:       args,
+		GPUs:       gpus,
+		GPUCount:   max(assignment.GPUs, 1),
+		Image:      image,
+		Env:        env,
+	}, a.logger)
+	if err != nil {
+		return failPrep("starting process failed", err)
+	}
+	st.Phase = phaseRunning
+	st.PID, st.PIDStart, st.JobID = proc.PID, proc.StartTime, proc.JobID
+	if err := st.save(); err != nil {
+		a.logger.Warn("saving run state failed", "error", err)
+	}
+
+	return a.followRun(ctx, sess, st, proc)
+}
+
+// runExecutor returns the executor for a run and, for a container, its image.
+// Runs submitted with an image run in a container unless the agent submits to
+// SLURM, which doesn't run images.
+func (a *Agent) runExecutor(assignment *api.Assignment) (executor, image string, err error) {
+	executor = a.cfg.Executor
+	if assignment.Image != "" {
+		if executor == executorSlurm {
+			return "", "", fmt.Errorf("run has image %s but the slurm executor doesn't run images", assignment.Image)
+		}
+		executor = executorContainer
+	}
+	if executor != executorContainer {
+		return executor, "", nil
+	}
+	image = cmp.Or(assignment.Image, a.cfg.ContainerImage)
+	if image == "" {
+		return "", "", fmt.Errorf("run has no image and container_image is not set")
+	}
+	return executor, image, nil
+}
+
+// recoverRuns handles runs recorded in the state dir by an earlier agent
+// process. A run whose process is still alive is reattached to and followed
+// to the end; one whose process exited in the meantime is finished from its
+// recorded output and exit code. Anything else is reported as failed with
+// reason agent_restarted.
+func (a *Agent) recoverRuns(ctx context.Context) {
+	states, err := loadRunStates(a.stateDir())
+	if err != nil {
+		a.logger.Error("reading run state failed", "error", err)
+		return
+	}
+
+	for _, st := range states {
+		runID := st.Assignment.RunID
+		executor := a.executors[cmp.Or(st.Executor, executorLocal)]
+		if st.Phase == phaseRunning && executor != nil {
+			if proc, ok := AttachProcess(executor, st.dir, st.PID, st.PIDStart, st.JobID); ok {
+				a.logger.Info("reattaching to run", "run_id", runID, "pid", st.PID, "job_id", st.JobID, "gpus", st.GPUs)
+				gpus := a.gpus.claim(st.GPUs)
+				venv := a.venvs.Hold(st.Venv)
+				a.goRun(runID, gpus, func() error {
+					defer a.venvs.Release(venv)
+					sess := a.startSession(ctx, st)
+					defer sess.stop()
+					if cause := a.reconcileRun(ctx, runID); cause != nil {
+						sess.cancelRun(cause)
+					}
+					return a.followRun(ctx, sess, st, proc)
+				})
+				continue
+			}
+		}
+
+		a.logger.Warn("run interrupted by agent restart", "run_id", runID, "phase", st.Phase)
+		a.report(spoolFailed, api.FailedRequest{
+			RunID:    runID,
+			Error:    "run was interrupted by an agent restart during " + st.Phase,
+			Reason:   reasonAgentRestarted,
+			ExitCode: -1,
 		})
-		return err
+		a.endRun(st)
+	}
+}
+
+// reconcileRun asks the Worker about a run an earlier agent left running. It
+// returns the cause to stop the run with if it was cancelled or finished
+// while the agent was down, or nil to carry on following it. If the Worker
+// can't be reached the run carries on; its heartbeat picks up a cancel later.
+func (a *Agent) reconcileRun(ctx context.Context, runID string) error {
+	resp, err := a.client.Heartbeat(ctx, api.HeartbeatRequest{RunID: runID})
+	if err != nil {
+		a.logger.Warn("checking reattached run with worker failed", "run_id", runID, "error", err)
+		return nil
+	}
+	switch {
+	case resp.Cancel:
+		a.logger.Info("run was cancelled while the agent was down, stopping it", "run_id", runID)
+		return errRunCancelled
+	case resp.Status == "completed" || resp.Status == "failed" || resp.Status == "cancelled" || resp.Status == "early_stopped":
+		a.logger.Info("run finished on the worker while the agent was down, stopping it", "run_id", runID, "status", resp.Status)
+		return &finishedOnWorker{status: resp.Status}
+	}
+	return nil
+}
+
+// followRun follows a started process until it exits and reports the result.
+// If the agent shuts down first, the run's state is checkpointed and left for
+// the next agent process to pick up.
+func (a *Agent) followRun(ctx context.Context, sess *runSession, st *runState, proc *Process) error {
+	assignment := st.Assignment
+
+	// Sample system telemetry for the lifetime of the subprocess. It gets its
+	// own batcher so samples don't advance the training step counter.
+	sysBatcher := NewMetricBatcher(a.spool, assignment.RunID, st.StartedAt, a.logger)
+	sysBatcher.SetNextStep(st.SysNextStep)
+	sysBatcher.Start(ctx)
+	defer sysBatcher.Stop()
+	sampleCtx, stopSampling := context.WithCancel(sess.runCtx)
+	hostSampler := NewHostSampler(a.cfg.WorkDir, a.cfg.TelemetryInterval, sysBatcher, a.logger)
+	hostSampler.SetPID(proc.PID)
+	gpuSampler := NewGPUSampler(a.cfg.NvidiaSMIBin, a.cfg.TelemetryInterval, sysBatcher, a.logger)
+	gpuSampler.SetDevices(st.GPUs)
+	// A SLURM job runs on another node, so this host's telemetry says
+	// nothing about it
+	if proc.JobID == "" {
+		go gpuSampler.Run(sampleCtx)
+		go hostSampler.Run(sampleCtx)
+	}
+
+	// Stop the run if it goes over its limits. Only a local process's tree
+	// can be measured; the others are held to the time limit alone.
+	localPID := 0
+	if cmp.Or(st.Executor, executorLocal) == executorLocal {
+		localPID = proc.PID
 	}
+	go watchLimits(sampleCtx, a.runLimits(assignment), st.StartedAt, localPID, sess.cancelRun, a.logger)
 
-	// Install deps into venv if needed
-	if err := InstallDeps(ctx, workDir, assignment.DepsHash, venvPython, a.logger); err != nil {
-		a.logger.Warn("dep install failed", "error", err)
+	// Periodically spool what has been read so far and record how far that
+	// is, so a restarted agent neither loses nor repeats much output
+	checkpoint := func() {
+		st.StdoutOffset, st.StderrOffset = proc.Offsets()
+		st.NextStep, st.LogSeq = sess.batcher.NextStep(), sess.logs.Seq()
+		st.SysNextStep = sysBatcher.NextStep()
+		sess.flush(ctx)
+		sysBatcher.Flush(ctx)
+		if err := st.save(); err != nil {
+			a.logger.Warn("saving run state failed", "error", err)
+		}
 	}
+	cpStop, cpDone := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(cpDone)
+		ticker := time.NewTicker(checkpointInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-cpStop:
+				return
+			case <-ticker.C:
+				checkpoint()
+			}
+		}
+	}()
 
-	// Run the experiment subprocess using venv Python
-	exitCode, runErr := RunSubprocess(ctx, workDir, venvPython, assignment.Entrypoint, batcher, a.logger)
+	// Watch for stalls, dumping the stacks of a local process
+	artifacts := NewArtifactCollector()
+	stallGPUs := gpuSampler
+	if proc.JobID != "" {
+		stallGPUs = nil
+	}
+	go a.watchStall(sampleCtx, sess, st, proc, localPID, stallGPUs, artifacts)
+
+	stderrTail := NewStderrTail()
+	if st.StderrOffset > 0 {
+		stderrTail.Load(filepath.Join(st.dir, stderrFile), st.StderrOffset)
+	}
+	exitCode, runErr := proc.Follow(sess.runCtx, st.StdoutOffset, st.StderrOffset, a.cfg.CancelGracePeriod, SubprocessSinks{
+		Metrics:   sess.batcher,
+		Info:      sess.info,
+		Logs:      sess.logs,
+		Artifacts: artifacts,
+		Stderr:    stderrTail,
+		Stop:      NewStopRules(assignment.StopRules, sess.cancelRun, a.logger.With("run_id", assignment.RunID)),
+	}, a.logger)
+	stopSampling()
+	close(cpStop)
+	<-cpDone
 
-	// Flush remaining metrics
-	batcher.Flush(ctx)
+	if errors.Is(runErr, errDetached) {
+		checkpoint()
+		return nil
+	}
+	if proc.JobID == "" {
+		a.reapGPUOrphans(ctx, assignment.RunID, st.GPUs)
+	}
+
+	// Flush remaining metrics, run info and logs
+	sess.flush(ctx)
+	sysBatcher.Flush(ctx)
+
+	var limit *limitExceeded
+	var early *earlyStopped
+	var finished *finishedOnWorker
+	cause := context.Cause(sess.runCtx)
+	if errors.As(cause, &finished) {
+		a.endRun(st)
+		return nil
+	}
+	if isCancelled(sess.runCtx) && !errors.As(cause, &limit) && !errors.As(cause, &early) {
+		a.finishCancelled(st, exitCode)
+		return nil
+	}
+
+	// Upload artifacts before reporting so the manifest can be attached
+	var manifest []api.Artifact
+	if paths, err := artifacts.Paths(st.WorkDir, a.cfg.ArtifactDir); err != nil {
+		a.logger.Error("collecting artifacts failed", "error", err)
+	} else {
+		manifest = UploadArtifacts(ctx, a.client, assignment.RunID, st.WorkDir, paths, a.logger)
+	}
 
 	// Report result
+	if limit != nil {
+		a.report(spoolFailed, api.FailedRequest{
+			RunID:     assignment.RunID,
+			Error:     limit.msg,
+			Reason:    limit.reason,
+			ExitCode:  exitCode,
+			Artifacts: manifest,
+		})
+		a.endRun(st)
+		return nil
+	}
+	if early != nil {
+		a.report(spoolEarlyStopped, api.EarlyStoppedRequest{
+			RunID:     assignment.RunID,
+			Rule:      early.rule,
+			ExitCode:  exitCode,
+			Artifacts: manifest,
+		})
+		a.endRun(st)
+		return nil
+	}
 	if runErr != nil || exitCode != 0 {
-		errMsg := "process exited with non-zero code"
+		req := api.FailedRequest{
+			RunID:     assignment.RunID,
+			Error:     "process exited with non-zero code",
+			ExitCode:  exitCode,
+			Artifacts: manifest,
+		}
 		if runErr != nil {
-			errMsg = runErr.Error()
+			req.Error = runErr.Error()
 		}
-		_ = a.client.ReportFailed(ctx, api.FailedRequest{
-			RunID:    assignment.RunID,
-			Error:    errMsg,
-			ExitCode: exitCode,
-		})
+		// Work out why from stderr, unless the supervisor died without an
+		// exit code
+		if exitCode > 0 {
+			req.Error, req.Diagnostics = Diagnose(exitCode, stderrTail.Lines())
+			req.Reason = req.Diagnostics.ExitClass
+		}
+		a.report(spoolFailed, req)
+		a.endRun(st)
 		return runErr
 	}
 
-	return a.client.ReportCompleted(ctx, api.CompletedRequest{
-		RunID:    assignment.RunID,
-		ExitCode: 0,
+	a.report(spoolCompleted, api.CompletedRequest{
+		RunID:     assignment.RunID,
+		ExitCode:  0,
+		Artifacts: manifest,
 	})
+	a.endRun(st)
+	return nil
+}
+
+// report spools a report for the Worker. A terminal report is sent after the
+// run's metrics and logs, which were spooled first.
+func (a *Agent) report(kind string, req any) {
+	if err := a.spool.Append(kind, req); err != nil {
+		a.logger.Error("failed to spool report", "kind", kind, "error", err)
+	}
+}
+
+func (a *Agent) finishCancelled(st *runState, exitCode int) {
+	runID := st.Assignment.RunID
+	a.logger.Info("run cancelled", "run_id", runID, "exit_code", exitCode)
+	a.report(spoolCancelled, api.CancelledRequest{
+		RunID:    runID,
+		ExitCode: exitCode,
+	})
+	a.endRun(st)
+}
+
+// runLimits returns the limits a run is held to: those it was submitted
+// with, else the agent's defaults.
+func (a *Agent) runLimits(assignment *api.Assignment) runLimits {
+	return runLimits{
+		MaxDuration:  cmp.Or(time.Duration(assignment.MaxDuration)*time.Second, a.cfg.MaxRunDuration),
+		MaxRSS:       uint64(cmp.Or(assignment.MaxRSSMB, a.cfg.MaxRunRSSMB)) << 20,
+		MaxDiskWrite: uint64(cmp.Or(assignment.MaxDiskWriteMB, a.cfg.MaxRunDiskWriteMB)) << 20,
+	}
+}
+
+// cacheEnv points Hugging Face and PyTorch at caches under <WorkDir>/cache,
+// so models and datasets they download persist across runs and hibernation.
+// Locations set in the agent's own environment are left alone.
+func (a *Agent) cacheEnv() []string {
+	var env []string
+	for name, dir := range map[string]string{"HF_HOME": "huggingface", "TORCH_HOME": "torch"} {
+		if os.Getenv(name) == "" {
+			env = append(env, name+"="+filepath.Join(a.cfg.WorkDir, "cache", dir))
+		}
+	}
+	return env
+}
+
+// reapGPUOrphans kills processes a finished run left on its GPUs, which
+// would keep holding memory the next run needs. They are told apart by the
+// run ID in their environment; anything else still on the GPUs is reported.
+func (a *Agent) reapGPUOrphans(ctx context.Context, runID string, gpus []int) {
+	if len(gpus) == 0 {
+		return
+	}
+	pids, err := gpuProcesses(ctx, a.cfg.NvidiaSMIBin, gpus)
+	if err != nil {
+		a.logger.Debug("checking GPUs for orphaned processes failed", "error", err)
+		return
+	}
+	for _, pid := range pids {
+		if !procHasEnv(pid, "MLFLARE_RUN_ID="+runID) {
+			a.logger.Warn("GPU still in use after run", "pid", pid, "gpus", gpuList(gpus))
+			continue
+		}
+		a.logger.Warn("killing orphaned process still using the GPU", "pid", pid)
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+			a.logger.Warn("killing orphaned process failed", "pid", pid, "error", err)
+		}
+	}
+}
+
+// gpuList renders GPU indices for CUDA_VISIBLE_DEVICES.
+func gpuList(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = strconv.Itoa(id)
+	}
+	return strings.Join(s, ",")
+}
+
+func isCancelled(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRunCancelled)
 }
@@ -0,0 +1,209 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+	"github.com/foundling-ai/mlflare/internal/config"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// TestMain lets the test binary stand in for the agent binary as the
+// supervisor of processes started on this host.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == SuperviseArg {
+		os.Exit(Supervise(os.Args[2:]))
+	}
+	os.Exit(m.Run())
+}
+
+// writeScript writes an executable shell script standing in for a tool.
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// calls returns the argument lines a fake tool recorded in dir/name.calls.
+func calls(t *testing.T, dir, name string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, name+".calls"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+// testAgent returns an agent set up the way Run sets it up, short of
+// sending its spool to the Worker.
+func testAgent(t *testing.T, cfg *config.AgentConfig) *Agent {
+	t.Helper()
+	a := New(cfg, testLogger)
+	a.spool = openTestSpool(t, filepath.Join(cfg.WorkDir, "spool"), 0)
+	venvs, err := OpenVenvPool(filepath.Join(cfg.WorkDir, "cache", "venvs"), EnvTools{}, 0, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.venvs = venvs
+	a.gpus = newGPUPool(nil)
+	return a
+}
+
+// TestRecoverRunResumesOutput checks that an agent restarted while a run is
+// going picks its output up where the last one left off: every line is
+// shipped once and in order, and steps and log sequence numbers carry on.
+func TestRecoverRunResumesOutput(t *testing.T) {
+	// The Worker has nothing to say about the run
+	worker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "{}")
+	}))
+	defer worker.Close()
+	cfg := &config.AgentConfig{
+		WorkerURL:         worker.URL,
+		WorkDir:           t.TempDir(),
+		WorkspaceDir:      t.TempDir(),
+		TelemetryInterval: time.Hour,
+		NvidiaSMIBin:      filepath.Join(t.TempDir(), "nvidia-smi"),
+		CancelGracePeriod: time.Second,
+	}
+
+	// The first agent starts a run that writes half its output, then waits.
+	// It sleeps first and last, so each agent samples it once.
+	a1 := testAgent(t, cfg)
+	st := newRunState(a1.stateDir(), &api.Assignment{RunID: "r1"})
+	st.WorkDir = t.TempDir()
+	script := `out() {
+	for i in "$@"; do
+		echo "out $i"
+		echo "err $i" >&2
+		echo "{\"_mlflare\": {\"loss\": $i}}"
+	done
+}
+sleep 0.2
+out 1 2 3
+while [ ! -e resume ]; do sleep 0.05; done
+out 4 5 6
+sleep 0.2
+`
+	proc, err := localExecutor{}.Start(SubprocessSpec{
+		Name:       "r1",
+		WorkDir:    st.WorkDir,
+		ControlDir: st.dir,
+		Command:    []string{"sh", "-c", script},
+	}, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Phase = phaseRunning
+	st.PID, st.PIDStart = proc.PID, proc.StartTime
+	if err := st.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, shutdown := context.WithCancel(context.Background())
+	sess := a1.startSession(ctx, st)
+	done := make(chan error)
+	go func() { done <- a1.followRun(ctx, sess, st, proc) }()
+	for deadline := time.Now().Add(5 * time.Second); sess.logs.Seq() < 6 || sess.batcher.NextStep() < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the first half of the output was not read")
+		}
+	}
+	shutdown()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	sess.stop()
+	a1.spool.Close()
+
+	states, err := loadRunStates(a1.stateDir())
+	if err != nil || len(states) != 1 {
+		t.Fatalf("loaded %d run states: %v", len(states), err)
+	}
+	saved := states[0]
+	if saved.NextStep != 3 || saved.LogSeq != 6 || saved.SysNextStep != 1 {
+		t.Errorf("saved next step %d, log seq %d, sys next step %d; want 3, 6, 1", saved.NextStep, saved.LogSeq, saved.SysNextStep)
+	}
+	if saved.StdoutOffset == 0 || saved.StderrOffset == 0 {
+		t.Errorf("saved offsets %d, %d", saved.StdoutOffset, saved.StderrOffset)
+	}
+
+	// A new agent reattaches and follows the run to the end
+	a2 := testAgent(t, cfg)
+	a2.recoverRuns(context.Background())
+	if err := os.WriteFile(filepath.Join(st.WorkDir, "resume"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a2.runs.Wait()
+
+	var lines []string
+	var seqs, steps, sysSteps []int
+	var kinds []string
+	for _, e := range a2.spool.pending {
+		kinds = append(kinds, e.kind)
+		switch e.kind {
+		case spoolLogs:
+			var batch api.LogBatch
+			if err := json.Unmarshal(e.body, &batch); err != nil {
+				t.Fatal(err)
+			}
+			for _, l := range batch.Lines {
+				lines = append(lines, l.Stream+": "+l.Line)
+				seqs = append(seqs, l.Seq)
+			}
+		case spoolMetrics:
+			var batch api.MetricBatch
+			if err := json.Unmarshal(e.body, &batch); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range batch.Metrics {
+				if _, ok := m.Values["loss"]; ok {
+					steps = append(steps, m.Step)
+				} else {
+					sysSteps = append(sysSteps, m.Step)
+				}
+			}
+		}
+	}
+	if kinds[len(kinds)-1] != spoolCompleted {
+		t.Errorf("spooled %q, want the run to end completed", kinds)
+	}
+
+	var want []string
+	for i := 1; i <= 6; i++ {
+		want = append(want, fmt.Sprintf("stdout: out %d", i), fmt.Sprintf("stderr: err %d", i))
+	}
+	// The two streams are read apart, so only the order within each counts
+	slices.Sort(lines)
+	slices.Sort(want)
+	if !slices.Equal(lines, want) {
+		t.Errorf("shipped lines %q, want %q", lines, want)
+	}
+	slices.Sort(seqs)
+	if want := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}; !slices.Equal(seqs, want) {
+		t.Errorf("log seqs %v, want %v", seqs, want)
+	}
+	if want := []int{0, 1, 2, 3, 4, 5}; !slices.Equal(steps, want) {
+		t.Errorf("loss steps %v, want %v", steps, want)
+	}
+	slices.Sort(sysSteps)
+	if want := []int{0, 1}; !slices.Equal(sysSteps, want) {
+		t.Errorf("sys steps %v, want %v", sysSteps, want)
+	}
+}
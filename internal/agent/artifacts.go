@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+// ArtifactCollector records files the subprocess declares as artifacts on
+// stdout, in addition to everything under the configured output directory.
+type ArtifactCollector struct {
+	mu       sync.Mutex
+	declared []string
+}
+
+func NewArtifactCollector() *ArtifactCollector {
+	return &ArtifactCollector{}
+}
+
+// Declare records a path relative to the run's work dir.
+func (c *ArtifactCollector) Declare(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.declared = append(c.declared, path)
+}
+
+// Paths returns the artifacts to upload as slash-separated paths relative to
+// workDir: every regular file under outputDir plus the declared files.
+// Declarations that resolve outside workDir are dropped.
+func (c *ArtifactCollector) Paths(workDir, outputDir string) ([]string, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	add := func(abs string) {
+		rel, err := filepath.Rel(workDir, abs)
+		if err != nil || !filepath.IsLocal(rel) {
+			return
+		}
+		rel = filepath.ToSlash(rel)
+		if !seen[rel] {
+			seen[rel] = true
+			paths = append(paths, rel)
+		}
+	}
+
+	if outputDir != "" {
+		root := filepath.Join(workDir, outputDir)
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && path == root {
+					return filepath.SkipAll
+				}
+				return err
+			}
+			if d.Type().IsRegular() {
+				add(path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("walking output dir: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	declared := append([]string(nil), c.declared...)
+	c.mu.Unlock()
+
+	for _, p := range declared {
+		abs := p
+		if !filepath.IsAbs(abs) {
+			abs = filepath.Join(workDir, p)
+		}
+		if info, err := os.Lstat(abs); err == nil && info.Mode().IsRegular() {
+			add(filepath.Clean(abs))
+		}
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// UploadArtifacts uploads each path and returns the manifest of files that
+// made it. Failed uploads are logged and left out of the manifest.
+func UploadArtifacts(ctx context.Context, client *api.Client, runID, workDir string, paths []string, logger *slog.Logger) []api.Artifact {
+	var manifest []api.Artifact
+	for _, rel := range paths {
+		abs := filepath.Join(workDir, filepath.FromSlash(rel))
+		size, sum, err := hashFile(abs)
+		if err != nil {
+			logger.Error("hashing artifact failed", "path", rel, "error", err)
+			continue
+		}
+		if err := client.UploadArtifact(ctx, runID, rel, abs); err != nil {
+			logger.Error("artifact upload failed", "path", rel, "error", err)
+			continue
+		}
+		logger.Info("artifact uploaded", "path", rel, "size", size)
+		manifest = append(manifest, api.Artifact{
+			Path:   rel,
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+	return manifest
+}
+
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -2,7 +2,11 @@ package agent
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log/slog"
+	"math"
+	"slices"
 	"sync"
 	"time"
 
@@ -11,9 +15,25 @@ import (
 
 const flushInterval = 30 * time.Second
 
+// MetricPoint is a set of values logged together.
+type MetricPoint struct {
+	// Step is the explicit step, or nil for the step after the last one.
+	Step *int
+	// Time is the wall-clock time of the point, or zero for now.
+	Time time.Time
+
+	// Scalars may include NaN and ±Inf.
+	Scalars    map[string]float64
+	Histograms map[string]api.Histogram
+	Texts      map[string]string
+}
+
+// MetricBatcher groups metric points and hands them to the spool every
+// flushInterval.
 type MetricBatcher struct {
-	client *api.Client
+	spool  *Spool
 	runID  string
+	start  time.Time
 	logger *slog.Logger
 
 	mu      sync.Mutex
@@ -22,10 +42,13 @@ type MetricBatcher struct {
 	cancel  context.CancelFunc
 }
 
-func NewMetricBatcher(client *api.Client, runID string, logger *slog.Logger) *MetricBatcher {
+// NewMetricBatcher creates a batcher whose points carry their time relative
+// to start.
+func NewMetricBatcher(spool *Spool, runID string, start time.Time, logger *slog.Logger) *MetricBatcher {
 	return &MetricBatcher{
-		client: client,
+		spool:  spool,
 		runID:  runID,
+		start:  start,
 		logger: logger,
 	}
 }
@@ -54,14 +77,80 @@ func (b *MetricBatcher) Stop() {
 	}
 }
 
+// NextStep returns the step the next point without an explicit step gets.
+func (b *MetricBatcher) NextStep() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.step
+}
+
+// SetNextStep resumes automatic steps at n.
+func (b *MetricBatcher) SetNextStep(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.step = n
+}
+
+// Add records scalar values at the next step.
 func (b *MetricBatcher) Add(values map[string]float64) {
+	b.AddPoint(MetricPoint{Scalars: values})
+}
+
+// AddPoint records a point and returns its step. A point with an explicit
+// step moves the next automatic step past it.
+func (b *MetricBatcher) AddPoint(p MetricPoint) int {
+	at := p.Time
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	payload := api.MetricPayload{
+		Time:         float64(at.UnixMicro()) / 1e6,
+		RelativeTime: at.Sub(b.start).Seconds(),
+		Values:       make(map[string]float64, len(p.Scalars)),
+	}
+	for name, v := range p.Scalars {
+		if s, ok := nonFiniteString(v); ok {
+			if payload.NonFinite == nil {
+				payload.NonFinite = make(map[string]string)
+			}
+			payload.NonFinite[name] = s
+			continue
+		}
+		payload.Values[name] = v
+	}
+	if len(p.Histograms) > 0 {
+		payload.Histograms = p.Histograms
+	}
+	if len(p.Texts) > 0 {
+		payload.Texts = p.Texts
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	b.pending = append(b.pending, api.MetricPayload{
-		Step:   b.step,
-		Values: values,
-	})
-	b.step++
+	if p.Step != nil {
+		payload.Step = *p.Step
+	} else {
+		payload.Step = b.step
+	}
+	if payload.Step >= b.step {
+		b.step = payload.Step + 1
+	}
+	b.pending = append(b.pending, payload)
+	return payload.Step
+}
+
+// nonFiniteString returns the wire name of NaN and ±Inf.
+func nonFiniteString(v float64) (string, bool) {
+	switch {
+	case math.IsNaN(v):
+		return "nan", true
+	case math.IsInf(v, 1):
+		return "inf", true
+	case math.IsInf(v, -1):
+		return "-inf", true
+	}
+	return "", false
 }
 
 func (b *MetricBatcher) Flush(ctx context.Context) {
@@ -74,17 +163,32 @@ func (b *MetricBatcher) Flush(ctx context.Context) {
 	b.pending = nil
 	b.mu.Unlock()
 
-	err := b.client.SendMetrics(ctx, api.MetricBatch{
-		RunID:   b.runID,
-		Metrics: metrics,
-	})
-	if err != nil {
-		b.logger.Error("failed to flush metrics", "error", err, "count", len(metrics))
-		// Put them back
-		b.mu.Lock()
-		b.pending = append(metrics, b.pending...)
-		b.mu.Unlock()
-	} else {
-		b.logger.Debug("flushed metrics", "count", len(metrics))
+	batches := spoolBatches(metrics, payloadSize)
+	for i, batch := range batches {
+		err := b.spool.Append(spoolMetrics, api.MetricBatch{
+			RunID:   b.runID,
+			Metrics: batch,
+		})
+		if errors.Is(err, errBadSpoolRecord) {
+			b.logger.Error("dropping metrics that cannot be spooled", "error", err, "count", len(batch))
+			continue
+		}
+		if err != nil {
+			rest := slices.Concat(batches[i:]...)
+			b.logger.Error("failed to spool metrics", "error", err, "count", len(rest))
+			// Put them back
+			b.mu.Lock()
+			b.pending = append(rest, b.pending...)
+			b.mu.Unlock()
+			return
+		}
+		b.logger.Debug("spooled metrics", "count", len(batch))
 	}
 }
+
+// payloadSize returns the encoded size of a metric point. Points may carry
+// histograms and long texts, so they are measured rather than estimated.
+func payloadSize(p api.MetricPayload) int {
+	data, _ := json.Marshal(p)
+	return len(data)
+}
@@ -0,0 +1,288 @@
+package agent
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+// datasetIndexFile, in the cache dir, maps R2 objects to the blobs holding
+// their contents.
+const datasetIndexFile = "index.json"
+
+// md5ETagRe matches the ETag R2 gives objects uploaded in one part, which is
+// the MD5 of their contents.
+var md5ETagRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// DatasetCache keeps the R2 objects runs read as datasets under
+// <WorkDir>/cache/datasets, so they are downloaded once and survive
+// hibernation:
+//
+//	blobs/<sha256>                 an object's contents, verified on download
+//	snapshots/<hash>/<path>        a dataset's files, as symlinks to blobs
+//	index.json                     R2 key and ETag to blob
+//
+// Objects with the same contents share a blob. A dataset whose objects
+// haven't changed maps to the same snapshot.
+type DatasetCache struct {
+	dir    string
+	client *api.Client
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	index map[string]string
+
+	// fetching holds a lock per object being downloaded, so runs that need
+	// the same object download it once
+	fetching map[string]*sync.Mutex
+}
+
+// OpenDatasetCache opens the cache in dir, loading its index.
+func OpenDatasetCache(dir string, client *api.Client, logger *slog.Logger) (*DatasetCache, error) {
+	for _, sub := range []string{"blobs", "snapshots", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("creating dataset cache: %w", err)
+		}
+	}
+	c := &DatasetCache{
+		dir:      dir,
+		client:   client,
+		logger:   logger,
+		index:    make(map[string]string),
+		fetching: make(map[string]*sync.Mutex),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, datasetIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading dataset index: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &c.index); err != nil {
+			logger.Warn("dataset index unreadable, starting empty", "error", err)
+			c.index = make(map[string]string)
+		}
+	}
+
+	// Downloads a crash interrupted
+	tmp, _ := os.ReadDir(filepath.Join(dir, "tmp"))
+	for _, e := range tmp {
+		os.RemoveAll(filepath.Join(dir, "tmp", e.Name()))
+	}
+	return c, nil
+}
+
+// Link makes each dataset available at <workDir>/datasets/<name>, downloading
+// objects that aren't cached yet. A dataset that is a single object is linked
+// as a file, a prefix as a directory.
+func (c *DatasetCache) Link(ctx context.Context, workDir string, datasets []api.Dataset) error {
+	if len(datasets) == 0 {
+		return nil
+	}
+	dir := filepath.Join(workDir, "datasets")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("creating datasets dir: %w", err)
+	}
+	for _, ds := range datasets {
+		if !filepath.IsLocal(ds.Name) || filepath.Base(ds.Name) != ds.Name {
+			return fmt.Errorf("invalid dataset name %q", ds.Name)
+		}
+		target, err := c.fetch(ctx, ds)
+		if err != nil {
+			return fmt.Errorf("dataset %s: %w", ds.Name, err)
+		}
+		link := filepath.Join(dir, ds.Name)
+		os.Remove(link)
+		if err := os.Symlink(target, link); err != nil {
+			return fmt.Errorf("linking dataset %s: %w", ds.Name, err)
+		}
+	}
+	return nil
+}
+
+// fetch downloads a dataset's objects into the cache and returns the path
+// the run should see: the blob of a single object, or the dataset's
+// snapshot dir.
+func (c *DatasetCache) fetch(ctx context.Context, ds api.Dataset) (string, error) {
+	objects, err := c.client.ListDataset(ctx, ds.Key)
+	if err != nil {
+		return "", fmt.Errorf("listing %s: %w", ds.Key, err)
+	}
+
+	var total int64
+	blobs := make([]string, len(objects))
+	for i, obj := range objects {
+		if !filepath.IsLocal(obj.Path) {
+			return "", fmt.Errorf("object %s has unsafe path %q", obj.Key, obj.Path)
+		}
+		if blobs[i], err = c.blob(ctx, obj); err != nil {
+			return "", err
+		}
+		total += obj.Size
+	}
+	c.logger.Info("dataset ready", "dataset", ds.Name, "key", ds.Key, "objects", len(objects), "size_mb", total>>20)
+
+	if len(objects) == 1 && objects[0].Key == ds.Key {
+		return c.blobPath(blobs[0]), nil
+	}
+	return c.snapshot(objects, blobs)
+}
+
+// blob returns the hash of an object's blob, downloading it unless the same
+// version of the object was downloaded before.
+func (c *DatasetCache) blob(ctx context.Context, obj api.DatasetObject) (string, error) {
+	indexKey := obj.ETag + " " + obj.Key
+	lock := c.lock(indexKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	c.mu.Lock()
+	sum, ok := c.index[indexKey]
+	c.mu.Unlock()
+	if ok {
+		if info, err := os.Stat(c.blobPath(sum)); err == nil && info.Size() == obj.Size {
+			return sum, nil
+		}
+	}
+
+	c.logger.Info("downloading dataset object", "key", obj.Key, "size_mb", obj.Size>>20)
+	sum, err := c.download(ctx, obj)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.index[indexKey] = sum
+	c.save()
+	c.mu.Unlock()
+	return sum, nil
+}
+
+// download fetches an object into blobs/ and returns its SHA-256. The
+// contents are checked against the SHA-256 R2 has for the object, or else
+// the MD5 in its ETag, before they are added to the cache.
+func (c *DatasetCache) download(ctx context.Context, obj api.DatasetObject) (string, error) {
+	body, err := c.client.DownloadDatasetObject(ctx, obj.Key)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", obj.Key, err)
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "blob-")
+	if err != nil {
+		return "", fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sha, md := sha256.New(), md5.New()
+	n, err := io.Copy(io.MultiWriter(tmp, sha, md), body)
+	if err != nil {
+		return "", fmt.Errorf("downloading %s: %w", obj.Key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("writing %s: %w", obj.Key, err)
+	}
+
+	sum := hex.EncodeToString(sha.Sum(nil))
+	switch {
+	case n != obj.Size:
+		return "", fmt.Errorf("%s: got %d bytes, want %d", obj.Key, n, obj.Size)
+	case obj.SHA256 != "" && obj.SHA256 != sum:
+		return "", fmt.Errorf("%s: SHA-256 mismatch", obj.Key)
+	case obj.SHA256 == "" && md5ETagRe.MatchString(obj.ETag) && obj.ETag != hex.EncodeToString(md.Sum(nil)):
+		return "", fmt.Errorf("%s: MD5 mismatch", obj.Key)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0o444); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), c.blobPath(sum)); err != nil {
+		return "", fmt.Errorf("adding %s to cache: %w", obj.Key, err)
+	}
+	return sum, nil
+}
+
+// snapshot returns the dir holding a dataset's objects at their paths,
+// creating it if no run used the same objects before.
+func (c *DatasetCache) snapshot(objects []api.DatasetObject, blobs []string) (string, error) {
+	entries := make([]string, len(objects))
+	for i, obj := range objects {
+		entries[i] = obj.Path + "\x00" + blobs[i]
+	}
+	slices.Sort(entries)
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\n", e)
+	}
+	dir := filepath.Join(c.dir, "snapshots", hex.EncodeToString(h.Sum(nil))[:16])
+	if _, err := os.Stat(dir); err == nil {
+		return dir, nil
+	}
+
+	tmp, err := os.MkdirTemp(filepath.Join(c.dir, "tmp"), "snapshot-")
+	if err != nil {
+		return "", fmt.Errorf("creating snapshot: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0o755); err != nil {
+		return "", fmt.Errorf("creating snapshot: %w", err)
+	}
+	for i, obj := range objects {
+		path := filepath.Join(tmp, obj.Path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return "", fmt.Errorf("creating snapshot: %w", err)
+		}
+		if err := os.Symlink(c.blobPath(blobs[i]), path); err != nil {
+			return "", fmt.Errorf("creating snapshot: %w", err)
+		}
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		// Another run created it first
+		if _, statErr := os.Stat(dir); statErr == nil {
+			return dir, nil
+		}
+		return "", fmt.Errorf("creating snapshot: %w", err)
+	}
+	return dir, nil
+}
+
+func (c *DatasetCache) lock(key string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.fetching[key]
+	if !ok {
+		l = &sync.Mutex{}
+		c.fetching[key] = l
+	}
+	return l
+}
+
+func (c *DatasetCache) blobPath(sum string) string {
+	return filepath.Join(c.dir, "blobs", sum)
+}
+
+// save writes the index atomically. Callers hold mu.
+func (c *DatasetCache) save() {
+	data, err := json.MarshalIndent(c.index, "", "  ")
+	if err == nil {
+		tmp := filepath.Join(c.dir, datasetIndexFile+".tmp")
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, filepath.Join(c.dir, datasetIndexFile))
+		}
+	}
+	if err != nil {
+		c.logger.Warn("writing dataset index failed", "error", err)
+	}
+}
@@ -0,0 +1,100 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+// What to do about a run whose dependencies fail to install.
+const (
+	depsFailureFail = "fail"
+	depsFailureWarn = "warn"
+)
+
+// depsOutput takes what the tools installing a run's dependencies print. Each
+// line is shipped with the run's logs, and the last are kept for a failure
+// report.
+type depsOutput struct {
+	logs *LogShipper
+	tail *StderrTail
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func newDepsOutput(logs *LogShipper) *depsOutput {
+	return &depsOutput{logs: logs, tail: NewStderrTail()}
+}
+
+// Write takes output from both of a tool's streams, which may be written at
+// the same time.
+func (o *depsOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			break
+		}
+		o.add(string(o.partial[:i]))
+		o.partial = o.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Close keeps the last line if the tool didn't end it.
+func (o *depsOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.partial) > 0 {
+		o.add(string(o.partial))
+		o.partial = nil
+	}
+	return nil
+}
+
+func (o *depsOutput) add(line string) {
+	line = strings.TrimRight(line, "\r")
+	o.logs.Add("stdout", line)
+	o.tail.Add(line)
+}
+
+// installDeps installs the bundle's dependencies into the run's venv in the
+// installing_deps phase, and reports how long that took. What the install
+// tools print goes to the run's logs; the last lines are returned for a
+// failure report.
+func (a *Agent) installDeps(ctx context.Context, sess *runSession, st *runState, venv *Venv) ([]string, error) {
+	st.Phase = phaseInstallingDeps
+	if err := st.save(); err != nil {
+		a.logger.Warn("saving run state failed", "error", err)
+	}
+
+	out := newDepsOutput(sess.logs)
+	start := time.Now()
+	err := a.venvs.Install(ctx, venv, st.WorkDir, out)
+	out.Close()
+	// Spool the output ahead of a failure report
+	sess.logs.Flush(ctx)
+
+	phase := api.PhaseRequest{
+		RunID:   st.Assignment.RunID,
+		Phase:   phaseInstallingDeps,
+		Seconds: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		phase.Error = err.Error()
+	}
+	a.report(spoolPhase, phase)
+
+	st.Phase = phasePreparing
+	if err := st.save(); err != nil {
+		a.logger.Warn("saving run state failed", "error", err)
+	}
+	return out.tail.Lines(), err
+}
@@ -0,0 +1,205 @@
+package agent
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+// Exit classes reported in a failed run's diagnostics, from the most to the
+// least specific.
+const (
+	exitClassCUDAOOM   = "cuda_oom"
+	exitClassNCCL      = "nccl_error"
+	exitClassImport    = "import_error"
+	exitClassOOMKilled = "oom_killed"
+	exitClassSignal    = "signal"
+	exitClassException = "user_exception"
+	exitClassCode      = "exit_code"
+
+	// exitClassDeps is for runs whose dependencies failed to install, so
+	// their process never started.
+	exitClassDeps = "deps_install"
+)
+
+const (
+	// stderrTailLines is how many of the last stderr lines are kept for a
+	// failure report.
+	stderrTailLines = 100
+
+	// stderrTailLineLen caps each kept line, so a progress bar redrawn on
+	// one line can't make the report huge.
+	stderrTailLineLen = 1000
+)
+
+var (
+	tracebackFrameRe = regexp.MustCompile(`^  File "(.*)", line (\d+), in (.*)$`)
+	exceptionLineRe  = regexp.MustCompile(`^([A-Za-z_][\w.]*)(?::\s?(.*))?$`)
+)
+
+// signalNames names the signals a training process usually dies of.
+var signalNames = map[int]string{
+	1: "SIGHUP", 2: "SIGINT", 4: "SIGILL", 6: "SIGABRT", 7: "SIGBUS",
+	8: "SIGFPE", 9: "SIGKILL", 11: "SIGSEGV", 13: "SIGPIPE", 15: "SIGTERM",
+}
+
+// StderrTail keeps the last lines a process wrote to stderr.
+type StderrTail struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func NewStderrTail() *StderrTail {
+	return &StderrTail{lines: make([]string, stderrTailLines)}
+}
+
+// Add records a line, dropping the oldest once the tail is full.
+func (t *StderrTail) Add(line string) {
+	if len(line) > stderrTailLineLen {
+		line = line[:stderrTailLineLen] + "..."
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+// Load adds the lines of the file at path that end before offset, for a
+// process reattached to after that much of its stderr was read.
+func (t *StderrTail) Load(path string, offset int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	// 64 KB holds the tail unless the lines are very long
+	from := max(offset-64<<10, 0)
+	buf := make([]byte, offset-from)
+	n, _ := f.ReadAt(buf, from)
+	lines := strings.Split(strings.TrimSuffix(string(buf[:n]), "\n"), "\n")
+	if from > 0 {
+		// The first line is likely cut
+		lines = lines[1:]
+	}
+	for _, l := range lines {
+		t.Add(l)
+	}
+}
+
+// Lines returns the kept lines, oldest first.
+func (t *StderrTail) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.full {
+		return append([]string(nil), t.lines[:t.next]...)
+	}
+	return append(append([]string(nil), t.lines[t.next:]...), t.lines[:t.next]...)
+}
+
+// Diagnose works out how a process that exited with code failed from the end
+// of its stderr, and returns a one-line summary for the failure report along
+// with the diagnostics.
+func Diagnose(code int, tail []string) (string, *api.FailureDiagnostics) {
+	d := &api.FailureDiagnostics{StderrTail: tail, Exception: parseTraceback(tail)}
+	if code > 128 {
+		d.Signal = signalName(code - 128)
+	}
+	text := strings.Join(tail, "\n")
+	exc := d.Exception
+
+	var summary string
+	switch {
+	case strings.Contains(text, "CUDA out of memory") || exc != nil && strings.HasSuffix(exc.Type, "OutOfMemoryError"):
+		d.ExitClass, summary = exitClassCUDAOOM, "CUDA out of memory"
+	case strings.Contains(text, "NCCL error") || strings.Contains(text, "ncclInternalError") || strings.Contains(text, "ncclSystemError") ||
+		exc != nil && strings.HasSuffix(exc.Type, "DistBackendError"):
+		d.ExitClass, summary = exitClassNCCL, "NCCL error"
+	case exc != nil && (exc.Type == "ModuleNotFoundError" || exc.Type == "ImportError"):
+		d.ExitClass, summary = exitClassImport, "import failed"
+	case code == 128+9:
+		// The kernel's OOM killer is what usually sends SIGKILL
+		d.ExitClass, summary = exitClassOOMKilled, "killed by SIGKILL (exit code 137), most likely out of memory"
+	case code > 128:
+		d.ExitClass, summary = exitClassSignal, fmt.Sprintf("killed by %s (exit code %d)", d.Signal, code)
+	case exc != nil:
+		d.ExitClass, summary = exitClassException, "uncaught exception"
+	default:
+		d.ExitClass, summary = exitClassCode, fmt.Sprintf("process exited with code %d", code)
+	}
+	if exc != nil && d.ExitClass != exitClassOOMKilled && d.ExitClass != exitClassSignal {
+		summary = exc.Type
+		if exc.Message != "" {
+			summary += ": " + exc.Message
+		}
+	}
+	return summary, d
+}
+
+// parseTraceback returns the last Python traceback in lines, or nil if there
+// is none. Rank prefixes added by a launcher are ignored, and so is the
+// traceback torchrun prints when a rank fails, which says nothing about why.
+func parseTraceback(lines []string) *api.PythonException {
+	var last *api.PythonException
+	for i := len(lines) - 1; i >= 0; i-- {
+		if _, l := splitRank(lines[i]); !strings.HasPrefix(l, "Traceback (most recent call last):") {
+			continue
+		}
+		exc := parseTracebackAt(lines[i+1:])
+		if exc == nil {
+			continue
+		}
+		if !strings.HasSuffix(exc.Type, "ChildFailedError") {
+			return exc
+		}
+		if last == nil {
+			last = exc
+		}
+	}
+	return last
+}
+
+// parseTracebackAt parses the frames and exception that follow a
+// "Traceback" line.
+func parseTracebackAt(lines []string) *api.PythonException {
+	exc := &api.PythonException{}
+	for _, line := range lines {
+		_, line = splitRank(line)
+		if m := tracebackFrameRe.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[2])
+			exc.Frames = append(exc.Frames, api.TracebackFrame{File: m[1], Line: n, Function: m[3]})
+			continue
+		}
+		if strings.HasPrefix(line, " ") {
+			// The frame's source line, or the ^^^ markers under it
+			code := strings.TrimSpace(line)
+			if n := len(exc.Frames); n > 0 && exc.Frames[n-1].Code == "" && strings.Trim(code, "^~ ") != "" {
+				exc.Frames[n-1].Code = code
+			}
+			continue
+		}
+		if m := exceptionLineRe.FindStringSubmatch(line); m != nil {
+			exc.Type, exc.Message = m[1], m[2]
+			return exc
+		}
+		break
+	}
+	// Cut off before the exception line
+	return nil
+}
+
+func signalName(sig int) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return "signal " + strconv.Itoa(sig)
+}
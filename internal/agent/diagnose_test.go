@@ -0,0 +1,191 @@
+package agent
+
+import (
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+const cudaOOMTail = `Epoch 3:  41%|████      | 412/1000 [02:13<03:10,  3.09it/s]
+Traceback (most recent call last):
+  File "/work/train.py", line 88, in <module>
+    main()
+  File "/work/train.py", line 71, in main
+    loss = model(batch).loss
+           ^^^^^^^^^^^^
+  File "/venv/lib/python3.11/site-packages/torch/nn/modules/module.py", line 1511, in _wrapped_call_impl
+    return self._call_impl(*args, **kwargs)
+           ^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^
+torch.OutOfMemoryError: CUDA out of memory. Tried to allocate 2.00 GiB. GPU 0 has a total capacity of 79.15 GiB of which 1.06 GiB is free. Of the allocated memory 75.20 GiB is allocated by PyTorch, and 1.51 GiB is reserved by PyTorch but unallocated.`
+
+const ncclTail = `[default1]:Traceback (most recent call last):
+[default1]:  File "/work/train.py", line 40, in <module>
+[default1]:    dist.all_reduce(t)
+[default1]:  File "/venv/lib/python3.11/site-packages/torch/distributed/c10d_logger.py", line 72, in wrapper
+[default1]:    return func(*args, **kwargs)
+[default1]:torch.distributed.DistBackendError: NCCL error in: ../torch/csrc/distributed/c10d/ProcessGroupNCCL.cpp:1970, unhandled system error (run with NCCL_DEBUG=INFO for details), NCCL version 2.19.3
+E0612 10:21:07.913000 140231 torch/distributed/elastic/multiprocessing/api.py:826] failed (exitcode: 1) local_rank: 1 (pid: 2291) of binary: /venv/bin/python
+Traceback (most recent call last):
+  File "/venv/bin/torchrun", line 8, in <module>
+    sys.exit(main())
+  File "/venv/lib/python3.11/site-packages/torch/distributed/run.py", line 870, in run
+    elastic_launch(
+torch.distributed.elastic.multiprocessing.errors.ChildFailedError:
+============================================================
+/work/train.py FAILED`
+
+const importTail = `Traceback (most recent call last):
+  File "/work/train.py", line 3, in <module>
+    from transformers import AutoModel
+ModuleNotFoundError: No module named 'transformers'`
+
+const chainedTail = `Traceback (most recent call last):
+  File "/work/data.py", line 12, in load
+    return json.loads(text)
+json.decoder.JSONDecodeError: Expecting value: line 1 column 1 (char 0)
+
+During handling of the above exception, another exception occurred:
+
+Traceback (most recent call last):
+  File "/work/train.py", line 9, in <module>
+    load()
+  File "/work/data.py", line 14, in load
+    raise ValueError("bad shard")
+ValueError: bad shard`
+
+func TestDiagnose(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      int
+		tail      string
+		summary   string
+		class     string
+		signal    string
+		exception string
+	}{
+		{
+			name:      "cuda oom",
+			code:      1,
+			tail:      cudaOOMTail,
+			summary:   "torch.OutOfMemoryError: CUDA out of memory. Tried to allocate 2.00 GiB. GPU 0 has a total capacity of 79.15 GiB of which 1.06 GiB is free. Of the allocated memory 75.20 GiB is allocated by PyTorch, and 1.51 GiB is reserved by PyTorch but unallocated.",
+			class:     exitClassCUDAOOM,
+			exception: "torch.OutOfMemoryError",
+		},
+		{
+			name:      "nccl",
+			code:      1,
+			tail:      ncclTail,
+			summary:   "torch.distributed.DistBackendError: NCCL error in: ../torch/csrc/distributed/c10d/ProcessGroupNCCL.cpp:1970, unhandled system error (run with NCCL_DEBUG=INFO for details), NCCL version 2.19.3",
+			class:     exitClassNCCL,
+			exception: "torch.distributed.DistBackendError",
+		},
+		{
+			name:      "import",
+			code:      1,
+			tail:      importTail,
+			summary:   "ModuleNotFoundError: No module named 'transformers'",
+			class:     exitClassImport,
+			exception: "ModuleNotFoundError",
+		},
+		{
+			name:      "chained exception",
+			code:      1,
+			tail:      chainedTail,
+			summary:   "ValueError: bad shard",
+			class:     exitClassException,
+			exception: "ValueError",
+		},
+		{
+			name:    "oom killed",
+			code:    137,
+			tail:    "Epoch 1:  12%|█▏        | 120/1000",
+			summary: "killed by SIGKILL (exit code 137), most likely out of memory",
+			class:   exitClassOOMKilled,
+			signal:  "SIGKILL",
+		},
+		{
+			name:    "segfault",
+			code:    139,
+			tail:    "Fatal Python error: Segmentation fault",
+			summary: "killed by SIGSEGV (exit code 139)",
+			class:   exitClassSignal,
+			signal:  "SIGSEGV",
+		},
+		{
+			name:    "exit code",
+			code:    2,
+			tail:    "usage: train.py [-h] --lr LR\ntrain.py: error: the following arguments are required: --lr",
+			summary: "process exited with code 2",
+			class:   exitClassCode,
+		},
+		{
+			name:    "traceback cut off",
+			code:    1,
+			tail:    "Traceback (most recent call last):\n  File \"/work/train.py\", line 3, in <module>",
+			summary: "process exited with code 1",
+			class:   exitClassCode,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tail := strings.Split(tt.tail, "\n")
+			summary, d := Diagnose(tt.code, tail)
+			if summary != tt.summary {
+				t.Errorf("summary = %q, want %q", summary, tt.summary)
+			}
+			if d.ExitClass != tt.class || d.Signal != tt.signal {
+				t.Errorf("class %q, signal %q; want %q, %q", d.ExitClass, d.Signal, tt.class, tt.signal)
+			}
+			var exception string
+			if d.Exception != nil {
+				exception = d.Exception.Type
+			}
+			if exception != tt.exception {
+				t.Errorf("exception %q, want %q", exception, tt.exception)
+			}
+			if !slices.Equal(d.StderrTail, tail) {
+				t.Errorf("stderr tail %q, want %q", d.StderrTail, tail)
+			}
+		})
+	}
+}
+
+func TestParseTracebackFrames(t *testing.T) {
+	got := parseTraceback(strings.Split(cudaOOMTail, "\n"))
+	want := []api.TracebackFrame{
+		{File: "/work/train.py", Line: 88, Function: "<module>", Code: "main()"},
+		{File: "/work/train.py", Line: 71, Function: "main", Code: "loss = model(batch).loss"},
+		{File: "/venv/lib/python3.11/site-packages/torch/nn/modules/module.py", Line: 1511, Function: "_wrapped_call_impl", Code: "return self._call_impl(*args, **kwargs)"},
+	}
+	if got == nil || !reflect.DeepEqual(got.Frames, want) {
+		t.Errorf("frames = %+v, want %+v", got, want)
+	}
+
+	// Ranks' frames lose their prefix
+	got = parseTraceback(strings.Split(ncclTail, "\n"))
+	if got == nil || len(got.Frames) != 2 || got.Frames[0].Code != "dist.all_reduce(t)" {
+		t.Errorf("rank frames = %+v", got)
+	}
+}
+
+func TestStderrTail(t *testing.T) {
+	tail := NewStderrTail()
+	for i := range stderrTailLines + 5 {
+		tail.Add(strings.Repeat("x", i%3))
+	}
+	tail.Add(strings.Repeat("y", stderrTailLineLen+1))
+	lines := tail.Lines()
+	if len(lines) != stderrTailLines {
+		t.Fatalf("kept %d lines, want %d", len(lines), stderrTailLines)
+	}
+	if got, want := lines[len(lines)-1], strings.Repeat("y", stderrTailLineLen)+"..."; got != want {
+		t.Errorf("long line kept as %d bytes, want it cut to %d", len(got), len(want))
+	}
+	// The oldest six lines were dropped
+	if lines[0] != strings.Repeat("x", 6%3) || lines[1] != strings.Repeat("x", 7%3) {
+		t.Errorf("oldest kept lines %q", lines[:2])
+	}
+}
@@ -0,0 +1,83 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+	"github.com/foundling-ai/mlflare/internal/version"
+)
+
+// captureEnvironment records what a run is about to run on: the agent and
+// host, the Python and packages of its venv, and its GPUs. A SLURM job runs
+// on another node, so the host's kernel and GPUs aren't recorded for it.
+// Whatever can't be found out is logged and left empty.
+func (a *Agent) captureEnvironment(ctx context.Context, executor, image, pythonBin string, gpus []int) api.RunEnvironment {
+	env := api.RunEnvironment{
+		Hostname:     a.cfg.Hostname,
+		AgentVersion: version.Version,
+		Executor:     executor,
+		Image:        image,
+	}
+
+	if executor != executorContainer {
+		var err error
+		if env.Python, err = pythonVersion(ctx, pythonBin); err != nil {
+			a.logger.Warn("getting Python version failed", "error", err)
+		}
+		if env.Packages, err = pipFreeze(ctx, pythonBin, a.cfg.UVBin); err != nil {
+			a.logger.Warn("listing installed packages failed", "error", err)
+		}
+	}
+	if executor == executorSlurm {
+		return env
+	}
+
+	if release, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		env.Kernel = strings.TrimSpace(string(release))
+	}
+	if _, err := exec.LookPath(a.cfg.NvidiaSMIBin); err != nil {
+		return env
+	}
+	var err error
+	if env.GPUs, env.DriverVersion, err = gpuModels(ctx, a.cfg.NvidiaSMIBin, gpus); err != nil {
+		a.logger.Warn("getting GPU models failed", "error", err)
+	}
+	if env.CUDAVersion, err = cudaVersion(ctx, a.cfg.NvidiaSMIBin); err != nil {
+		a.logger.Warn("getting CUDA version failed", "error", err)
+	}
+	return env
+}
+
+func pythonVersion(ctx context.Context, python string) (string, error) {
+	out, err := exec.CommandContext(ctx, python, "-c", "import platform; print(platform.python_version())").Output()
+	if err != nil {
+		return "", fmt.Errorf("running %s: %w", python, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// pipFreeze returns the packages installed for python as pip freeze lists
+// them. Venvs created by uv have no pip, so uv lists theirs.
+func pipFreeze(ctx context.Context, python, uvBin string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, python, "-m", "pip", "freeze").Output()
+	if err != nil {
+		if _, lookErr := exec.LookPath(uvBin); lookErr != nil {
+			return nil, fmt.Errorf("running pip freeze: %w", err)
+		}
+		out, err = exec.CommandContext(ctx, uvBin, "pip", "freeze", "--python", python).Output()
+		if err != nil {
+			return nil, fmt.Errorf("running uv pip freeze: %w", err)
+		}
+	}
+	var packages []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			packages = append(packages, line)
+		}
+	}
+	return packages, nil
+}
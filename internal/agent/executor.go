@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Executor names, as set in the agent's config and recorded in a run's state.
+const (
+	executorLocal     = "local"
+	executorContainer = "container"
+	executorSlurm     = "slurm"
+)
+
+// Executor starts runs' processes and tracks them. Wherever the process
+// runs, its stdout, stderr and exit code end up in files in the run's control
+// dir, which is how the agent follows it and how a restarted agent picks it
+// up again.
+type Executor interface {
+	// Start starts the process described by spec.
+	Start(spec SubprocessSpec, logger *slog.Logger) (*Process, error)
+
+	// Alive reports whether a started process is still running.
+	Alive(p *Process) bool
+
+	// Signal sends sig to the process. SIGKILL stops it for good.
+	Signal(p *Process, sig syscall.Signal) error
+}
+
+// localExecutor runs the entrypoint as a process on this host, under the
+// supervisor.
+type localExecutor struct{}
+
+func (e localExecutor) Start(spec SubprocessSpec, logger *slog.Logger) (*Process, error) {
+	env := spec.Env
+	if len(spec.GPUs) > 0 {
+		env = append(env, "CUDA_VISIBLE_DEVICES="+gpuList(spec.GPUs))
+	}
+	return startSupervised(e, spec, spec.argv(), env, logger)
+}
+
+func (localExecutor) Alive(p *Process) bool {
+	st, err := readProcStat(p.PID)
+	return err == nil && st.startTime == p.StartTime
+}
+
+// Signal signals the supervisor, which passes SIGTERM and SIGINT on to the
+// command's process group. SIGKILL can't be passed on, so it goes to the
+// group directly, and the supervisor records the exit code; only the
+// supervisor of a command that never started is killed itself.
+func (e localExecutor) Signal(p *Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL && e.Alive(p) {
+		if pgid, ok := readIntFile(filepath.Join(p.ControlDir, pgidFile)); ok && pgid > 1 {
+			return syscall.Kill(-pgid, syscall.SIGKILL)
+		}
+	}
+	if p.cmd != nil {
+		return p.cmd.Process.Signal(sig)
+	}
+	if !e.Alive(p) {
+		return os.ErrProcessDone
+	}
+	return syscall.Kill(p.PID, sig)
+}
+
+// containerExecutor runs the entrypoint in a container with docker or podman.
+// The container runtime's client runs under the supervisor, which forwards
+// signals to it, and it forwards them to the container. The run's work dir
+// and the agent's caches are mounted at the same paths inside the container,
+// so dataset links resolve; the image provides Python and the dependencies.
+type containerExecutor struct {
+	local   localExecutor
+	runtime string
+	mounts  []string
+}
+
+func (e containerExecutor) Start(spec SubprocessSpec, logger *slog.Logger) (*Process, error) {
+	if spec.Image == "" {
+		return nil, fmt.Errorf("no container image for the run")
+	}
+	name := containerName(spec.Name)
+
+	// A container left from an earlier attempt would block the name
+	exec.Command(e.runtime, "rm", "--force", name).Run()
+
+	args := []string{e.runtime, "run", "--rm", "--name", name,
+		// PyTorch data loaders share memory between workers, more than the
+		// default /dev/shm allows
+		"--ipc=host",
+		"--workdir", spec.WorkDir,
+		"--volume", spec.WorkDir + ":" + spec.WorkDir,
+	}
+	for _, m := range e.mounts {
+		args = append(args, "--volume", m+":"+m)
+	}
+	for _, kv := range spec.Env {
+		args = append(args, "--env", kv)
+	}
+	if len(spec.GPUs) > 0 {
+		if filepath.Base(e.runtime) == "podman" {
+			for _, id := range spec.GPUs {
+				args = append(args, "--device", "nvidia.com/gpu="+strconv.Itoa(id))
+			}
+		} else {
+			args = append(args, "--gpus", `"device=`+gpuList(spec.GPUs)+`"`)
+		}
+	}
+	args = append(args, spec.Image)
+	args = append(args, spec.argv()...)
+
+	logger.Info("starting container", "image", spec.Image, "name", name, "runtime", e.runtime)
+	return startSupervised(e, spec, args, nil, logger)
+}
+
+func (e containerExecutor) Alive(p *Process) bool {
+	return e.local.Alive(p)
+}
+
+// Signal forwards SIGTERM through the runtime's client. SIGKILL would only
+// kill the client, so the container is killed through the runtime first.
+func (e containerExecutor) Signal(p *Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		// The control dir is named after the run
+		exec.Command(e.runtime, "kill", containerName(filepath.Base(p.ControlDir))).Run()
+	}
+	return e.local.Signal(p, sig)
+}
+
+func containerName(runID string) string {
+	return "mlflare-" + runID
+}
+
+// slurmExecutor submits the entrypoint as a SLURM batch job. The job writes
+// its output and exit code straight to the control dir, so the agent's
+// work_dir must be on a filesystem the compute nodes share, and the venv
+// there must work on them.
+type slurmExecutor struct {
+	binDir    string
+	partition string
+	args      []string
+}
+
+// slurmScript runs the command in the background so the shell can forward
+// SIGTERM from scancel to it, then records its exit code.
+const slurmScript = `#!/bin/sh
+trap 'kill -TERM "$child" 2>/dev/null' TERM INT
+%s &
+child=$!
+wait "$child"
+code=$?
+while kill -0 "$child" 2>/dev/null; do
+	wait "$child"
+	code=$?
+done
+echo "$code" > %s.tmp && mv %s.tmp %s
+`
+
+func (e slurmExecutor) Start(spec SubprocessSpec, logger *slog.Logger) (*Process, error) {
+	stdout, stderr, err := createConsoleFiles(spec.ControlDir)
+	if err != nil {
+		return nil, err
+	}
+	stdout.Close()
+	stderr.Close()
+
+	argv := spec.argv()
+	exitFile := shellQuote(filepath.Join(spec.ControlDir, exitCodeFile))
+	script := filepath.Join(spec.ControlDir, "job.sh")
+	body := fmt.Sprintf(slurmScript, shellJoin(argv), exitFile, exitFile, exitFile)
+	if err := os.WriteFile(script, []byte(body), 0o755); err != nil {
+		return nil, fmt.Errorf("writing job script: %w", err)
+	}
+
+	args := []string{"--parsable",
+		"--job-name", "mlflare-" + spec.Name,
+		"--chdir", spec.WorkDir,
+		"--output", filepath.Join(spec.ControlDir, stdoutFile),
+		"--error", filepath.Join(spec.ControlDir, stderrFile),
+		"--open-mode", "append",
+	}
+	if e.partition != "" {
+		args = append(args, "--partition", e.partition)
+	}
+	if spec.GPUCount > 0 {
+		args = append(args, "--gpus", strconv.Itoa(spec.GPUCount))
+	}
+	args = append(args, e.args...)
+	args = append(args, script)
+
+	// sbatch passes its environment on to the job
+	cmd := exec.Command(e.bin("sbatch"), args...)
+	cmd.Env = append(os.Environ(), spec.Env...)
+	var errOut bytes.Buffer
+	cmd.Stderr = &errOut
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("sbatch: %w: %s", err, strings.TrimSpace(errOut.String()))
+	}
+	// --parsable prints "<job id>[;<cluster>]"
+	jobID, _, _ := strings.Cut(strings.TrimSpace(string(out)), ";")
+	if jobID == "" {
+		return nil, fmt.Errorf("sbatch printed no job id")
+	}
+
+	logger.Info("submitted SLURM job", "job_id", jobID)
+	return &Process{JobID: jobID, ControlDir: spec.ControlDir, executor: e}, nil
+}
+
+// Alive asks squeue about the job. A job squeue no longer knows, or one that
+// recorded its exit code, is done; if squeue fails for another reason, such
+// as the controller being unreachable, the job is assumed to still run.
+func (e slurmExecutor) Alive(p *Process) bool {
+	if _, ok := readIntFile(filepath.Join(p.ControlDir, exitCodeFile)); ok {
+		return false
+	}
+	var errOut bytes.Buffer
+	cmd := exec.Command(e.bin("squeue"), "--noheader", "--jobs", p.JobID, "--format", "%T")
+	cmd.Stderr = &errOut
+	out, err := cmd.Output()
+	if err != nil {
+		return !strings.Contains(errOut.String(), "Invalid job id")
+	}
+	switch strings.TrimSpace(string(out)) {
+	case "", "COMPLETED", "FAILED", "CANCELLED", "TIMEOUT", "OUT_OF_MEMORY", "NODE_FAIL", "PREEMPTED", "BOOT_FAIL", "DEADLINE":
+		return false
+	}
+	return true
+}
+
+// Signal sends SIGTERM or SIGINT to the job's batch script, which passes it
+// on to the command. SIGKILL cancels the job.
+func (e slurmExecutor) Signal(p *Process, sig syscall.Signal) error {
+	var args []string
+	switch sig {
+	case syscall.SIGKILL:
+		args = []string{p.JobID}
+	case syscall.SIGTERM:
+		args = []string{"--batch", "--signal", "TERM", p.JobID}
+	case syscall.SIGINT:
+		args = []string{"--batch", "--signal", "INT", p.JobID}
+	default:
+		return fmt.Errorf("can't send %v to a SLURM job", sig)
+	}
+	if out, err := exec.Command(e.bin("scancel"), args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("scancel: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (e slurmExecutor) bin(name string) string {
+	if e.binDir == "" {
+		return name
+	}
+	return filepath.Join(e.binDir, name)
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellJoin(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, a := range argv {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
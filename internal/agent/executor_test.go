@@ -0,0 +1,263 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func testSinks(t *testing.T) SubprocessSinks {
+	s := openTestSpool(t, t.TempDir(), 0)
+	return SubprocessSinks{
+		Metrics: NewMetricBatcher(s, "r1", time.Now(), testLogger),
+		Logs:    NewLogShipper(s, "r1", testLogger),
+		Stderr:  NewStderrTail(),
+	}
+}
+
+func loggedLines(l *LogShipper) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var lines []string
+	for _, line := range l.pending {
+		lines = append(lines, line.Stream+": "+line.Line)
+	}
+	return lines
+}
+
+// fakeDocker records its arguments and, for "run", runs the command after
+// the image like a container would.
+const fakeDocker = `echo "$@" >> "$0.calls"
+[ "$1" = run ] || exit 0
+while [ "$1" != test-image ]; do shift; done
+shift
+exec "$@"
+`
+
+func TestContainerExecutor(t *testing.T) {
+	bin := t.TempDir()
+	e := containerExecutor{runtime: writeScript(t, bin, "docker", fakeDocker), mounts: []string{"/cache"}}
+	work := t.TempDir()
+	spec := SubprocessSpec{
+		Name:       "r1",
+		WorkDir:    work,
+		Command:    []string{"sh", "-c", `echo out; echo err >&2; exit 3`},
+		GPUs:       []int{0, 1},
+		Image:      "test-image",
+		ControlDir: filepath.Join(t.TempDir(), "r1"),
+		Env:        []string{"A=1"},
+	}
+	p, err := e.Start(spec, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sinks := testSinks(t)
+	code, err := p.Follow(context.Background(), 0, 0, time.Second, sinks, testLogger)
+	if code != 3 || err == nil {
+		t.Errorf("Follow = %d, %v; want exit code 3", code, err)
+	}
+	if got, want := loggedLines(sinks.Logs), []string{"stderr: err", "stdout: out"}; !slices.Equal(slices.Sorted(slices.Values(got)), want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+
+	got := calls(t, bin, "docker")
+	want := []string{
+		"rm --force mlflare-r1",
+		"run --rm --name mlflare-r1 --ipc=host --workdir " + work + " --volume " + work + ":" + work +
+			" --volume /cache:/cache --env A=1 --gpus \"device=0,1\" test-image sh -c echo out; echo err >&2; exit 3",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("docker calls:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestContainerExecutorCancel(t *testing.T) {
+	bin := t.TempDir()
+	e := containerExecutor{runtime: writeScript(t, bin, "docker", fakeDocker)}
+	spec := SubprocessSpec{
+		Name:       "r1",
+		WorkDir:    t.TempDir(),
+		Command:    []string{"sleep", "30"},
+		Image:      "test-image",
+		ControlDir: filepath.Join(t.TempDir(), "r1"),
+	}
+	p, err := e.Start(spec, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { cancel(errRunCancelled) })
+	start := time.Now()
+	code, _ := p.Follow(ctx, 0, 0, 5*time.Second, testSinks(t), testLogger)
+	if code != 128+int(syscall.SIGTERM) {
+		t.Errorf("exit code %d, want %d", code, 128+int(syscall.SIGTERM))
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("cancel took %v", d)
+	}
+
+	// SIGKILL goes through the runtime, which the client can't pass on
+	e.Signal(p, syscall.SIGKILL)
+	if got := calls(t, bin, "docker"); !slices.Contains(got, "kill mlflare-r1") {
+		t.Errorf("docker calls %q, want a kill of the container", got)
+	}
+}
+
+// fakeSbatch records its arguments, runs the job script to completion with
+// its output where --output and --error point, and prints a parsable job id.
+const fakeSbatch = `echo "$@" >> "$0.calls"
+while [ $# -gt 1 ]; do
+	case "$1" in
+	--output) out=$2; shift ;;
+	--error) err=$2; shift ;;
+	esac
+	shift
+done
+sh "$1" >> "$out" 2>> "$err"
+echo "4242;cluster"
+`
+
+func TestSlurmExecutor(t *testing.T) {
+	bin := t.TempDir()
+	writeScript(t, bin, "sbatch", fakeSbatch)
+	e := slurmExecutor{binDir: bin, partition: "gpu", args: []string{"--time=1:00:00"}}
+	control := t.TempDir()
+	spec := SubprocessSpec{
+		Name:       "r1",
+		WorkDir:    t.TempDir(),
+		Command:    []string{"sh", "-c", `echo "$MLFLARE_RUN"; echo err >&2; exit 2`},
+		GPUCount:   2,
+		ControlDir: control,
+		Env:        []string{"MLFLARE_RUN=r1"},
+	}
+	p, err := e.Start(spec, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.JobID != "4242" {
+		t.Errorf("job id %q, want %q", p.JobID, "4242")
+	}
+	got := calls(t, bin, "sbatch")
+	want := []string{"--parsable --job-name mlflare-r1 --chdir " + spec.WorkDir +
+		" --output " + filepath.Join(control, stdoutFile) + " --error " + filepath.Join(control, stderrFile) +
+		" --open-mode append --partition gpu --gpus 2 --time=1:00:00 " + filepath.Join(control, "job.sh")}
+	if !slices.Equal(got, want) {
+		t.Errorf("sbatch calls:\n%q\nwant:\n%q", got, want)
+	}
+
+	// The job has recorded its exit code, so it is done without asking squeue
+	sinks := testSinks(t)
+	code, err := p.Follow(context.Background(), 0, 0, time.Second, sinks, testLogger)
+	if code != 2 || err == nil {
+		t.Errorf("Follow = %d, %v; want exit code 2", code, err)
+	}
+	if got, want := loggedLines(sinks.Logs), []string{"stderr: err", "stdout: r1"}; !slices.Equal(slices.Sorted(slices.Values(got)), want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestSlurmExecutorJobID(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", out: "4242", want: "4242"},
+		{name: "cluster", out: "4242;cluster", want: "4242"},
+		{name: "trailing newline", out: "4242\n", want: "4242"},
+		{name: "empty", out: "", wantErr: true},
+		{name: "cluster only", out: ";cluster", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin := t.TempDir()
+			writeScript(t, bin, "sbatch", "printf '%s' '"+tt.out+"'\n")
+			e := slurmExecutor{binDir: bin}
+			p, err := e.Start(SubprocessSpec{Name: "r1", WorkDir: bin, Command: []string{"true"}, ControlDir: t.TempDir()}, testLogger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Start err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && p.JobID != tt.want {
+				t.Errorf("job id %q, want %q", p.JobID, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlurmExecutorSbatchFails(t *testing.T) {
+	bin := t.TempDir()
+	writeScript(t, bin, "sbatch", "echo 'invalid partition' >&2\nexit 1\n")
+	e := slurmExecutor{binDir: bin}
+	_, err := e.Start(SubprocessSpec{Name: "r1", WorkDir: bin, Command: []string{"true"}, ControlDir: t.TempDir()}, testLogger)
+	if err == nil || !strings.Contains(err.Error(), "invalid partition") {
+		t.Errorf("Start err = %v, want sbatch's message", err)
+	}
+}
+
+func TestSlurmExecutorAlive(t *testing.T) {
+	tests := []struct {
+		name   string
+		squeue string
+		want   bool
+	}{
+		{"running", "echo RUNNING", true},
+		{"pending", "echo PENDING", true},
+		{"completed", "echo COMPLETED", false},
+		{"cancelled", "echo CANCELLED", false},
+		{"forgotten", "true", false},
+		{"invalid job id", "echo 'slurm_load_jobs error: Invalid job id specified' >&2; exit 1", false},
+		{"controller down", "echo 'Unable to contact slurm controller' >&2; exit 1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bin := t.TempDir()
+			writeScript(t, bin, "squeue", tt.squeue+"\n")
+			e := slurmExecutor{binDir: bin}
+			p := &Process{JobID: "4242", ControlDir: t.TempDir(), executor: e}
+			if got := e.Alive(p); got != tt.want {
+				t.Errorf("Alive = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlurmExecutorAliveAfterExitCode(t *testing.T) {
+	bin := t.TempDir()
+	writeScript(t, bin, "squeue", "echo RUNNING\n")
+	e := slurmExecutor{binDir: bin}
+	control := t.TempDir()
+	if err := os.WriteFile(filepath.Join(control, exitCodeFile), []byte("0\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if e.Alive(&Process{JobID: "4242", ControlDir: control, executor: e}) {
+		t.Error("job that recorded its exit code is alive")
+	}
+}
+
+func TestSlurmExecutorSignal(t *testing.T) {
+	bin := t.TempDir()
+	writeScript(t, bin, "scancel", `echo "$@" >> "$0.calls"`+"\n")
+	e := slurmExecutor{binDir: bin}
+	p := &Process{JobID: "4242", ControlDir: t.TempDir(), executor: e}
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL} {
+		if err := e.Signal(p, sig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Signal(p, syscall.SIGHUP); err == nil {
+		t.Error("SIGHUP sent to a SLURM job")
+	}
+	got := calls(t, bin, "scancel")
+	want := []string{"--batch --signal TERM 4242", "--batch --signal INT 4242", "4242"}
+	if !slices.Equal(got, want) {
+		t.Errorf("scancel calls %q, want %q", got, want)
+	}
+}
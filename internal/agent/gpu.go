@@ -0,0 +1,228 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sysMetricPrefix is reserved for metrics sampled by the agent itself.
+// Metrics under it emitted by training code are dropped.
+const sysMetricPrefix = "sys/"
+
+// gpuQueryFields are the nvidia-smi fields sampled per GPU, in query order,
+// with the metric suffix each one is reported under.
+var gpuQueryFields = []struct {
+	query  string
+	metric string
+}{
+	{"utilization.gpu", "utilization"},
+	{"memory.used", "memory_used_mb"},
+	{"memory.total", "memory_total_mb"},
+	{"temperature.gpu", "temperature_c"},
+	{"power.draw", "power_w"},
+}
+
+// detectGPUs returns the indices of the GPUs nvidia-smi reports, or none if
+// nvidia-smi is not installed.
+func detectGPUs(ctx context.Context, bin string) ([]int, error) {
+	if _, err := exec.LookPath(bin); err != nil {
+		return nil, nil
+	}
+	out, err := exec.CommandContext(ctx, bin, "--query-gpu=index", "--format=csv,noheader").Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w", bin, err)
+	}
+	return parseGPUList(strings.ReplaceAll(strings.TrimSpace(string(out)), "\n", ","))
+}
+
+// gpuProcesses returns the PIDs of the processes nvidia-smi reports using
+// the given GPUs.
+func gpuProcesses(ctx context.Context, bin string, devices []int) ([]int, error) {
+	out, err := exec.CommandContext(ctx, bin,
+		"--query-compute-apps=pid",
+		"--format=csv,noheader",
+		"--id="+gpuList(devices),
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w", bin, err)
+	}
+	var pids []int
+	for _, f := range strings.Fields(string(out)) {
+		if pid, err := strconv.Atoi(f); err == nil && !slices.Contains(pids, pid) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids, nil
+}
+
+// cudaVersionRe matches the CUDA version in the header nvidia-smi prints.
+var cudaVersionRe = regexp.MustCompile(`CUDA Version:\s*([\d.]+)`)
+
+// gpuModels returns the model of each of the given GPUs, and the driver
+// version.
+func gpuModels(ctx context.Context, bin string, devices []int) (models []string, driver string, err error) {
+	out, err := exec.CommandContext(ctx, bin, "--query-gpu=index,name,driver_version", "--format=csv,noheader").Output()
+	if err != nil {
+		return nil, "", fmt.Errorf("running %s: %w", bin, err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			continue
+		}
+		driver = strings.TrimSpace(fields[2])
+		if index, err := strconv.Atoi(strings.TrimSpace(fields[0])); err == nil && slices.Contains(devices, index) {
+			models = append(models, strings.TrimSpace(fields[1]))
+		}
+	}
+	return models, driver, nil
+}
+
+// cudaVersion returns the CUDA version nvidia-smi reports, the newest the
+// driver supports.
+func cudaVersion(ctx context.Context, bin string) (string, error) {
+	out, err := exec.CommandContext(ctx, bin).Output()
+	if err != nil {
+		return "", fmt.Errorf("running %s: %w", bin, err)
+	}
+	if m := cudaVersionRe.FindSubmatch(out); m != nil {
+		return string(m[1]), nil
+	}
+	return "", fmt.Errorf("no CUDA version in %s output", bin)
+}
+
+// parseGPUList parses a comma-separated list of GPU indices such as "0,1,3".
+func parseGPUList(s string) ([]int, error) {
+	var ids []int
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		id, err := strconv.Atoi(f)
+		if err != nil || id < 0 {
+			return nil, fmt.Errorf("invalid GPU index %q", f)
+		}
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// GPUSampler periodically queries nvidia-smi and records per-GPU metrics
+// under sys/gpu{i}/.
+type GPUSampler struct {
+	bin      string
+	interval time.Duration
+	batcher  *MetricBatcher
+	logger   *slog.Logger
+
+	// devices, if set, limits sampling to the GPUs a run was given
+	devices []int
+}
+
+func NewGPUSampler(bin string, interval time.Duration, batcher *MetricBatcher, logger *slog.Logger) *GPUSampler {
+	return &GPUSampler{
+		bin:      bin,
+		interval: interval,
+		batcher:  batcher,
+		logger:   logger,
+	}
+}
+
+// SetDevices limits sampling to the given GPU indices.
+func (s *GPUSampler) SetDevices(ids []int) {
+	s.devices = ids
+}
+
+// Run samples until ctx is done. It returns immediately if the interval is
+// zero or nvidia-smi is not available.
+func (s *GPUSampler) Run(ctx context.Context) {
+	if s.interval <= 0 {
+		return
+	}
+	if _, err := exec.LookPath(s.bin); err != nil {
+		s.logger.Info("nvidia-smi not found, GPU telemetry disabled", "bin", s.bin)
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		values, err := s.Sample(ctx)
+		if err != nil {
+			s.logger.Warn("GPU sample failed", "error", err)
+		} else if len(values) > 0 {
+			s.batcher.Add(values)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample runs nvidia-smi once and returns the metrics for every GPU.
+func (s *GPUSampler) Sample(ctx context.Context) (map[string]float64, error) {
+	queries := make([]string, 0, len(gpuQueryFields)+1)
+	queries = append(queries, "index")
+	for _, f := range gpuQueryFields {
+		queries = append(queries, f.query)
+	}
+
+	cmd := exec.CommandContext(ctx, s.bin,
+		"--query-gpu="+strings.Join(queries, ","),
+		"--format=csv,noheader,nounits",
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %s: %w", s.bin, err)
+	}
+	return parseGPUQuery(out, s.devices)
+}
+
+// parseGPUQuery parses nvidia-smi CSV output, keeping only the given devices
+// if any are. Fields reported as "[N/A]" or "[Not Supported]" are skipped.
+func parseGPUQuery(out []byte, devices []int) (map[string]float64, error) {
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != len(gpuQueryFields)+1 {
+			return nil, fmt.Errorf("unexpected nvidia-smi line: %q", line)
+		}
+		index, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return nil, fmt.Errorf("parsing GPU index %q: %w", fields[0], err)
+		}
+		if len(devices) > 0 && !slices.Contains(devices, index) {
+			continue
+		}
+		for i, f := range gpuQueryFields {
+			v, err := strconv.ParseFloat(strings.TrimSpace(fields[i+1]), 64)
+			if err != nil {
+				continue
+			}
+			values[fmt.Sprintf("%sgpu%d/%s", sysMetricPrefix, index, f.metric)] = v
+		}
+	}
+	return values, scanner.Err()
+}
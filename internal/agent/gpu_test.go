@@ -0,0 +1,125 @@
+package agent
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseGPUQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		devices []int
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name: "two GPUs",
+			out:  "0, 97, 30561, 81559, 64, 287.45\n1, 0, 4, 81559, 31, 61.02\n",
+			want: map[string]float64{
+				"sys/gpu0/utilization": 97, "sys/gpu0/memory_used_mb": 30561, "sys/gpu0/memory_total_mb": 81559,
+				"sys/gpu0/temperature_c": 64, "sys/gpu0/power_w": 287.45,
+				"sys/gpu1/utilization": 0, "sys/gpu1/memory_used_mb": 4, "sys/gpu1/memory_total_mb": 81559,
+				"sys/gpu1/temperature_c": 31, "sys/gpu1/power_w": 61.02,
+			},
+		},
+		{
+			name: "not available",
+			out:  "0, 12, 1024, 16384, 40, [N/A]\n",
+			want: map[string]float64{
+				"sys/gpu0/utilization": 12, "sys/gpu0/memory_used_mb": 1024, "sys/gpu0/memory_total_mb": 16384,
+				"sys/gpu0/temperature_c": 40,
+			},
+		},
+		{
+			name: "not supported",
+			out:  "0, [Not Supported], 1024, 16384, [Not Supported], [Not Supported]\n",
+			want: map[string]float64{"sys/gpu0/memory_used_mb": 1024, "sys/gpu0/memory_total_mb": 16384},
+		},
+		{
+			name:    "devices",
+			out:     "0, 97, 30561, 81559, 64, 287.45\n1, 5, 4, 81559, 31, 61.02\n",
+			devices: []int{1},
+			want: map[string]float64{
+				"sys/gpu1/utilization": 5, "sys/gpu1/memory_used_mb": 4, "sys/gpu1/memory_total_mb": 81559,
+				"sys/gpu1/temperature_c": 31, "sys/gpu1/power_w": 61.02,
+			},
+		},
+		{
+			name: "blank lines",
+			out:  "\n0, 1, 2, 3, 4, 5\n\n",
+			want: map[string]float64{
+				"sys/gpu0/utilization": 1, "sys/gpu0/memory_used_mb": 2, "sys/gpu0/memory_total_mb": 3,
+				"sys/gpu0/temperature_c": 4, "sys/gpu0/power_w": 5,
+			},
+		},
+		{name: "empty", out: "", want: map[string]float64{}},
+		{name: "missing fields", out: "0, 97, 30561\n", wantErr: true},
+		{name: "bad index", out: "GPU-0, 97, 30561, 81559, 64, 287.45\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseGPUQuery([]byte(tt.out), tt.devices)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseGPUQuery err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("parseGPUQuery = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseGPUList(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: "0", want: []int{0}},
+		{in: "3, 1,0", want: []int{0, 1, 3}},
+		{in: "1,1", want: []int{1}},
+		{in: "0,,2", want: []int{0, 2}},
+		{in: "-1", wantErr: true},
+		{in: "GPU-0", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseGPUList(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGPUList(%q) err = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseGPUList(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGPUSamplerSample(t *testing.T) {
+	bin := t.TempDir()
+	smi := writeScript(t, bin, "nvidia-smi", `echo "$@" >> "$0.calls"
+echo "0, 50, 100, 200, 30, 40.5"
+echo "1, 60, 100, 200, 30, [N/A]"
+`)
+	s := NewGPUSampler(smi, time.Second, nil, testLogger)
+	s.SetDevices([]int{1})
+	got, err := s.Sample(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{
+		"sys/gpu1/utilization": 60, "sys/gpu1/memory_used_mb": 100, "sys/gpu1/memory_total_mb": 200,
+		"sys/gpu1/temperature_c": 30,
+	}
+	if !maps.Equal(got, want) {
+		t.Errorf("Sample = %v, want %v", got, want)
+	}
+	wantCalls := []string{"--query-gpu=index,utilization.gpu,memory.used,memory.total,temperature.gpu,power.draw --format=csv,noheader,nounits"}
+	if got := calls(t, bin, "nvidia-smi"); !slices.Equal(got, wantCalls) {
+		t.Errorf("nvidia-smi calls %q, want %q", got, wantCalls)
+	}
+}
@@ -0,0 +1,95 @@
+package agent
+
+import (
+	"slices"
+	"sync"
+)
+
+// gpuPool hands out the machine's GPUs to concurrent runs. Each run holds the
+// GPUs it was given until it finishes. On a machine without GPUs the pool has
+// a single slot, so runs go one at a time.
+type gpuPool struct {
+	mu    sync.Mutex
+	all   []int
+	free  []int
+	runs  int
+	freed chan struct{}
+}
+
+func newGPUPool(ids []int) *gpuPool {
+	return &gpuPool{
+		all:   ids,
+		free:  slices.Clone(ids),
+		freed: make(chan struct{}, 1),
+	}
+}
+
+// counts returns the GPUs to advertise at checkin.
+func (p *gpuPool) counts() (total, free int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.all), len(p.free)
+}
+
+// available reports whether another run could be started.
+func (p *gpuPool) available() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.all) == 0 {
+		return p.runs == 0
+	}
+	return len(p.free) > 0
+}
+
+// acquire takes n GPUs, at least one, for a run. On a machine without GPUs it
+// takes the single slot and returns no GPUs. ok is false if not enough are
+// free.
+func (p *gpuPool) acquire(n int) (ids []int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.all) == 0 {
+		if p.runs > 0 {
+			return nil, false
+		}
+		p.runs++
+		return nil, true
+	}
+	n = max(n, 1)
+	if n > len(p.free) {
+		return nil, false
+	}
+	ids = slices.Clone(p.free[:n])
+	p.free = p.free[n:]
+	p.runs++
+	return ids, true
+}
+
+// claim takes the GPUs a recovered run was already using. GPUs no longer in
+// the pool are left out of the result.
+func (p *gpuPool) claim(ids []int) []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var held []int
+	for _, id := range ids {
+		if i := slices.Index(p.free, id); i >= 0 {
+			p.free = slices.Delete(p.free, i, i+1)
+			held = append(held, id)
+		}
+	}
+	p.runs++
+	return held
+}
+
+// release returns a finished run's GPUs to the pool.
+func (p *gpuPool) release(ids []int) {
+	p.mu.Lock()
+	p.free = append(p.free, ids...)
+	slices.Sort(p.free)
+	p.runs--
+	p.mu.Unlock()
+
+	select {
+	case p.freed <- struct{}{}:
+	default:
+	}
+}
@@ -8,9 +8,13 @@ import (
 	"github.com/foundling-ai/mlflare/internal/api"
 )
 
-const heartbeatInterval = 2 * time.Minute
+// heartbeatInterval also bounds how long a cancel request takes to reach the
+// agent, so it is kept well below the Worker's 5 minute heartbeat timeout.
+const heartbeatInterval = 30 * time.Second
 
-func RunHeartbeat(ctx context.Context, client *api.Client, logger *slog.Logger) {
+// RunHeartbeat keeps the run alive on the Worker and calls onCancel once if the
+// Worker reports that the run has been cancelled.
+func RunHeartbeat(ctx context.Context, client *api.Client, runID string, onCancel func(), logger *slog.Logger) {
 	ticker := time.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
 
@@ -19,10 +23,16 @@ func RunHeartbeat(ctx context.Context, client *api.Client, logger *slog.Logger)
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if err := client.Heartbeat(ctx); err != nil {
+			resp, err := client.Heartbeat(ctx, api.HeartbeatRequest{RunID: runID})
+			if err != nil {
 				logger.Error("heartbeat failed", "error", err)
-			} else {
-				logger.Debug("heartbeat sent")
+				continue
+			}
+			logger.Debug("heartbeat sent")
+			if resp.Cancel {
+				logger.Info("cancel requested by worker", "run_id", runID)
+				onCancel()
+				return
 			}
 		}
 	}
@@ -0,0 +1,322 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat. It is 100
+// on every Linux architecture the agent is built for.
+const clockTicks = 100
+
+// HostSampler periodically reads /proc and records metrics for the training
+// process tree (sys/proc/*), host memory (sys/host/*), disk usage of the work
+// dir (sys/disk/*) and network throughput (sys/net/*).
+type HostSampler struct {
+	workDir  string
+	interval time.Duration
+	batcher  *MetricBatcher
+	logger   *slog.Logger
+
+	pid  atomic.Int64
+	prev *hostCounters
+}
+
+// hostCounters are the cumulative counters rates are derived from.
+type hostCounters struct {
+	at         time.Time
+	pid        int
+	cpuTicks   uint64
+	readBytes  uint64
+	writeBytes uint64
+	rxBytes    uint64
+	txBytes    uint64
+}
+
+func NewHostSampler(workDir string, interval time.Duration, batcher *MetricBatcher, logger *slog.Logger) *HostSampler {
+	return &HostSampler{
+		workDir:  workDir,
+		interval: interval,
+		batcher:  batcher,
+		logger:   logger,
+	}
+}
+
+// SetPID sets the root of the process tree to sample.
+func (s *HostSampler) SetPID(pid int) {
+	s.pid.Store(int64(pid))
+}
+
+// Run samples until ctx is done. It returns immediately if the interval is
+// zero.
+func (s *HostSampler) Run(ctx context.Context) {
+	if s.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		if values := s.Sample(); len(values) > 0 {
+			s.batcher.Add(values)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample takes one reading. Rates are only reported from the second call on.
+func (s *HostSampler) Sample() map[string]float64 {
+	values := make(map[string]float64)
+	cur := &hostCounters{at: time.Now(), pid: int(s.pid.Load())}
+
+	if pid := cur.pid; pid > 0 {
+		pids := processTree(pid)
+		var rss uint64
+		for _, p := range pids {
+			st, err := readProcStat(p)
+			if err != nil {
+				continue
+			}
+			cur.cpuTicks += st.utime + st.stime
+			rss += st.rssPages * uint64(os.Getpagesize())
+			if r, w, err := readProcIO(p); err == nil {
+				cur.readBytes += r
+				cur.writeBytes += w
+			}
+		}
+		values["sys/proc/count"] = float64(len(pids))
+		values["sys/proc/rss_mb"] = float64(rss) / (1 << 20)
+	}
+
+	if total, avail, err := readMeminfo(); err == nil {
+		values["sys/host/memory_total_mb"] = float64(total) / (1 << 20)
+		values["sys/host/memory_used_mb"] = float64(total-avail) / (1 << 20)
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(s.workDir, &fs); err == nil {
+		total := fs.Blocks * uint64(fs.Bsize)
+		free := fs.Bavail * uint64(fs.Bsize)
+		values["sys/disk/used_gb"] = float64(total-free) / (1 << 30)
+		values["sys/disk/free_gb"] = float64(free) / (1 << 30)
+		if total > 0 {
+			values["sys/disk/used_percent"] = 100 * float64(total-free) / float64(total)
+		}
+	}
+
+	if rx, tx, err := readNetDev(); err == nil {
+		cur.rxBytes, cur.txBytes = rx, tx
+	}
+
+	if prev := s.prev; prev != nil {
+		elapsed := cur.at.Sub(prev.at).Seconds()
+		if elapsed > 0 {
+			if cur.pid > 0 && cur.pid == prev.pid {
+				values["sys/proc/cpu_percent"] = 100 * rate(prev.cpuTicks, cur.cpuTicks, elapsed) / clockTicks
+				values["sys/proc/read_bytes_per_s"] = rate(prev.readBytes, cur.readBytes, elapsed)
+				values["sys/proc/write_bytes_per_s"] = rate(prev.writeBytes, cur.writeBytes, elapsed)
+			}
+			values["sys/net/rx_bytes_per_s"] = rate(prev.rxBytes, cur.rxBytes, elapsed)
+			values["sys/net/tx_bytes_per_s"] = rate(prev.txBytes, cur.txBytes, elapsed)
+		}
+	}
+	s.prev = cur
+
+	return values
+}
+
+// rate returns the per-second increase of a counter. Counters summed over a
+// process tree drop when a child exits, which is reported as zero.
+func rate(prev, cur uint64, elapsed float64) float64 {
+	if cur < prev {
+		return 0
+	}
+	return float64(cur-prev) / elapsed
+}
+
+// processTree returns root and all of its descendants.
+func processTree(root int) []int {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return []int{root}
+	}
+
+	children := make(map[int][]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		st, err := readProcStat(pid)
+		if err != nil {
+			continue
+		}
+		children[st.ppid] = append(children[st.ppid], pid)
+	}
+
+	tree := []int{root}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+type procStat struct {
+	ppid      int
+	utime     uint64
+	stime     uint64
+	startTime uint64
+	rssPages  uint64
+}
+
+// readProcStat parses /proc/<pid>/stat. The command name may contain spaces
+// and parentheses, so fields are counted from the last ')'.
+func readProcStat(pid int) (procStat, error) {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return procStat{}, os.ErrInvalid
+	}
+	// fields[0] is the state, field 3 in proc(5)
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return procStat{}, os.ErrInvalid
+	}
+	var st procStat
+	st.ppid, _ = strconv.Atoi(fields[1])
+	st.utime, _ = strconv.ParseUint(fields[11], 10, 64)
+	st.stime, _ = strconv.ParseUint(fields[12], 10, 64)
+	st.startTime, _ = strconv.ParseUint(fields[19], 10, 64)
+	st.rssPages, _ = strconv.ParseUint(fields[21], 10, 64)
+	return st, nil
+}
+
+// procHasEnv reports whether a process's environment holds the variable kv,
+// given as name=value.
+func procHasEnv(pid int, kv string) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "environ"))
+	if err != nil {
+		return false
+	}
+	return slices.Contains(strings.Split(string(data), "\x00"), kv)
+}
+
+// procCatchesSignal reports whether a process has a handler installed for
+// sig, going by the SigCgt mask in /proc/<pid>/status.
+func procCatchesSignal(pid int, sig syscall.Signal) bool {
+	data, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if mask, ok := strings.CutPrefix(line, "SigCgt:"); ok {
+			bits, err := strconv.ParseUint(strings.TrimSpace(mask), 16, 64)
+			return err == nil && bits&(1<<(sig-1)) != 0
+		}
+	}
+	return false
+}
+
+// procCmdline returns a process's command line with its arguments joined by
+// spaces.
+func procCmdline(pid int) string {
+	data, _ := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	return strings.TrimSpace(strings.ReplaceAll(string(data), "\x00", " "))
+}
+
+// readProcIO returns the bytes a process has read from and written to
+// storage.
+func readProcIO(pid int) (read, write uint64, err error) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "io"))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		switch key {
+		case "read_bytes":
+			read = n
+		case "write_bytes":
+			write = n
+		}
+	}
+	return read, write, scanner.Err()
+}
+
+// readMeminfo returns total and available host memory in bytes.
+func readMeminfo() (total, available uint64, err error) {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb * 1024
+		case "MemAvailable:":
+			available = kb * 1024
+		}
+	}
+	return total, available, scanner.Err()
+}
+
+// readNetDev returns bytes received and sent on all interfaces except
+// loopback.
+func readNetDev() (rx, tx uint64, err error) {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		iface, counters, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(iface) == "lo" {
+			continue
+		}
+		fields := strings.Fields(counters)
+		if len(fields) < 9 {
+			continue
+		}
+		r, _ := strconv.ParseUint(fields[0], 10, 64)
+		t, _ := strconv.ParseUint(fields[8], 10, 64)
+		rx += r
+		tx += t
+	}
+	return rx, tx, scanner.Err()
+}
@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"slices"
+	"testing"
+	"time"
+)
+
+// startChild starts a process that runs until the test ends.
+func startChild(t *testing.T) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return cmd
+}
+
+func TestProcessTree(t *testing.T) {
+	child := startChild(t)
+	tree := processTree(os.Getpid())
+	if len(tree) < 2 || tree[0] != os.Getpid() {
+		t.Fatalf("processTree = %v, want the test process first", tree)
+	}
+	if !slices.Contains(tree, child.Process.Pid) {
+		t.Errorf("processTree = %v, missing child %d", tree, child.Process.Pid)
+	}
+	if got := processTree(child.Process.Pid); !slices.Equal(got, []int{child.Process.Pid}) {
+		t.Errorf("processTree of a leaf = %v", got)
+	}
+}
+
+func TestReadProcStat(t *testing.T) {
+	child := startChild(t)
+	st, err := readProcStat(child.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ppid != os.Getpid() {
+		t.Errorf("ppid = %d, want %d", st.ppid, os.Getpid())
+	}
+	if st.startTime == 0 {
+		t.Errorf("readProcStat = %+v, want a start time", st)
+	}
+	if self, err := readProcStat(os.Getpid()); err != nil || self.rssPages == 0 {
+		t.Errorf("readProcStat of the test process = %+v, %v; want its RSS", self, err)
+	}
+	if _, err := readProcStat(-1); err == nil {
+		t.Error("readProcStat of a missing process succeeded")
+	}
+}
+
+func TestHostSampler(t *testing.T) {
+	startChild(t)
+	s := NewHostSampler(t.TempDir(), time.Second, nil, testLogger)
+	s.SetPID(os.Getpid())
+
+	first := s.Sample()
+	for _, name := range []string{
+		"sys/proc/count", "sys/proc/rss_mb",
+		"sys/host/memory_total_mb", "sys/host/memory_used_mb",
+		"sys/disk/used_gb", "sys/disk/free_gb", "sys/disk/used_percent",
+	} {
+		if _, ok := first[name]; !ok {
+			t.Errorf("first sample has no %s", name)
+		}
+	}
+	if got := first["sys/proc/count"]; got < 2 {
+		t.Errorf("sys/proc/count = %v, want the test process and its child", got)
+	}
+	if got := first["sys/proc/rss_mb"]; got <= 0 {
+		t.Errorf("sys/proc/rss_mb = %v", got)
+	}
+	if _, ok := first["sys/proc/cpu_percent"]; ok {
+		t.Error("first sample has a rate")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	second := s.Sample()
+	for _, name := range []string{"sys/proc/cpu_percent", "sys/proc/read_bytes_per_s", "sys/proc/write_bytes_per_s"} {
+		if v, ok := second[name]; !ok || v < 0 {
+			t.Errorf("second sample %s = %v, %v", name, v, ok)
+		}
+	}
+
+	// A new root starts its rates over
+	s.SetPID(os.Getppid())
+	if _, ok := s.Sample()["sys/proc/cpu_percent"]; ok {
+		t.Error("rate across different roots")
+	}
+}
+
+func TestRate(t *testing.T) {
+	if got := rate(100, 300, 2); got != 100 {
+		t.Errorf("rate = %v, want 100", got)
+	}
+	if got := rate(300, 100, 2); got != 0 {
+		t.Errorf("rate of a dropped counter = %v, want 0", got)
+	}
+}
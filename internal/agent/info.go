@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+const infoFlushInterval = 10 * time.Second
+
+// RunInfoBatcher collects params, summary values, tags and the latest status
+// message reported by the subprocess. Later values for the same key replace
+// earlier ones, so only the newest state is sent on each flush.
+type RunInfoBatcher struct {
+	client *api.Client
+	runID  string
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	params  map[string]any
+	summary map[string]any
+	tags    map[string]string
+	status  *string
+	cancel  context.CancelFunc
+}
+
+func NewRunInfoBatcher(client *api.Client, runID string, logger *slog.Logger) *RunInfoBatcher {
+	return &RunInfoBatcher{
+		client: client,
+		runID:  runID,
+		logger: logger,
+	}
+}
+
+func (b *RunInfoBatcher) Start(ctx context.Context) {
+	bctx, cancel := context.WithCancel(ctx)
+	b.cancel = cancel
+
+	go func() {
+		ticker := time.NewTicker(infoFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-bctx.Done():
+				return
+			case <-ticker.C:
+				b.Flush(ctx)
+			}
+		}
+	}()
+}
+
+func (b *RunInfoBatcher) Stop() {
+	if b.cancel != nil {
+		b.cancel()
+	}
+}
+
+func (b *RunInfoBatcher) AddParams(values map[string]any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.params = mergeInto(b.params, values)
+}
+
+func (b *RunInfoBatcher) AddSummary(values map[string]any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.summary = mergeInto(b.summary, values)
+}
+
+func (b *RunInfoBatcher) AddTags(tags map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tags = mergeInto(b.tags, tags)
+}
+
+func (b *RunInfoBatcher) SetStatus(message string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.status = &message
+}
+
+func (b *RunInfoBatcher) Flush(ctx context.Context) {
+	b.mu.Lock()
+	params, summary, tags, status := b.params, b.summary, b.tags, b.status
+	b.params, b.summary, b.tags, b.status = nil, nil, nil, nil
+	b.mu.Unlock()
+
+	if len(params) > 0 {
+		if err := b.client.SendParams(ctx, api.RunValues{RunID: b.runID, Values: params}); err != nil {
+			b.logger.Error("failed to send params", "error", err)
+			b.mu.Lock()
+			b.params = mergeInto(params, b.params)
+			b.mu.Unlock()
+		}
+	}
+	if len(summary) > 0 {
+		if err := b.client.SendSummary(ctx, api.RunValues{RunID: b.runID, Values: summary}); err != nil {
+			b.logger.Error("failed to send summary", "error", err)
+			b.mu.Lock()
+			b.summary = mergeInto(summary, b.summary)
+			b.mu.Unlock()
+		}
+	}
+	if len(tags) > 0 {
+		if err := b.client.SendTags(ctx, api.RunTags{RunID: b.runID, Tags: tags}); err != nil {
+			b.logger.Error("failed to send tags", "error", err)
+			b.mu.Lock()
+			b.tags = mergeInto(tags, b.tags)
+			b.mu.Unlock()
+		}
+	}
+	if status != nil {
+		if err := b.client.SendStatus(ctx, api.RunStatus{RunID: b.runID, Message: *status}); err != nil {
+			b.logger.Error("failed to send status", "error", err)
+			b.mu.Lock()
+			if b.status == nil {
+				b.status = status
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// mergeInto copies src over dst, allocating dst if needed, and returns it.
+func mergeInto[V any](dst, src map[string]V) map[string]V {
+	if dst == nil {
+		dst = make(map[string]V, len(src))
+	}
+	maps.Copy(dst, src)
+	return dst
+}
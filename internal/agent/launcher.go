@@ -0,0 +1,92 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+)
+
+// Launchers a run can be started through to run one process per GPU.
+const (
+	launcherTorchrun   = "torchrun"
+	launcherAccelerate = "accelerate"
+	launcherDeepspeed  = "deepspeed"
+)
+
+// rendezvousAddr is where a run's processes meet. Launches are single-node.
+const rendezvousAddr = "127.0.0.1"
+
+// rankPrefixRe matches the prefix torchrun's --tee puts on each line a rank
+// prints: "[default0]:" from older releases, "[rank0]:" from newer ones.
+var rankPrefixRe = regexp.MustCompile(`^\[(?:default|rank)(\d+)\]:`)
+
+// launcherCommand returns the command line that runs script, the entrypoint
+// or the submitted command, through launcher with nproc processes, and the
+// rendezvous variables for the run's environment.
+//
+// torchrun and accelerate are asked to prefix each line with its rank, so
+// protocol lines from ranks other than 0 can be dropped. deepspeed has no
+// such option; the SDK only prints protocol lines on rank 0.
+func launcherCommand(launcher string, script []string, nproc int) ([]string, []string, error) {
+	port, err := freePort()
+	if err != nil {
+		return nil, nil, fmt.Errorf("picking rendezvous port: %w", err)
+	}
+	n, p := strconv.Itoa(nproc), strconv.Itoa(port)
+
+	// The launchers start Python themselves
+	if len(script) > 0 && (script[0] == "python" || script[0] == "python3") {
+		script = script[1:]
+	}
+
+	var argv []string
+	switch launcher {
+	case launcherTorchrun:
+		argv = []string{"torchrun",
+			"--nnodes=1", "--nproc_per_node=" + n,
+			"--master_addr=" + rendezvousAddr, "--master_port=" + p,
+			"--tee=3",
+		}
+	case launcherAccelerate:
+		argv = []string{"accelerate", "launch",
+			"--num_machines=1", "--num_processes=" + n,
+			"--main_process_ip=" + rendezvousAddr, "--main_process_port=" + p,
+			"--tee=3",
+		}
+		if nproc > 1 {
+			argv = append(argv, "--multi_gpu")
+		}
+	case launcherDeepspeed:
+		argv = []string{"deepspeed",
+			"--num_nodes=1", "--num_gpus=" + n,
+			"--master_addr=" + rendezvousAddr, "--master_port=" + p,
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown launcher %q", launcher)
+	}
+
+	env := []string{"MASTER_ADDR=" + rendezvousAddr, "MASTER_PORT=" + p}
+	return append(argv, script...), env, nil
+}
+
+// freePort returns a TCP port nothing listens on right now.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", rendezvousAddr+":0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// splitRank splits the rank a launcher tagged line with off it. rank is -1
+// if the line isn't tagged.
+func splitRank(line string) (rank int, rest string) {
+	m := rankPrefixRe.FindStringSubmatchIndex(line)
+	if m == nil {
+		return -1, line
+	}
+	rank, _ = strconv.Atoi(line[m[2]:m[3]])
+	return rank, line[m[1]:]
+}
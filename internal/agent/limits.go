@@ -0,0 +1,104 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// limitCheckInterval is how often a run's memory use and disk writes are
+// checked against its limits.
+const limitCheckInterval = 5 * time.Second
+
+// runLimits are the limits a run is stopped at. Zero means no limit.
+type runLimits struct {
+	MaxDuration  time.Duration
+	MaxRSS       uint64 // bytes
+	MaxDiskWrite uint64 // bytes
+}
+
+// limitExceeded is the cancel cause of a run stopped for going over a limit.
+// It unwraps to errRunCancelled, so the process is stopped the way a
+// cancelled run's is, but the run is reported as failed with reason.
+type limitExceeded struct {
+	reason string
+	msg    string
+}
+
+func (e *limitExceeded) Error() string { return e.msg }
+func (e *limitExceeded) Unwrap() error { return errRunCancelled }
+
+// watchLimits stops the run with a limitExceeded cause once it goes over a
+// limit, or returns when ctx is done. The duration counts from startedAt, so
+// it carries over an agent restart. Memory and disk writes are summed over
+// the process tree under pid, which is only known for processes on this
+// host; with pid 0 only the duration is enforced.
+func watchLimits(ctx context.Context, limits runLimits, startedAt time.Time, pid int, stop context.CancelCauseFunc, logger *slog.Logger) {
+	var deadline <-chan time.Time
+	if limits.MaxDuration > 0 {
+		t := time.NewTimer(time.Until(startedAt.Add(limits.MaxDuration)))
+		defer t.Stop()
+		deadline = t.C
+	}
+	var tick <-chan time.Time
+	if pid > 0 && (limits.MaxRSS > 0 || limits.MaxDiskWrite > 0) {
+		t := time.NewTicker(limitCheckInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+	if deadline == nil && tick == nil {
+		return
+	}
+
+	usage := &treeUsage{root: pid, written: make(map[int]uint64)}
+	exceeded := func(reason, format string, args ...any) {
+		err := &limitExceeded{reason: reason, msg: fmt.Sprintf(format, args...)}
+		logger.Warn("stopping run", "reason", reason, "error", err.msg)
+		stop(err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			exceeded(reasonTimeout, "run exceeded its time limit of %s", limits.MaxDuration)
+			return
+		case <-tick:
+			rss, written := usage.sample()
+			switch {
+			case limits.MaxRSS > 0 && rss > limits.MaxRSS:
+				exceeded(reasonResourceLimit, "memory use of %d MB exceeded the limit of %d MB", rss>>20, limits.MaxRSS>>20)
+				return
+			case limits.MaxDiskWrite > 0 && written > limits.MaxDiskWrite:
+				exceeded(reasonResourceLimit, "disk writes of %d MB exceeded the limit of %d MB", written>>20, limits.MaxDiskWrite>>20)
+				return
+			}
+		}
+	}
+}
+
+// treeUsage measures a process tree's memory and the bytes it has written to
+// storage. Processes come and go, so bytes written are totalled per process
+// rather than read off the tree as a whole.
+type treeUsage struct {
+	root    int
+	written map[int]uint64
+	total   uint64
+}
+
+// sample returns the tree's current RSS and the bytes it has written,
+// including those written by processes that have since exited.
+func (u *treeUsage) sample() (rss, written uint64) {
+	for _, pid := range processTree(u.root) {
+		if st, err := readProcStat(pid); err == nil {
+			rss += st.rssPages * uint64(os.Getpagesize())
+		}
+		if _, w, err := readProcIO(pid); err == nil && w >= u.written[pid] {
+			u.total += w - u.written[pid]
+			u.written[pid] = w
+		}
+	}
+	return rss, u.total
+}
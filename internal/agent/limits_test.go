@@ -0,0 +1,106 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWatchLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		limits  runLimits
+		// age is how long before the test the run started
+		age    time.Duration
+		reason string
+	}{
+		{
+			name:    "time",
+			command: []string{"sleep", "30"},
+			limits:  runLimits{MaxDuration: 300 * time.Millisecond},
+			reason:  reasonTimeout,
+		},
+		{
+			name:    "time before a restart",
+			command: []string{"sleep", "30"},
+			limits:  runLimits{MaxDuration: time.Hour},
+			age:     2 * time.Hour,
+			reason:  reasonTimeout,
+		},
+		{
+			name:    "memory",
+			command: []string{"sleep", "30"},
+			limits:  runLimits{MaxRSS: 1 << 10},
+			reason:  reasonResourceLimit,
+		},
+		{
+			name:    "within limits",
+			command: []string{"sleep", "0.2"},
+			limits:  runLimits{MaxDuration: time.Hour, MaxRSS: 1 << 40, MaxDiskWrite: 1 << 40},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			spec := SubprocessSpec{WorkDir: t.TempDir(), Command: tt.command, ControlDir: t.TempDir()}
+			p, err := localExecutor{}.Start(spec, testLogger)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A supervisor signalled before it has started the command dies
+			// without an exit code
+			waitForFile(t, filepath.Join(spec.ControlDir, pgidFile))
+
+			ctx, stop := context.WithCancelCause(context.Background())
+			defer stop(nil)
+			go watchLimits(ctx, tt.limits, time.Now().Add(-tt.age), p.PID, stop, testLogger)
+			code, _ := p.Follow(ctx, 0, 0, 5*time.Second, testSinks(t), testLogger)
+
+			var exceeded *limitExceeded
+			if tt.reason == "" {
+				if code != 0 || context.Cause(ctx) != nil {
+					t.Errorf("exit code %d, cause %v; want a clean exit", code, context.Cause(ctx))
+				}
+				return
+			}
+			if !errors.As(context.Cause(ctx), &exceeded) || exceeded.reason != tt.reason {
+				t.Fatalf("cause %v, want a limit exceeded with reason %s", context.Cause(ctx), tt.reason)
+			}
+			if !isCancelled(ctx) {
+				t.Error("limit exceeded does not cancel the run")
+			}
+			if code != 128+int(syscall.SIGTERM) {
+				t.Errorf("exit code %d, want %d", code, 128+int(syscall.SIGTERM))
+			}
+		})
+	}
+}
+
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+	}
+	t.Fatalf("%s was not created", path)
+}
+
+func TestWatchLimitsNone(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		watchLimits(context.Background(), runLimits{MaxRSS: 1}, time.Now(), 0, func(error) {}, testLogger)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("watchLimits without enforceable limits did not return")
+	}
+}
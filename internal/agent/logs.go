@@ -0,0 +1,137 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+const (
+	logFlushInterval = 5 * time.Second
+	logFlushLines    = 500
+)
+
+// LogShipper batches subprocess console output and hands it to the spool in
+// order. Every line gets a sequence number so the Worker can drop duplicates
+// from retried batches.
+type LogShipper struct {
+	spool  *Spool
+	runID  string
+	logger *slog.Logger
+
+	mu      sync.Mutex
+	seq     int
+	pending []api.LogLine
+	cancel  context.CancelFunc
+	flushCh chan struct{}
+}
+
+func NewLogShipper(spool *Spool, runID string, logger *slog.Logger) *LogShipper {
+	return &LogShipper{
+		spool:   spool,
+		runID:   runID,
+		logger:  logger,
+		flushCh: make(chan struct{}, 1),
+	}
+}
+
+func (s *LogShipper) Start(ctx context.Context) {
+	sctx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+
+	go func() {
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sctx.Done():
+				return
+			case <-ticker.C:
+				s.Flush(ctx)
+			case <-s.flushCh:
+				s.Flush(ctx)
+			}
+		}
+	}()
+}
+
+func (s *LogShipper) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// Seq returns the sequence number of the last line added.
+func (s *LogShipper) Seq() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seq
+}
+
+// SetSeq resumes numbering after n.
+func (s *LogShipper) SetSeq(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq = n
+}
+
+// Add queues a line from the given stream ("stdout" or "stderr").
+func (s *LogShipper) Add(stream, line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	s.pending = append(s.pending, api.LogLine{
+		Seq:    s.seq,
+		Stream: stream,
+		Line:   line,
+	})
+	if len(s.pending) >= logFlushLines {
+		select {
+		case s.flushCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *LogShipper) Flush(ctx context.Context) {
+	s.mu.Lock()
+	if len(s.pending) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	lines := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+
+	batches := spoolBatches(lines, logLineSize)
+	for i, batch := range batches {
+		err := s.spool.Append(spoolLogs, api.LogBatch{
+			RunID: s.runID,
+			Lines: batch,
+		})
+		if errors.Is(err, errBadSpoolRecord) {
+			s.logger.Error("dropping logs that cannot be spooled", "error", err, "count", len(batch))
+			continue
+		}
+		if err != nil {
+			rest := slices.Concat(batches[i:]...)
+			s.logger.Error("failed to spool logs", "error", err, "count", len(rest))
+			// Put them back
+			s.mu.Lock()
+			s.pending = append(rest, s.pending...)
+			s.mu.Unlock()
+			return
+		}
+		s.logger.Debug("spooled logs", "count", len(batch))
+	}
+}
+
+// logLineSize estimates the encoded size of a log line.
+func logLineSize(l api.LogLine) int {
+	return len(l.Line) + 48
+}
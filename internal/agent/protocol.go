@@ -0,0 +1,318 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+// Training scripts talk to the agent by printing single-line JSON objects to
+// stdout. Two envelope keys are accepted: "_mlflare" (documented in the spec)
+// and "__mlflare__" (emitted by older SDKs). Either may hold
+//
+//   - a flat object of metric values, logged at the next step:
+//     {"_mlflare": {"loss": 0.34, "epoch": 5}}
+//
+//   - a typed event with a protocol version:
+//     {"_mlflare": {"v": 2, "type": "metrics", "step": 100, "time": 1718000000.5, "values": {"loss": 0.34}}}
+//     {"_mlflare": {"v": 2, "type": "params", "values": {"lr": 0.001}}}
+//     {"_mlflare": {"v": 2, "type": "summary", "values": {"best_acc": 0.91}}}
+//     {"_mlflare": {"v": 2, "type": "tags", "values": {"stage": "pretrain"}}}
+//     {"_mlflare": {"v": 2, "type": "artifact", "path": "checkpoints/best.pt"}}
+//     {"_mlflare": {"v": 2, "type": "status", "message": "evaluating"}}
+//
+// The legacy {"__mlflare_artifact__": "path"} line is also accepted.
+//
+// Metric values are numbers (including the bare NaN, Infinity and -Infinity
+// Python's json module writes), strings, which are logged as text, or
+// histograms given either as bucket edges and counts or as raw samples:
+//
+//	{"type": "histogram", "edges": [0, 0.5, 1], "counts": [3, 7]}
+//	{"type": "histogram", "values": [0.1, 0.4, 0.9], "bins": 32}
+
+// protocolVersion is the newest typed event version the agent understands.
+const protocolVersion = 2
+
+const (
+	EventMetrics  = "metrics"
+	EventParams   = "params"
+	EventSummary  = "summary"
+	EventTags     = "tags"
+	EventArtifact = "artifact"
+	EventStatus   = "status"
+)
+
+// defaultHistogramBins is used when raw samples are sent without a bin count,
+// and maxHistogramBins caps the count a script asks for.
+const (
+	defaultHistogramBins = 64
+	maxHistogramBins     = 1024
+)
+
+// nonFiniteSentinel prefixes the strings bare NaN and Infinity tokens are
+// rewritten to before decoding, so they can't be mistaken for text values.
+const nonFiniteSentinel = "\x00mlflare:"
+
+// Event is one decoded stdout protocol message.
+type Event struct {
+	Type string
+
+	// Point holds the values of a metrics event.
+	Point MetricPoint
+
+	Values  map[string]any
+	Tags    map[string]string
+	Path    string
+	Message string
+}
+
+type envelope struct {
+	Current  json.RawMessage `json:"_mlflare"`
+	Legacy   json.RawMessage `json:"__mlflare__"`
+	Artifact string          `json:"__mlflare_artifact__"`
+}
+
+type typedEvent struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Step    *int            `json:"step"`
+	Time    float64         `json:"time"`
+	Values  json.RawMessage `json:"values"`
+	Path    string          `json:"path"`
+	Message string          `json:"message"`
+}
+
+// ParseEvent decodes a stdout line. ok is false for lines that are not
+// protocol messages; err is set for protocol messages that are malformed.
+func ParseEvent(line string) (ev Event, ok bool, err error) {
+	if len(line) == 0 || line[0] != '{' {
+		return Event{}, false, nil
+	}
+
+	var env envelope
+	if json.Unmarshal([]byte(quoteNonFinite(line)), &env) != nil {
+		return Event{}, false, nil
+	}
+
+	if env.Artifact != "" {
+		return Event{Type: EventArtifact, Path: env.Artifact}, true, nil
+	}
+
+	raw := env.Current
+	if raw == nil {
+		raw = env.Legacy
+	}
+	if raw == nil {
+		return Event{}, false, nil
+	}
+
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &probe); err != nil {
+		return Event{}, true, fmt.Errorf("payload is not an object: %w", err)
+	}
+
+	// A string "type" naming an event, or next to a version, marks a typed
+	// event; anything else is a flat metric map.
+	var typ string
+	if t, found := probe["type"]; !found || json.Unmarshal(t, &typ) != nil || (!knownEventType(typ) && probe["v"] == nil) {
+		point, err := decodeMetricValues(raw)
+		if err != nil {
+			return Event{}, true, err
+		}
+		return Event{Type: EventMetrics, Point: point}, true, nil
+	}
+
+	var te typedEvent
+	if err := json.Unmarshal(raw, &te); err != nil {
+		return Event{}, true, fmt.Errorf("decoding event: %w", err)
+	}
+	if te.Version > protocolVersion {
+		return Event{}, true, fmt.Errorf("unsupported protocol version %d", te.Version)
+	}
+
+	ev = Event{Type: te.Type, Path: te.Path, Message: te.Message}
+	switch te.Type {
+	case EventMetrics:
+		ev.Point, err = decodeMetricValues(te.Values)
+		ev.Point.Step = te.Step
+		if te.Time > 0 {
+			ev.Point.Time = time.UnixMicro(int64(te.Time * 1e6))
+		}
+	case EventParams, EventSummary:
+		err = json.Unmarshal(te.Values, &ev.Values)
+	case EventTags:
+		var values map[string]any
+		if err = json.Unmarshal(te.Values, &values); err == nil {
+			ev.Tags = make(map[string]string, len(values))
+			for k, v := range values {
+				ev.Tags[k] = configValue(v)
+			}
+		}
+	case EventArtifact:
+		if te.Path == "" {
+			err = fmt.Errorf("artifact event without path")
+		}
+	case EventStatus:
+	default:
+		err = fmt.Errorf("unknown event type %q", te.Type)
+	}
+	if err != nil {
+		return Event{}, true, err
+	}
+	return ev, true, nil
+}
+
+func knownEventType(t string) bool {
+	switch t {
+	case EventMetrics, EventParams, EventSummary, EventTags, EventArtifact, EventStatus:
+		return true
+	}
+	return false
+}
+
+type histogramSpec struct {
+	Type   string    `json:"type"`
+	Edges  []float64 `json:"edges"`
+	Counts []float64 `json:"counts"`
+	Values []float64 `json:"values"`
+	Bins   int       `json:"bins"`
+}
+
+// decodeMetricValues decodes an object of metric values into a point.
+func decodeMetricValues(raw json.RawMessage) (MetricPoint, error) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &values); err != nil {
+		return MetricPoint{}, fmt.Errorf("decoding metrics: %w", err)
+	}
+
+	var p MetricPoint
+	for name, v := range values {
+		if len(v) == 0 || string(v) == "null" {
+			continue
+		}
+		switch v[0] {
+		case '"':
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return MetricPoint{}, fmt.Errorf("decoding %q: %w", name, err)
+			}
+			if tok, ok := strings.CutPrefix(s, nonFiniteSentinel); ok {
+				f, _ := strconv.ParseFloat(strings.TrimPrefix(tok, "+"), 64)
+				p.Scalars = mergeInto(p.Scalars, map[string]float64{name: f})
+			} else {
+				p.Texts = mergeInto(p.Texts, map[string]string{name: s})
+			}
+		case '{':
+			var spec histogramSpec
+			if err := json.Unmarshal(v, &spec); err != nil {
+				return MetricPoint{}, fmt.Errorf("decoding %q: %w", name, err)
+			}
+			h, err := spec.histogram()
+			if err != nil {
+				return MetricPoint{}, fmt.Errorf("decoding %q: %w", name, err)
+			}
+			p.Histograms = mergeInto(p.Histograms, map[string]api.Histogram{name: h})
+		default:
+			var f float64
+			if err := json.Unmarshal(v, &f); err != nil {
+				return MetricPoint{}, fmt.Errorf("decoding %q: %w", name, err)
+			}
+			p.Scalars = mergeInto(p.Scalars, map[string]float64{name: f})
+		}
+	}
+	return p, nil
+}
+
+func (s histogramSpec) histogram() (api.Histogram, error) {
+	if s.Type != "histogram" {
+		return api.Histogram{}, fmt.Errorf("unsupported value type %q", s.Type)
+	}
+	if len(s.Counts) > 0 {
+		if len(s.Edges) != len(s.Counts)+1 {
+			return api.Histogram{}, fmt.Errorf("histogram needs len(edges) == len(counts)+1")
+		}
+		return api.Histogram{Edges: s.Edges, Counts: s.Counts}, nil
+	}
+	if len(s.Values) == 0 {
+		return api.Histogram{}, fmt.Errorf("histogram has neither counts nor values")
+	}
+
+	bins := s.Bins
+	if bins <= 0 {
+		bins = defaultHistogramBins
+	}
+	bins = min(bins, maxHistogramBins)
+	lo, hi := slices.Min(s.Values), slices.Max(s.Values)
+	if lo == hi {
+		bins = 1
+		hi = lo + 1
+	}
+	width := (hi - lo) / float64(bins)
+	if math.IsInf(hi-lo, 0) || math.IsInf(width, 0) || width == 0 {
+		return api.Histogram{}, fmt.Errorf("histogram range %g to %g is too wide or narrow to bin", lo, hi)
+	}
+	h := api.Histogram{
+		Edges:  make([]float64, bins+1),
+		Counts: make([]float64, bins),
+	}
+	for i := range h.Edges {
+		h.Edges[i] = lo + float64(i)*width
+	}
+	for _, v := range s.Values {
+		i := min(max(int((v-lo)/width), 0), bins-1)
+		h.Counts[i]++
+	}
+	return h, nil
+}
+
+// quoteNonFinite rewrites the bare NaN, Infinity and -Infinity tokens that
+// Python's json module emits, which are not valid JSON, into sentinel
+// strings. Text inside JSON strings is left alone.
+func quoteNonFinite(line string) string {
+	if !strings.Contains(line, "NaN") && !strings.Contains(line, "Infinity") {
+		return line
+	}
+
+	var b strings.Builder
+	inString, escaped := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			b.WriteByte(c)
+			continue
+		}
+		if c == '"' {
+			inString = true
+			b.WriteByte(c)
+			continue
+		}
+
+		matched := false
+		for _, tok := range []string{"NaN", "Infinity", "-Infinity"} {
+			if strings.HasPrefix(line[i:], tok) {
+				b.WriteString(`"\u0000mlflare:` + tok + `"`)
+				i += len(tok) - 1
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
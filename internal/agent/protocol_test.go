@@ -0,0 +1,234 @@
+package agent
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+func TestParseEvent(t *testing.T) {
+	step := 100
+	tests := []struct {
+		name    string
+		line    string
+		want    Event
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "empty", line: ""},
+		{name: "plain text", line: "epoch 1 done"},
+		{name: "truncated json", line: `{"_mlflare": {"loss": 0.5`},
+		{name: "other json", line: `{"level": "info"}`},
+		{
+			name:   "flat metrics",
+			line:   `{"_mlflare": {"loss": 0.5, "note": "warmup", "skip": null}}`,
+			want:   Event{Type: EventMetrics, Point: MetricPoint{Scalars: map[string]float64{"loss": 0.5}, Texts: map[string]string{"note": "warmup"}}},
+			wantOK: true,
+		},
+		{
+			name:   "legacy envelope",
+			line:   `{"__mlflare__": {"loss": 1}}`,
+			want:   Event{Type: EventMetrics, Point: MetricPoint{Scalars: map[string]float64{"loss": 1}}},
+			wantOK: true,
+		},
+		{
+			name:   "legacy artifact",
+			line:   `{"__mlflare_artifact__": "model.pt"}`,
+			want:   Event{Type: EventArtifact, Path: "model.pt"},
+			wantOK: true,
+		},
+		{
+			name:   "type as metric name",
+			line:   `{"_mlflare": {"type": "resnet"}}`,
+			want:   Event{Type: EventMetrics, Point: MetricPoint{Texts: map[string]string{"type": "resnet"}}},
+			wantOK: true,
+		},
+		{
+			name: "typed metrics",
+			line: `{"_mlflare": {"v": 2, "type": "metrics", "step": 100, "time": 1718000000.5, "values": {"loss": 0.34}}}`,
+			want: Event{Type: EventMetrics, Point: MetricPoint{
+				Step:    &step,
+				Time:    time.UnixMicro(1718000000500000),
+				Scalars: map[string]float64{"loss": 0.34},
+			}},
+			wantOK: true,
+		},
+		{
+			name:   "params",
+			line:   `{"_mlflare": {"v": 2, "type": "params", "values": {"lr": 0.001}}}`,
+			want:   Event{Type: EventParams, Values: map[string]any{"lr": 0.001}},
+			wantOK: true,
+		},
+		{
+			name:   "tags",
+			line:   `{"_mlflare": {"v": 2, "type": "tags", "values": {"stage": "pretrain", "fold": 3}}}`,
+			want:   Event{Type: EventTags, Tags: map[string]string{"stage": "pretrain", "fold": "3"}},
+			wantOK: true,
+		},
+		{
+			name:   "status",
+			line:   `{"_mlflare": {"type": "status", "message": "evaluating"}}`,
+			want:   Event{Type: EventStatus, Message: "evaluating"},
+			wantOK: true,
+		},
+		{
+			name:   "histogram",
+			line:   `{"_mlflare": {"w": {"type": "histogram", "edges": [0, 1], "counts": [4]}}}`,
+			want:   Event{Type: EventMetrics, Point: MetricPoint{Histograms: map[string]api.Histogram{"w": {Edges: []float64{0, 1}, Counts: []float64{4}}}}},
+			wantOK: true,
+		},
+		{name: "payload not an object", line: `{"_mlflare": 5}`, wantOK: true, wantErr: true},
+		{name: "artifact without path", line: `{"_mlflare": {"v": 2, "type": "artifact"}}`, wantOK: true, wantErr: true},
+		{name: "unknown type", line: `{"_mlflare": {"v": 2, "type": "video"}}`, wantOK: true, wantErr: true},
+		{name: "newer version", line: `{"_mlflare": {"v": 3, "type": "metrics", "values": {}}}`, wantOK: true, wantErr: true},
+		{name: "list value", line: `{"_mlflare": {"loss": [1, 2]}}`, wantOK: true, wantErr: true},
+		{name: "unsupported value type", line: `{"_mlflare": {"img": {"type": "image"}}}`, wantOK: true, wantErr: true},
+		{name: "empty histogram", line: `{"_mlflare": {"w": {"type": "histogram", "values": []}}}`, wantOK: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := ParseEvent(tt.line)
+			if ok != tt.wantOK || (err != nil) != tt.wantErr {
+				t.Fatalf("ParseEvent(%s) ok = %v, err = %v; want ok = %v, err = %v", tt.line, ok, err, tt.wantOK, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseEvent(%s) = %+v, want %+v", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEventNonFinite(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+	}{
+		{"flat", `{"_mlflare": {"a": NaN, "b": Infinity, "c": -Infinity, "d": "NaN"}}`},
+		{"typed", `{"_mlflare": {"v": 2, "type": "metrics", "values": {"a": NaN, "b": Infinity, "c": -Infinity, "d": "NaN"}}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, ok, err := ParseEvent(tt.line)
+			if !ok || err != nil {
+				t.Fatalf("ParseEvent(%s) ok = %v, err = %v", tt.line, ok, err)
+			}
+			s := ev.Point.Scalars
+			if !math.IsNaN(s["a"]) || !math.IsInf(s["b"], 1) || !math.IsInf(s["c"], -1) {
+				t.Errorf("scalars = %v, want a=NaN b=+Inf c=-Inf", s)
+			}
+			if got := ev.Point.Texts["d"]; got != "NaN" {
+				t.Errorf("text d = %q, want %q", got, "NaN")
+			}
+		})
+	}
+}
+
+func TestQuoteNonFinite(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"no tokens", `{"a": 1}`, `{"a": 1}`},
+		{"nan", `{"a": NaN}`, `{"a": "\u0000mlflare:NaN"}`},
+		{"infinities", `[Infinity,-Infinity]`, `["\u0000mlflare:Infinity","\u0000mlflare:-Infinity"]`},
+		{"inside string", `{"a": "NaN or Infinity"}`, `{"a": "NaN or Infinity"}`},
+		{"escaped quote", `{"a": "say \"NaN\"", "b": NaN}`, `{"a": "say \"NaN\"", "b": "\u0000mlflare:NaN"}`},
+		{"escaped backslash", `{"a": "C:\\", "b": NaN}`, `{"a": "C:\\", "b": "\u0000mlflare:NaN"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteNonFinite(tt.line); got != tt.want {
+				t.Errorf("quoteNonFinite(%s) = %s, want %s", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	capped := api.Histogram{Edges: make([]float64, maxHistogramBins+1), Counts: make([]float64, maxHistogramBins)}
+	for i := range capped.Edges {
+		capped.Edges[i] = float64(i)
+	}
+	capped.Counts[0], capped.Counts[maxHistogramBins-1] = 1, 1
+
+	tests := []struct {
+		name    string
+		spec    histogramSpec
+		want    api.Histogram
+		wantErr bool
+	}{
+		{
+			name: "edges and counts",
+			spec: histogramSpec{Type: "histogram", Edges: []float64{0, 0.5, 1}, Counts: []float64{3, 7}},
+			want: api.Histogram{Edges: []float64{0, 0.5, 1}, Counts: []float64{3, 7}},
+		},
+		{
+			name:    "mismatched edges",
+			spec:    histogramSpec{Type: "histogram", Edges: []float64{0, 1}, Counts: []float64{3, 7}},
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			spec:    histogramSpec{Type: "histogram"},
+			wantErr: true,
+		},
+		{
+			name:    "wrong type",
+			spec:    histogramSpec{Type: "image", Values: []float64{1}},
+			wantErr: true,
+		},
+		{
+			name: "binned samples",
+			spec: histogramSpec{Type: "histogram", Values: []float64{0, 1, 2, 3}, Bins: 2},
+			want: api.Histogram{Edges: []float64{0, 1.5, 3}, Counts: []float64{2, 2}},
+		},
+		{
+			name: "single value",
+			spec: histogramSpec{Type: "histogram", Values: []float64{2, 2, 2}, Bins: 10},
+			want: api.Histogram{Edges: []float64{2, 3}, Counts: []float64{3}},
+		},
+		{
+			name: "bins capped",
+			spec: histogramSpec{Type: "histogram", Values: []float64{0, maxHistogramBins}, Bins: 1 << 30},
+			want: capped,
+		},
+		{
+			name:    "range overflows",
+			spec:    histogramSpec{Type: "histogram", Values: []float64{-1e308, 1e308}},
+			wantErr: true,
+		},
+		{
+			name:    "range too narrow",
+			spec:    histogramSpec{Type: "histogram", Values: []float64{0, 5e-324}, Bins: 2},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.spec.histogram()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("histogram() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("histogram() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramDefaultBins(t *testing.T) {
+	h, err := histogramSpec{Type: "histogram", Values: []float64{0, 1}}.histogram()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Counts) != defaultHistogramBins || len(h.Edges) != defaultHistogramBins+1 {
+		t.Fatalf("got %d counts and %d edges", len(h.Counts), len(h.Edges))
+	}
+	if h.Counts[0] != 1 || h.Counts[defaultHistogramBins-1] != 1 {
+		t.Errorf("extremes not in the outer bins: %v", h.Counts)
+	}
+}
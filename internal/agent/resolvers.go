@@ -0,0 +1,275 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+
+	"github.com/foundling-ai/mlflare/internal/bundle"
+)
+
+// EnvTools are the binaries environment resolvers run.
+type EnvTools struct {
+	PythonBin string
+	UVBin     string
+	PoetryBin string
+	CondaBin  string
+}
+
+// envResolver builds a run's environment with the tool its dependency
+// manifest calls for. There is one per bundle.Deps kind.
+type envResolver interface {
+	// create makes an environment at dir, on the given Python version if one
+	// is pinned.
+	create(ctx context.Context, dir, python string) error
+
+	// install installs the bundle's dependencies into the environment,
+	// writing the tools' output to out.
+	install(ctx context.Context, dir, workDir string, out io.Writer) error
+
+	// locked reports whether the manifest fully determines what install
+	// does, so it only needs to run once per environment.
+	locked(workDir string) bool
+}
+
+func newEnvResolver(kind string, tools EnvTools, logger *slog.Logger) (envResolver, error) {
+	switch kind {
+	case bundle.DepsConda:
+		return condaResolver{tools, logger}, nil
+	case bundle.DepsUV:
+		return uvResolver{tools, logger}, nil
+	case bundle.DepsPoetry:
+		return poetryResolver{tools, logger}, nil
+	case bundle.DepsPyproject:
+		return pyprojectResolver{venvResolver{tools, logger}}, nil
+	case bundle.DepsRequirements:
+		return requirementsResolver{venvResolver{tools, logger}}, nil
+	case bundle.DepsNone:
+		return venvResolver{tools, logger}, nil
+	}
+	return nil, fmt.Errorf("unknown dependency manifest kind %q", kind)
+}
+
+// venvResolver creates a plain venv and installs nothing into it.
+type venvResolver struct {
+	tools  EnvTools
+	logger *slog.Logger
+}
+
+func (r venvResolver) create(ctx context.Context, dir, python string) error {
+	bin, err := r.findPython(ctx, python)
+	if err != nil {
+		return err
+	}
+	r.logger.Info("creating venv", "path", dir, "python", bin)
+	return runTool(ctx, "", nil, nil, bin, "-m", "venv", dir)
+}
+
+func (venvResolver) install(context.Context, string, string, io.Writer) error { return nil }
+
+func (venvResolver) locked(string) bool { return true }
+
+// findPython returns an interpreter for a pinned version: pythonX.Y on PATH,
+// or one uv knows about. Without a pin it returns the configured python.
+func (r venvResolver) findPython(ctx context.Context, version string) (string, error) {
+	if version == "" {
+		return r.tools.PythonBin, nil
+	}
+	if bin, err := exec.LookPath("python" + version); err == nil {
+		return bin, nil
+	}
+	if _, err := exec.LookPath(r.tools.UVBin); err == nil {
+		out, err := exec.CommandContext(ctx, r.tools.UVBin, "python", "find", version).Output()
+		if err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
+	}
+	return "", fmt.Errorf("python %s not found (install python%s, or uv to fetch it)", version, version)
+}
+
+// requirementsResolver pip installs requirements.txt.
+type requirementsResolver struct {
+	venvResolver
+}
+
+func (r requirementsResolver) install(ctx context.Context, dir, workDir string, out io.Writer) error {
+	args := []string{"-m", "pip", "install", "-r", "requirements.txt", "--quiet"}
+	if !r.locked(workDir) {
+		args = append(args, "--upgrade")
+		r.logger.Info("installing dependencies (upgrading unpinned)", "path", dir)
+	} else {
+		r.logger.Info("installing dependencies", "path", dir)
+	}
+	return runTool(ctx, workDir, nil, out, venvPython(dir), args...)
+}
+
+// locked reports whether every requirement is pinned with ==.
+func (requirementsResolver) locked(workDir string) bool {
+	data, _ := os.ReadFile(filepath.Join(workDir, "requirements.txt"))
+	return allPinned(strings.Split(string(data), "\n"))
+}
+
+// pyprojectResolver pip installs the [project] dependencies of
+// pyproject.toml. The project itself is not installed; it runs from the
+// bundle.
+type pyprojectResolver struct {
+	venvResolver
+}
+
+func (r pyprojectResolver) install(ctx context.Context, dir, workDir string, out io.Writer) error {
+	deps, err := pyprojectDeps(workDir)
+	if err != nil {
+		return err
+	}
+	if len(deps) == 0 {
+		return nil
+	}
+	args := append([]string{"-m", "pip", "install", "--quiet"}, deps...)
+	if !allPinned(deps) {
+		args = append(args, "--upgrade")
+		r.logger.Info("installing pyproject dependencies (upgrading unpinned)", "path", dir)
+	} else {
+		r.logger.Info("installing pyproject dependencies", "path", dir)
+	}
+	return runTool(ctx, workDir, nil, out, venvPython(dir), args...)
+}
+
+func (pyprojectResolver) locked(workDir string) bool {
+	deps, err := pyprojectDeps(workDir)
+	return err == nil && allPinned(deps)
+}
+
+func pyprojectDeps(workDir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(workDir, "pyproject.toml"))
+	if err != nil {
+		return nil, fmt.Errorf("reading pyproject.toml: %w", err)
+	}
+	var doc struct {
+		Project struct {
+			Dependencies []string `toml:"dependencies"`
+		} `toml:"project"`
+	}
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing pyproject.toml: %w", err)
+	}
+	return doc.Project.Dependencies, nil
+}
+
+// uvResolver syncs a uv project from its lockfile.
+type uvResolver struct {
+	tools  EnvTools
+	logger *slog.Logger
+}
+
+func (r uvResolver) create(ctx context.Context, dir, python string) error {
+	if python == "" {
+		python = r.tools.PythonBin
+	}
+	r.logger.Info("creating venv with uv", "path", dir, "python", python)
+	return runTool(ctx, "", nil, nil, r.tools.UVBin, "venv", "--python", python, dir)
+}
+
+func (r uvResolver) install(ctx context.Context, dir, workDir string, out io.Writer) error {
+	r.logger.Info("syncing uv lockfile", "path", dir)
+	env := []string{"UV_PROJECT_ENVIRONMENT=" + dir}
+	return runTool(ctx, workDir, env, out, r.tools.UVBin, "sync", "--frozen", "--no-install-project")
+}
+
+func (uvResolver) locked(string) bool { return true }
+
+// poetryResolver installs a Poetry project into a venv it doesn't manage.
+type poetryResolver struct {
+	tools  EnvTools
+	logger *slog.Logger
+}
+
+func (r poetryResolver) create(ctx context.Context, dir, python string) error {
+	return venvResolver{r.tools, r.logger}.create(ctx, dir, python)
+}
+
+func (r poetryResolver) install(ctx context.Context, dir, workDir string, out io.Writer) error {
+	r.logger.Info("installing Poetry dependencies", "path", dir)
+	env := []string{
+		"VIRTUAL_ENV=" + dir,
+		"PATH=" + filepath.Join(dir, "bin") + string(os.PathListSeparator) + os.Getenv("PATH"),
+		"POETRY_VIRTUALENVS_CREATE=false",
+	}
+	return runTool(ctx, workDir, env, out, r.tools.PoetryBin, "install", "--no-root", "--no-interaction")
+}
+
+// locked reports whether there is a poetry.lock; without one Poetry
+// resolves versions afresh.
+func (poetryResolver) locked(workDir string) bool {
+	_, err := os.Stat(filepath.Join(workDir, "poetry.lock"))
+	return err == nil
+}
+
+// condaResolver creates a conda environment from environment.yml.
+type condaResolver struct {
+	tools  EnvTools
+	logger *slog.Logger
+}
+
+func (r condaResolver) create(ctx context.Context, dir, python string) error {
+	args := []string{"create", "--yes", "--quiet", "--prefix", dir}
+	if python != "" {
+		args = append(args, "python="+python)
+	}
+	r.logger.Info("creating conda env", "path", dir, "python", python)
+	return runTool(ctx, "", nil, nil, r.tools.CondaBin, args...)
+}
+
+func (r condaResolver) install(ctx context.Context, dir, workDir string, out io.Writer) error {
+	file := bundle.DetectDeps(workDir).Files[0]
+	r.logger.Info("installing conda environment", "path", dir, "file", file)
+	return runTool(ctx, workDir, nil, out, r.tools.CondaBin, "env", "update", "--quiet", "--prefix", dir, "--file", file)
+}
+
+func (condaResolver) locked(string) bool { return true }
+
+// allPinned reports whether every requirement line is pinned with ==.
+func allPinned(lines []string) bool {
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-") {
+			continue
+		}
+		if !strings.Contains(line, "==") {
+			return false
+		}
+	}
+	return true
+}
+
+// venvPython is the interpreter of the environment at dir, for both venvs and
+// conda environments.
+func venvPython(dir string) string {
+	return filepath.Join(dir, "bin", "python")
+}
+
+// runTool runs an environment tool, printing its output on the agent's own.
+// If out is set, the output is written to it too.
+func runTool(ctx context.Context, workDir string, env []string, out io.Writer, bin string, args ...string) error {
+	cmd := exec.CommandContext(ctx, bin, args...)
+	cmd.Dir = workDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if out != nil {
+		cmd.Stdout = io.MultiWriter(os.Stdout, out)
+		cmd.Stderr = io.MultiWriter(os.Stderr, out)
+	}
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running %s: %w", filepath.Base(bin), err)
+	}
+	return nil
+}
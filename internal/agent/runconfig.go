@@ -0,0 +1,85 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// runConfigFile is written to the run's work dir with the experiment config.
+const runConfigFile = "mlflare_config.json"
+
+// RunEnv writes the experiment config to <workDir>/mlflare_config.json and
+// returns the environment that exposes it to the training process:
+//
+//	MLFLARE_CONFIG         the config as a JSON object
+//	MLFLARE_CONFIG_PATH    absolute path of mlflare_config.json
+//	MLFLARE_RUN_ID         run ID
+//	MLFLARE_EXPERIMENT_ID  experiment ID
+func RunEnv(workDir, runID, experimentID string, config map[string]any) ([]string, error) {
+	if config == nil {
+		config = map[string]any{}
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling config: %w", err)
+	}
+
+	path := filepath.Join(workDir, runConfigFile)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return nil, fmt.Errorf("writing config: %w", err)
+	}
+
+	return []string{
+		"MLFLARE_CONFIG=" + string(data),
+		"MLFLARE_CONFIG_PATH=" + path,
+		"MLFLARE_RUN_ID=" + runID,
+		"MLFLARE_EXPERIMENT_ID=" + experimentID,
+	}, nil
+}
+
+// ConfigArgs renders the config as sorted --key=value arguments. Nested
+// objects are flattened with dots (--optim.lr=0.001); lists are rendered as
+// JSON.
+func ConfigArgs(config map[string]any) []string {
+	var args []string
+	var walk func(prefix string, m map[string]any)
+	walk = func(prefix string, m map[string]any) {
+		for k, v := range m {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			if nested, ok := v.(map[string]any); ok {
+				walk(key, nested)
+				continue
+			}
+			args = append(args, fmt.Sprintf("--%s=%s", key, configValue(v)))
+		}
+	}
+	walk("", config)
+	sort.Strings(args)
+	return args
+}
+
+// configValue renders a config value as an argument. JSON numbers decode to
+// float64, and are printed without an exponent so 1000000 stays an int to
+// argparse.
+func configValue(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	case []any:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
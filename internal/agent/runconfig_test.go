@@ -0,0 +1,40 @@
+package agent
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestConfigArgs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{"empty", `{}`, nil},
+		{"string", `{"name": "resnet"}`, []string{"--name=resnet"}},
+		{"integer", `{"epochs": 10}`, []string{"--epochs=10"}},
+		{"large integer", `{"max_steps": 1000000}`, []string{"--max_steps=1000000"}},
+		{"negative integer", `{"seed": -3}`, []string{"--seed=-3"}},
+		{"float", `{"lr": 0.001}`, []string{"--lr=0.001"}},
+		{"small float", `{"eps": 0.00001}`, []string{"--eps=0.00001"}},
+		{"exponent", `{"wd": 1e-8}`, []string{"--wd=0.00000001"}},
+		{"bool", `{"amp": true}`, []string{"--amp=true"}},
+		{"null", `{"ckpt": null}`, []string{"--ckpt="}},
+		{"list", `{"layers": [64, 128]}`, []string{"--layers=[64,128]"}},
+		{"nested", `{"optim": {"lr": 0.1, "betas": {"b1": 0.9}}}`, []string{"--optim.betas.b1=0.9", "--optim.lr=0.1"}},
+		{"sorted", `{"b": 1, "a": 2}`, []string{"--a=2", "--b=1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var config map[string]any
+			if err := json.Unmarshal([]byte(tt.config), &config); err != nil {
+				t.Fatal(err)
+			}
+			if got := ConfigArgs(config); !slices.Equal(got, tt.want) {
+				t.Errorf("ConfigArgs(%s) = %q, want %q", tt.config, got, tt.want)
+			}
+		})
+	}
+}
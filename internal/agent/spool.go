@@ -0,0 +1,498 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+const (
+	spoolSegmentBytes = 8 << 20
+	spoolRetryMin     = 1 * time.Second
+	spoolRetryMax     = 1 * time.Minute
+
+	// spoolRecordBytes caps the body of one record. Longer lines found when
+	// loading a segment are skipped.
+	spoolRecordBytes = 8 << 20
+
+	// spoolBatchBytes is roughly how large a batch of metrics or log lines is
+	// allowed to grow before it is split across records.
+	spoolBatchBytes = 1 << 20
+)
+
+// errBadSpoolRecord marks records that can never be sent.
+var errBadSpoolRecord = errors.New("bad spool record")
+
+// Spool record kinds, one per Worker endpoint.
+const (
+	spoolMetrics      = "metrics"
+	spoolLogs         = "logs"
+	spoolCompleted    = "completed"
+	spoolFailed       = "failed"
+	spoolCancelled    = "cancelled"
+	spoolEarlyStopped = "early_stopped"
+	spoolEnvironment  = "environment"
+	spoolPhase        = "phase"
+)
+
+// Spool is a write-ahead queue of reports for the Worker. Records are
+// appended to JSONL segment files and fsynced before they are sent, and an
+// ack line is appended once the Worker has accepted them. Segments whose
+// records are all acked are deleted. Records left over from a previous agent
+// process are sent again on startup, in order.
+//
+// When the spool grows past its size limit the oldest segment is dropped, so
+// a long Worker outage costs the oldest data rather than the disk.
+type Spool struct {
+	dir      string
+	maxBytes int64
+	client   *api.Client
+	logger   *slog.Logger
+
+	mu       sync.Mutex
+	nextID   uint64
+	nextSeg  int
+	pending  []*spoolEntry
+	segments []*spoolSegment
+	active   *os.File
+	notify   chan struct{}
+}
+
+type spoolSegment struct {
+	n    int
+	size int64
+	live int
+}
+
+type spoolEntry struct {
+	id   uint64
+	kind string
+	body json.RawMessage
+	seg  *spoolSegment
+}
+
+// spoolLine is one line of a segment: either a record or the ack of one.
+type spoolLine struct {
+	ID   uint64          `json:"id,omitempty"`
+	Kind string          `json:"kind,omitempty"`
+	Body json.RawMessage `json:"body,omitempty"`
+	Ack  uint64          `json:"ack,omitempty"`
+}
+
+// OpenSpool opens the spool in dir, loading any records that were not acked.
+func OpenSpool(dir string, maxBytes int64, client *api.Client, logger *slog.Logger) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating spool dir: %w", err)
+	}
+
+	s := &Spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		client:   client,
+		logger:   logger,
+		notify:   make(chan struct{}, 1),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	if len(s.pending) > 0 {
+		logger.Info("replaying spooled reports", "count", len(s.pending))
+	}
+	return s, nil
+}
+
+func (s *Spool) segmentPath(n int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d.jsonl", n))
+}
+
+// load reads existing segments. A line cut short by a crash is skipped.
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("reading spool dir: %w", err)
+	}
+
+	var nums []int
+	for _, e := range entries {
+		n, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".jsonl"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".jsonl") {
+			continue
+		}
+		nums = append(nums, n)
+	}
+	slices.Sort(nums)
+
+	records := make(map[uint64]*spoolEntry)
+	for _, n := range nums {
+		seg := &spoolSegment{n: n}
+		if err := s.loadSegment(seg, records); err != nil {
+			return err
+		}
+		s.segments = append(s.segments, seg)
+		s.nextSeg = n + 1
+	}
+
+	for _, e := range records {
+		s.pending = append(s.pending, e)
+	}
+	slices.SortFunc(s.pending, func(a, b *spoolEntry) int { return cmp.Compare(a.id, b.id) })
+
+	// Segments with nothing left to send can go
+	s.segments = slices.DeleteFunc(s.segments, func(seg *spoolSegment) bool {
+		if seg.live > 0 {
+			return false
+		}
+		os.Remove(s.segmentPath(seg.n))
+		return true
+	})
+	return nil
+}
+
+func (s *Spool) loadSegment(seg *spoolSegment, records map[uint64]*spoolEntry) error {
+	f, err := os.Open(s.segmentPath(seg.n))
+	if err != nil {
+		return fmt.Errorf("opening spool segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		data, n, tooLong, err := readSpoolLine(r, 2*spoolRecordBytes)
+		seg.size += int64(n)
+		if errors.Is(err, io.EOF) && n == 0 {
+			return nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("reading spool segment: %w", err)
+		}
+		if tooLong {
+			s.logger.Warn("skipping oversized spool line", "segment", seg.n, "bytes", n)
+			continue
+		}
+
+		var line spoolLine
+		if err := json.Unmarshal(data, &line); err != nil {
+			s.logger.Warn("skipping corrupt spool line", "segment", seg.n, "error", err)
+			continue
+		}
+		if line.Ack != 0 {
+			if e, ok := records[line.Ack]; ok {
+				e.seg.live--
+				delete(records, line.Ack)
+			}
+			continue
+		}
+		if e, ok := records[line.ID]; ok {
+			// Moved by enforceLimit, which crashed before removing the old
+			// segment
+			e.seg.live--
+		}
+		records[line.ID] = &spoolEntry{id: line.ID, kind: line.Kind, body: line.Body, seg: seg}
+		seg.live++
+		s.nextID = max(s.nextID, line.ID)
+	}
+}
+
+// readSpoolLine reads the next line of r without its newline, and the bytes
+// it took up. A line over limit bytes is read past and reported as too long.
+func readSpoolLine(r *bufio.Reader, limit int) (line []byte, n int, tooLong bool, err error) {
+	for {
+		chunk, err := r.ReadSlice('\n')
+		n += len(chunk)
+		if tooLong = n > limit+1; !tooLong {
+			line = append(line, chunk...)
+		} else {
+			line = nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return bytes.TrimSuffix(line, []byte("\n")), n, tooLong, err
+		}
+	}
+}
+
+// rotate starts a new active segment. Callers other than OpenSpool hold mu.
+func (s *Spool) rotate() error {
+	if s.active != nil {
+		s.active.Close()
+		if cur := s.segments[len(s.segments)-1]; cur.live == 0 {
+			os.Remove(s.segmentPath(cur.n))
+			s.segments = s.segments[:len(s.segments)-1]
+		}
+	}
+
+	seg := &spoolSegment{n: s.nextSeg}
+	f, err := os.OpenFile(s.segmentPath(seg.n), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating spool segment: %w", err)
+	}
+	s.nextSeg++
+	s.active = f
+	s.segments = append(s.segments, seg)
+	return nil
+}
+
+// Append durably records a report and queues it for sending.
+func (s *Spool) Append(kind string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("marshaling %s report: %w", kind, err)
+	}
+	if len(data) > spoolRecordBytes {
+		return fmt.Errorf("%w: %s report of %d bytes is too large", errBadSpoolRecord, kind, len(data))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.write(kind, data)
+	if err != nil {
+		return err
+	}
+	if e.seg.size >= spoolSegmentBytes {
+		if err := s.rotate(); err != nil {
+			s.logger.Error("rotating spool failed", "error", err)
+		}
+	}
+	s.enforceLimit()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// write appends a record to the active segment and queues it. Callers hold
+// mu.
+func (s *Spool) write(kind string, data json.RawMessage) (*spoolEntry, error) {
+	e := &spoolEntry{id: s.nextID + 1, kind: kind, body: data}
+	if err := s.writeEntry(e); err != nil {
+		return nil, err
+	}
+	s.nextID = e.id
+	s.pending = append(s.pending, e)
+	return e, nil
+}
+
+// writeEntry appends e's record to the active segment and moves e there.
+// Callers hold mu.
+func (s *Spool) writeEntry(e *spoolEntry) error {
+	line, _ := json.Marshal(spoolLine{ID: e.id, Kind: e.kind, Body: e.body})
+	line = append(line, '\n')
+	if _, err := s.active.Write(line); err != nil {
+		return fmt.Errorf("writing spool: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		return fmt.Errorf("syncing spool: %w", err)
+	}
+
+	e.seg = s.segments[len(s.segments)-1]
+	e.seg.size += int64(len(line))
+	e.seg.live++
+	return nil
+}
+
+// enforceLimit drops the oldest segments while the spool is over its size
+// limit. The active segment is never dropped. Terminal reports in a dropped
+// segment are moved to the active one, since without them the Worker would
+// take their runs to be still running. They keep their IDs and their place
+// in the queue, so one already being sent is acked rather than sent again.
+func (s *Spool) enforceLimit() {
+	if s.maxBytes <= 0 {
+		return
+	}
+	for s.size() > s.maxBytes && len(s.segments) > 1 {
+		oldest := s.segments[0]
+		s.logger.Warn("spool over size limit, dropping oldest reports", "segment", oldest.n, "records", oldest.live)
+		s.pending = slices.DeleteFunc(s.pending, func(e *spoolEntry) bool {
+			if e.seg != oldest {
+				return false
+			}
+			if !terminalReport(e.kind) {
+				return true
+			}
+			if err := s.writeEntry(e); err != nil {
+				s.logger.Error("keeping terminal report failed", "kind", e.kind, "error", err)
+				return true
+			}
+			return false
+		})
+		os.Remove(s.segmentPath(oldest.n))
+		s.segments = s.segments[1:]
+	}
+}
+
+// size returns the bytes of all segments. Callers hold mu.
+func (s *Spool) size() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// spoolBatches splits items into batches whose estimated size stays under
+// spoolBatchBytes. An item larger than that gets a batch of its own.
+func spoolBatches[T any](items []T, size func(T) int) [][]T {
+	var batches [][]T
+	start, total := 0, 0
+	for i, item := range items {
+		n := size(item)
+		if i > start && total+n > spoolBatchBytes {
+			batches = append(batches, items[start:i])
+			start, total = i, 0
+		}
+		total += n
+	}
+	if start < len(items) {
+		batches = append(batches, items[start:])
+	}
+	return batches
+}
+
+// terminalReport reports whether records of kind end a run.
+func terminalReport(kind string) bool {
+	switch kind {
+	case spoolCompleted, spoolFailed, spoolCancelled, spoolEarlyStopped:
+		return true
+	}
+	return false
+}
+
+// ack marks the head record as delivered. The ack line is not fsynced: if it
+// is lost the record is merely sent again.
+func (s *Spool) ack(e *spoolEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.pending) == 0 || s.pending[0] != e {
+		// Dropped by enforceLimit while it was being sent
+		return
+	}
+	s.pending = s.pending[1:]
+
+	e.seg.live--
+	active := e.seg == s.segments[len(s.segments)-1]
+	if e.seg.live == 0 && !active {
+		os.Remove(s.segmentPath(e.seg.n))
+		s.segments = slices.DeleteFunc(s.segments, func(seg *spoolSegment) bool { return seg == e.seg })
+		return
+	}
+
+	line, _ := json.Marshal(spoolLine{Ack: e.id})
+	line = append(line, '\n')
+	f := s.active
+	if !active {
+		var err error
+		if f, err = os.OpenFile(s.segmentPath(e.seg.n), os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			s.logger.Warn("writing spool ack failed", "error", err)
+			return
+		}
+		defer f.Close()
+	}
+	if _, err := f.Write(line); err != nil {
+		s.logger.Warn("writing spool ack failed", "error", err)
+		return
+	}
+	e.seg.size += int64(len(line))
+}
+
+// Run sends spooled records to the Worker in order until ctx is done,
+// retrying with backoff while the Worker is unreachable. Records the Worker
+// rejects outright are dropped.
+func (s *Spool) Run(ctx context.Context) {
+	backoff := spoolRetryMin
+	for {
+		s.mu.Lock()
+		var head *spoolEntry
+		if len(s.pending) > 0 {
+			head = s.pending[0]
+		}
+		s.mu.Unlock()
+
+		if head == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.notify:
+			}
+			continue
+		}
+
+		err := s.deliver(ctx, head)
+		var se *api.StatusError
+		switch {
+		case err == nil:
+			backoff = spoolRetryMin
+		case errors.Is(err, errBadSpoolRecord), errors.As(err, &se) && !se.Retryable():
+			s.logger.Error("dropping spooled report", "kind", head.kind, "error", err)
+		default:
+			if ctx.Err() != nil {
+				return
+			}
+			s.logger.Warn("sending spooled report failed, will retry", "kind", head.kind, "error", err, "retry_in", backoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, spoolRetryMax)
+			continue
+		}
+		s.ack(head)
+	}
+}
+
+func (s *Spool) deliver(ctx context.Context, e *spoolEntry) error {
+	switch e.kind {
+	case spoolMetrics:
+		return sendSpooled(ctx, e.body, s.client.SendMetrics)
+	case spoolLogs:
+		return sendSpooled(ctx, e.body, s.client.SendLogs)
+	case spoolCompleted:
+		return sendSpooled(ctx, e.body, s.client.ReportCompleted)
+	case spoolFailed:
+		return sendSpooled(ctx, e.body, s.client.ReportFailed)
+	case spoolCancelled:
+		return sendSpooled(ctx, e.body, s.client.ReportCancelled)
+	case spoolEarlyStopped:
+		return sendSpooled(ctx, e.body, s.client.ReportEarlyStopped)
+	case spoolEnvironment:
+		return sendSpooled(ctx, e.body, s.client.ReportEnvironment)
+	case spoolPhase:
+		return sendSpooled(ctx, e.body, s.client.ReportPhase)
+	}
+	return fmt.Errorf("%w: unknown kind %q", errBadSpoolRecord, e.kind)
+}
+
+func sendSpooled[T any](ctx context.Context, body json.RawMessage, send func(context.Context, T) error) error {
+	var req T
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fmt.Errorf("%w: %v", errBadSpoolRecord, err)
+	}
+	return send(ctx, req)
+}
+
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.Close()
+}
@@ -0,0 +1,293 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func openTestSpool(t *testing.T, dir string, maxBytes int64) *Spool {
+	t.Helper()
+	s, err := OpenSpool(dir, maxBytes, nil, testLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func pendingKinds(s *Spool) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kinds []string
+	for _, e := range s.pending {
+		kinds = append(kinds, e.kind)
+	}
+	return kinds
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	for _, kind := range []string{spoolLogs, spoolMetrics, spoolCompleted} {
+		if err := s.Append(kind, map[string]string{"run_id": "r1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.ack(s.pending[0])
+	lastID := s.nextID
+	s.Close()
+
+	s = openTestSpool(t, dir, 0)
+	if got, want := pendingKinds(s), []string{spoolMetrics, spoolCompleted}; !slices.Equal(got, want) {
+		t.Fatalf("replayed %q, want %q", got, want)
+	}
+	if err := s.Append(spoolLogs, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.pending[len(s.pending)-1].id; got <= lastID {
+		t.Errorf("new record id %d reuses an id up to %d", got, lastID)
+	}
+}
+
+func TestSpoolAckRemovesSegments(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	if err := s.Append(spoolMetrics, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// The old segment goes once its only record is acked
+	s = openTestSpool(t, dir, 0)
+	old := s.segmentPath(s.segments[0].n)
+	s.ack(s.pending[0])
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("acked segment still exists: %v", err)
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 0)
+	if got := pendingKinds(s); len(got) != 0 {
+		t.Errorf("replayed acked records %q", got)
+	}
+}
+
+func TestSpoolSkipsTruncatedLine(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	if err := s.Append(spoolMetrics, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.active.WriteString(`{"id":2,"kind":"logs","bo`); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 0)
+	if got, want := pendingKinds(s), []string{spoolMetrics}; !slices.Equal(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolSkipsOversizedLine(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	if err := s.Append(spoolMetrics, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	huge := `{"id":2,"kind":"logs","body":"` + strings.Repeat("x", 2*spoolRecordBytes) + "\"}\n"
+	if _, err := s.active.WriteString(huge); err != nil {
+		t.Fatal(err)
+	}
+	s.nextID = 2
+	if err := s.Append(spoolCompleted, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 0)
+	if got, want := pendingKinds(s), []string{spoolMetrics, spoolCompleted}; !slices.Equal(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolRejectsOversizedRecord(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 0)
+	err := s.Append(spoolLogs, strings.Repeat("x", spoolRecordBytes))
+	if !errors.Is(err, errBadSpoolRecord) {
+		t.Errorf("Append of an oversized record: %v, want a bad record", err)
+	}
+	if got := pendingKinds(s); len(got) != 0 {
+		t.Errorf("pending %q after a rejected record", got)
+	}
+}
+
+func TestSpoolBatches(t *testing.T) {
+	half, third := spoolBatchBytes/2, spoolBatchBytes/3
+	tests := []struct {
+		sizes []int
+		want  [][]int
+	}{
+		{sizes: nil, want: nil},
+		{sizes: []int{1, 2, 3}, want: [][]int{{1, 2, 3}}},
+		{sizes: []int{half, half, 1}, want: [][]int{{half, half}, {1}}},
+		{sizes: []int{third, spoolBatchBytes * 2, third}, want: [][]int{{third}, {spoolBatchBytes * 2}, {third}}},
+	}
+	for _, tt := range tests {
+		got := spoolBatches(tt.sizes, func(n int) int { return n })
+		if !slices.EqualFunc(got, tt.want, slices.Equal) {
+			t.Errorf("spoolBatches(%v) = %v, want %v", tt.sizes, got, tt.want)
+		}
+	}
+}
+
+func TestLogShipperSplitsBatches(t *testing.T) {
+	s := openTestSpool(t, t.TempDir(), 0)
+	logs := NewLogShipper(s, "r1", testLogger)
+	for range 3 {
+		logs.Add("stdout", strings.Repeat("x", spoolBatchBytes/2-100))
+	}
+	logs.Flush(context.Background())
+	if got, want := pendingKinds(s), []string{spoolLogs, spoolLogs}; !slices.Equal(got, want) {
+		t.Errorf("spooled %q, want %q", got, want)
+	}
+}
+
+func TestSpoolLimitDropsOldest(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	for _, kind := range []string{spoolMetrics, spoolLogs} {
+		if err := s.Append(kind, map[string]string{"run_id": "r1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	// Reopening starts a new segment, so the next append pushes the first
+	// one out
+	s = openTestSpool(t, dir, 1)
+	if err := s.Append(spoolLogs, map[string]string{"run_id": "r2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pendingKinds(s), []string{spoolLogs}; !slices.Equal(got, want) {
+		t.Fatalf("pending %q, want %q", got, want)
+	}
+	if got := string(s.pending[0].body); got != `{"run_id":"r2"}` {
+		t.Errorf("kept record body %s", got)
+	}
+	if len(s.segments) != 1 {
+		t.Errorf("%d segments left, want 1", len(s.segments))
+	}
+}
+
+func TestSpoolLimitKeepsTerminalReports(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	for _, kind := range []string{spoolMetrics, spoolLogs, spoolFailed} {
+		if err := s.Append(kind, map[string]string{"run_id": "r1"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 1)
+	if err := s.Append(spoolMetrics, map[string]string{"run_id": "r2"}); err != nil {
+		t.Fatal(err)
+	}
+	// The report keeps its place ahead of the newer record
+	if got, want := pendingKinds(s), []string{spoolFailed, spoolMetrics}; !slices.Equal(got, want) {
+		t.Fatalf("pending %q, want %q", got, want)
+	}
+	if got := string(s.pending[0].body); got != `{"run_id":"r1"}` {
+		t.Errorf("kept report body %s", got)
+	}
+	if got := s.pending[0].id; got != 3 {
+		t.Errorf("kept report has id %d, want 3", got)
+	}
+	if len(s.segments) != 1 {
+		t.Errorf("%d segments left, want 1", len(s.segments))
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 0)
+	if got, want := pendingKinds(s), []string{spoolFailed, spoolMetrics}; !slices.Equal(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolAckMovedTerminalReport(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	if err := s.Append(spoolCompleted, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// The report is being sent when enforceLimit moves it; its ack must still
+	// take it off the queue, or it would be delivered twice
+	s = openTestSpool(t, dir, 1)
+	head := s.pending[0]
+	if err := s.Append(spoolLogs, map[string]string{"run_id": "r2"}); err != nil {
+		t.Fatal(err)
+	}
+	s.ack(head)
+	if got, want := pendingKinds(s), []string{spoolLogs}; !slices.Equal(got, want) {
+		t.Errorf("pending %q, want %q", got, want)
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 0)
+	if got, want := pendingKinds(s), []string{spoolLogs}; !slices.Equal(got, want) {
+		t.Errorf("replayed %q, want %q", got, want)
+	}
+}
+
+func TestSpoolLoadMovedReportTwice(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	if err := s.Append(spoolFailed, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// A crash between moving a report and removing the old segment leaves
+	// the report in both
+	s = openTestSpool(t, dir, 0)
+	if err := s.writeEntry(s.pending[0]); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 0)
+	if got, want := pendingKinds(s), []string{spoolFailed}; !slices.Equal(got, want) {
+		t.Fatalf("replayed %q, want %q", got, want)
+	}
+	s.ack(s.pending[0])
+	if len(s.segments) != 1 {
+		t.Errorf("%d segments left after the ack, want the active one", len(s.segments))
+	}
+}
+
+func TestSpoolAckAfterDrop(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestSpool(t, dir, 0)
+	if err := s.Append(spoolMetrics, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = openTestSpool(t, dir, 1)
+	head := s.pending[0]
+	if err := s.Append(spoolLogs, map[string]string{"run_id": "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	// The record being sent was dropped; its ack must not take the new head
+	s.ack(head)
+	if got, want := pendingKinds(s), []string{spoolLogs}; !slices.Equal(got, want) {
+		t.Errorf("pending %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,223 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// What to do about a stalled run.
+const (
+	stallActionAlert = "alert"
+	stallActionKill  = "kill"
+)
+
+const (
+	// stallCheckInterval is how often a run's output is checked for
+	// progress, at most.
+	stallCheckInterval = 30 * time.Second
+
+	// stackDumpSignal makes a Python process that ran stackDumpSite dump the
+	// stacks of all its threads.
+	stackDumpSignal = syscall.SIGUSR1
+
+	// stackDumpWait is how long a process is given to write its stacks
+	// before the next one is signalled, so dumps don't interleave.
+	stackDumpWait = 200 * time.Millisecond
+
+	// stacksFile, in a run's control dir, collects its stack dumps, and
+	// stallStacksArtifact is the copy uploaded with the run's artifacts.
+	stacksFile          = "stacks.txt"
+	stallStacksArtifact = "mlflare-stall-stacks.txt"
+
+	// stackDumpSiteDir, in a run's control dir, is put on PYTHONPATH so the
+	// run's Python processes import stackDumpSite at startup.
+	stackDumpSiteDir = "site"
+)
+
+// stackDumpSite is the sitecustomize module that makes a Python process dump
+// its stacks to the run's stacks file when sent stackDumpSignal. A failure is
+// ignored so it can never break the run. Since it shadows any sitecustomize
+// of the project or the venv, it then runs that one, as Python would have.
+const stackDumpSite = `# Written by the mlflare agent to dump stacks when a run stalls.
+import os
+
+try:
+    import faulthandler
+    import signal
+
+    _mlflare_stacks = open(os.environ["MLFLARE_STACKS_FILE"], "a")
+    faulthandler.register(signal.SIGUSR1, file=_mlflare_stacks, all_threads=True)
+except Exception:
+    pass
+
+
+def _mlflare_chain():
+    import importlib.machinery
+    import importlib.util
+    import sys
+
+    here = os.path.dirname(os.path.abspath(__file__))
+    path = [p for p in sys.path if os.path.abspath(p or os.curdir) != here]
+    spec = importlib.machinery.PathFinder.find_spec("sitecustomize", path)
+    if spec is None:
+        return
+    module = importlib.util.module_from_spec(spec)
+    sys.modules["sitecustomize"] = module
+    spec.loader.exec_module(module)
+
+
+_mlflare_chain()
+`
+
+// stackDumpEnv writes stackDumpSite to the run's control dir and returns the
+// environment that has the run's Python processes load it. PYTHONFAULTHANDLER
+// also has them dump their stacks to stderr if they crash.
+func stackDumpEnv(controlDir string) ([]string, error) {
+	dir := filepath.Join(controlDir, stackDumpSiteDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating site dir: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sitecustomize.py"), []byte(stackDumpSite), 0o644); err != nil {
+		return nil, fmt.Errorf("writing sitecustomize: %w", err)
+	}
+	pythonPath := dir
+	if p := os.Getenv("PYTHONPATH"); p != "" {
+		pythonPath += string(os.PathListSeparator) + p
+	}
+	return []string{
+		"PYTHONFAULTHANDLER=1",
+		"PYTHONPATH=" + pythonPath,
+		"MLFLARE_STACKS_FILE=" + filepath.Join(controlDir, stacksFile),
+	}, nil
+}
+
+// watchStall watches a run for stalls until ctx is done. A run is stalled
+// once it has written nothing to stdout or stderr for the stall timeout
+// and, if so configured, its GPUs are idle. Stderr counts because progress
+// bars usually go there. The stacks of a stalled run's Python processes are
+// dumped if they run on this host under pid, which is 0 otherwise; then the
+// run is either flagged in its status message until it makes progress
+// again, or killed.
+func (a *Agent) watchStall(ctx context.Context, sess *runSession, st *runState, proc *Process, pid int, gpus *GPUSampler, artifacts *ArtifactCollector) {
+	timeout := a.cfg.StallTimeout
+	if timeout <= 0 {
+		return
+	}
+	logger := a.logger.With("run_id", st.Assignment.RunID)
+	ticker := time.NewTicker(min(stallCheckInterval, timeout/2))
+	defer ticker.Stop()
+
+	lastOut, lastErr := proc.Offsets()
+	lastProgress := time.Now()
+	stalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if out, errOut := proc.Offsets(); out != lastOut || errOut != lastErr {
+			lastOut, lastErr, lastProgress = out, errOut, time.Now()
+			if stalled {
+				logger.Info("stalled run is making progress again")
+				sess.info.SetStatus("")
+				stalled = false
+			}
+			continue
+		}
+		idle := time.Since(lastProgress)
+		if stalled || idle < timeout {
+			continue
+		}
+		if a.cfg.StallIdleGPU && gpus != nil && gpusBusy(ctx, gpus) {
+			continue
+		}
+
+		stalled = true
+		msg := fmt.Sprintf("no output or metrics for %s", idle.Round(time.Second))
+		logger.Warn("run stalled", "idle", idle.Round(time.Second), "action", a.cfg.StallAction)
+		if pid > 0 {
+			a.dumpStacks(st, pid, msg, sess.logs, artifacts)
+		}
+		if a.cfg.StallAction == stallActionKill {
+			sess.cancelRun(&limitExceeded{reason: reasonStalled, msg: "run stalled: " + msg})
+			return
+		}
+		sess.info.SetStatus("stalled: " + msg)
+	}
+}
+
+// gpusBusy reports whether any of the sampled GPUs is in use. If that can't
+// be told, they are taken to be idle, so output alone decides.
+func gpusBusy(ctx context.Context, gpus *GPUSampler) bool {
+	values, err := gpus.Sample(ctx)
+	if err != nil {
+		return false
+	}
+	for name, v := range values {
+		if strings.HasSuffix(name, "/utilization") && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// dumpStacks has every process in the tree under the supervisor pid that
+// handles stackDumpSignal dump its stacks to the run's stacks file, one after
+// the other under a header naming it. The new dumps are shipped with the
+// run's logs, and the file is copied to the run's work dir to be uploaded
+// with its artifacts.
+func (a *Agent) dumpStacks(st *runState, pid int, reason string, logs *LogShipper, artifacts *ArtifactCollector) {
+	path := filepath.Join(st.dir, stacksFile)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		a.logger.Warn("opening stacks file failed", "error", err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		a.logger.Warn("opening stacks file failed", "error", err)
+		return
+	}
+	from := info.Size()
+
+	fmt.Fprintf(f, "=== %s: %s\n", time.Now().UTC().Format(time.RFC3339), reason)
+	dumped := 0
+	// The root is the supervisor, which ignores the signal
+	for _, p := range processTree(pid)[1:] {
+		if !procCatchesSignal(p, stackDumpSignal) || !procHasEnv(p, "MLFLARE_STACKS_FILE="+path) {
+			continue
+		}
+		fmt.Fprintf(f, "\n--- pid %d: %s\n", p, procCmdline(p))
+		if err := syscall.Kill(p, stackDumpSignal); err != nil {
+			continue
+		}
+		dumped++
+		time.Sleep(stackDumpWait)
+	}
+	if dumped == 0 {
+		fmt.Fprintln(f, "no Python process of the run could dump its stacks")
+	}
+	a.logger.Info("dumped stacks of stalled run", "processes", dumped)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		a.logger.Warn("reading stacks file failed", "error", err)
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data[from:]), "\n"), "\n") {
+		logs.Add("stderr", line)
+	}
+	if err := os.WriteFile(filepath.Join(st.WorkDir, stallStacksArtifact), data, 0o644); err != nil {
+		a.logger.Warn("copying stacks file failed", "error", err)
+		return
+	}
+	artifacts.Declare(stallStacksArtifact)
+}
@@ -0,0 +1,68 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestStackDumpSite checks that a Python process run with stackDumpEnv loads
+// the agent's sitecustomize and has the stack dump handler installed.
+func TestStackDumpSite(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not found")
+	}
+	control := t.TempDir()
+	env, err := stackDumpEnv(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(python, "-c", `import faulthandler, os, signal, sitecustomize
+print(sitecustomize.__file__)
+faulthandler.unregister(signal.SIGUSR1) or print("no handler")`)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("python: %v: %s", err, out)
+	}
+	want := filepath.Join(control, stackDumpSiteDir, "sitecustomize.py")
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("python printed %q, want %q", got, want)
+	}
+}
+
+// TestStackDumpSiteChains checks that the agent's sitecustomize runs the one
+// it shadows on PYTHONPATH.
+func TestStackDumpSiteChains(t *testing.T) {
+	python, err := exec.LookPath("python3")
+	if err != nil {
+		t.Skip("python3 not found")
+	}
+	project := t.TempDir()
+	site := "import os\nos.environ['PROJECT_SITE'] = 'ran'\n"
+	if err := os.WriteFile(filepath.Join(project, "sitecustomize.py"), []byte(site), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PYTHONPATH", project)
+	control := t.TempDir()
+	env, err := stackDumpEnv(control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(python, "-c", `import faulthandler, os, signal, sitecustomize
+print(os.environ.get("PROJECT_SITE"), sitecustomize.__file__)
+faulthandler.unregister(signal.SIGUSR1) or print("no handler")`)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("python: %v: %s", err, out)
+	}
+	want := "ran " + filepath.Join(project, "sitecustomize.py")
+	if got := strings.TrimSpace(string(out)); got != want {
+		t.Errorf("python printed %q, want %q", got, want)
+	}
+}
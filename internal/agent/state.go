@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+// stateFile, in a run's control dir, describes the run to a restarted agent.
+const stateFile = "state.json"
+
+// Run phases recorded in the state file.
+const (
+	// phasePreparing covers downloading the bundle and the other setup before
+	// the process starts. A run interrupted here is reported as failed.
+	phasePreparing = "preparing"
+
+	// phaseInstallingDeps covers installing the bundle's dependencies into
+	// the run's venv. It is timed and reported apart from the rest of the
+	// setup, and an interrupted run is reported as failed here too.
+	phaseInstallingDeps = "installing_deps"
+
+	// phaseRunning means the process has been started. A restarted agent
+	// reattaches to it, or finishes the run if it exited in the meantime.
+	phaseRunning = "running"
+)
+
+// runState is the local record of an in-flight run. It is kept in
+// <WorkDir>/state/<run_id>/ next to the process's console output and exit
+// code, and removed once the run's final report is spooled.
+type runState struct {
+	Assignment *api.Assignment `json:"assignment"`
+	Phase      string          `json:"phase"`
+	StartedAt  time.Time       `json:"started_at"`
+	WorkDir    string          `json:"work_dir,omitempty"`
+
+	// GPUs are the indices of the GPUs the run was given.
+	GPUs []int `json:"gpus,omitempty"`
+
+	// Venv is the key of the venv the run uses in the venv pool.
+	Venv string `json:"venv,omitempty"`
+
+	// Executor is the executor that started the process, local if empty.
+	Executor string `json:"executor,omitempty"`
+
+	// PID and PIDStart (the start time from /proc/<pid>/stat) identify the
+	// supervisor, so a reused PID is not mistaken for it. A SLURM job is
+	// identified by its JobID instead.
+	PID      int    `json:"pid,omitempty"`
+	PIDStart uint64 `json:"pid_start,omitempty"`
+	JobID    string `json:"job_id,omitempty"`
+
+	// Checkpoint of how far the run's output has been read and spooled.
+	StdoutOffset int64 `json:"stdout_offset,omitempty"`
+	StderrOffset int64 `json:"stderr_offset,omitempty"`
+	NextStep     int   `json:"next_step,omitempty"`
+	LogSeq       int   `json:"log_seq,omitempty"`
+
+	// SysNextStep is the next step of the system telemetry, which is counted
+	// apart from the training steps.
+	SysNextStep int `json:"sys_next_step,omitempty"`
+
+	dir string
+}
+
+func newRunState(stateDir string, assignment *api.Assignment) *runState {
+	return &runState{
+		Assignment: assignment,
+		Phase:      phasePreparing,
+		StartedAt:  time.Now(),
+		dir:        filepath.Join(stateDir, assignment.RunID),
+	}
+}
+
+// loadRunStates reads the state of every run left behind by an earlier agent.
+func loadRunStates(stateDir string) ([]*runState, error) {
+	entries, err := os.ReadDir(stateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading state dir: %w", err)
+	}
+
+	var states []*runState
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(stateDir, e.Name())
+		data, err := os.ReadFile(filepath.Join(dir, stateFile))
+		if err != nil {
+			// Nothing was recorded before the agent stopped
+			os.RemoveAll(dir)
+			continue
+		}
+		st := &runState{dir: dir}
+		if err := json.Unmarshal(data, st); err != nil || st.Assignment == nil {
+			// Unreadable, so all that's left is to fail the run
+			st = &runState{Assignment: &api.Assignment{RunID: e.Name()}, Phase: phasePreparing, dir: dir}
+		}
+		states = append(states, st)
+	}
+	return states, nil
+}
+
+// save writes the state atomically.
+func (s *runState) save() error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return fmt.Errorf("creating state dir: %w", err)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("marshaling state: %w", err)
+	}
+
+	tmp := filepath.Join(s.dir, stateFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("writing state: %w", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing state: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, stateFile))
+}
+
+// remove deletes the run's control dir, including its console output.
+func (s *runState) remove() error {
+	return os.RemoveAll(s.dir)
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+// Stop rule kinds.
+const (
+	stopNonFinite = "non_finite"
+	stopPlateau   = "plateau"
+	stopAbove     = "above"
+	stopBelow     = "below"
+)
+
+// earlyStopped is the cancel cause of a run stopped by a stop rule. It
+// unwraps to errRunCancelled, so the process is stopped the way a cancelled
+// run's is, but the run is reported as early_stopped.
+type earlyStopped struct {
+	rule string
+}
+
+func (e *earlyStopped) Error() string { return "stopped early: " + e.rule }
+func (e *earlyStopped) Unwrap() error { return errRunCancelled }
+
+// StopRules checks the metrics a run reports against its stop rules and stops
+// the run once one matches. What a plateau rule has seen is kept in memory
+// only, so its patience starts over if the agent reattaches to the run.
+type StopRules struct {
+	stop   context.CancelCauseFunc
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	rules []stopRuleState
+	fired bool
+}
+
+type stopRuleState struct {
+	api.StopRule
+
+	// best is the best value a plateau rule has seen, and since the number
+	// of reports since.
+	best  float64
+	seen  bool
+	since int
+}
+
+// NewStopRules returns the checker for rules, or nil if there are none.
+// Rules of an unknown kind are ignored.
+func NewStopRules(rules []api.StopRule, stop context.CancelCauseFunc, logger *slog.Logger) *StopRules {
+	s := &StopRules{stop: stop, logger: logger}
+	for _, r := range rules {
+		switch r.Kind {
+		case stopNonFinite, stopPlateau, stopAbove, stopBelow:
+			s.rules = append(s.rules, stopRuleState{StopRule: r})
+		default:
+			logger.Warn("ignoring stop rule of unknown kind", "metric", r.Metric, "kind", r.Kind)
+		}
+	}
+	if len(s.rules) == 0 {
+		return nil
+	}
+	return s
+}
+
+// Observe checks the scalars of a point reported at step. The first rule to
+// match stops the run.
+func (s *StopRules) Observe(step int, values map[string]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fired {
+		return
+	}
+	for i := range s.rules {
+		r := &s.rules[i]
+		v, ok := values[r.Metric]
+		if !ok || step < r.AfterStep || !r.matches(v) {
+			continue
+		}
+		s.fired = true
+		rule := fmt.Sprintf("%s (%s = %g at step %d)", describeStopRule(r.StopRule), r.Metric, v, step)
+		s.logger.Info("stop rule matched, stopping run", "rule", rule)
+		s.stop(&earlyStopped{rule: rule})
+		return
+	}
+}
+
+// matches reports whether the next value of the rule's metric, v, makes it
+// fire.
+func (r *stopRuleState) matches(v float64) bool {
+	switch r.Kind {
+	case stopNonFinite:
+		return math.IsNaN(v) || math.IsInf(v, 0)
+	case stopAbove:
+		return v > r.Threshold
+	case stopBelow:
+		return v < r.Threshold
+	case stopPlateau:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+		if !r.seen || r.Maximize && v > r.best || !r.Maximize && v < r.best {
+			r.best, r.seen, r.since = v, true, 0
+			return false
+		}
+		r.since++
+		return r.since >= r.Patience
+	}
+	return false
+}
+
+// describeStopRule says what a rule stops a run at, e.g. "val_loss did not
+// improve in 5 reports after step 1000".
+func describeStopRule(r api.StopRule) string {
+	var desc string
+	switch r.Kind {
+	case stopNonFinite:
+		desc = r.Metric + " is NaN or infinite"
+	case stopPlateau:
+		desc = fmt.Sprintf("%s did not improve in %d reports", r.Metric, r.Patience)
+	case stopAbove:
+		desc = fmt.Sprintf("%s > %g", r.Metric, r.Threshold)
+	case stopBelow:
+		desc = fmt.Sprintf("%s < %g", r.Metric, r.Threshold)
+	}
+	if r.AfterStep > 0 {
+		desc += fmt.Sprintf(" after step %d", r.AfterStep)
+	}
+	return desc
+}
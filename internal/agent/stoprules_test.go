@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+func TestStopRules(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	tests := []struct {
+		name   string
+		rule   api.StopRule
+		values []float64
+		// fireAt is the index of the value that stops the run, or -1
+		fireAt int
+	}{
+		{"non finite nan", api.StopRule{Metric: "loss", Kind: stopNonFinite}, []float64{1, 0.5, nan}, 2},
+		{"non finite inf", api.StopRule{Metric: "loss", Kind: stopNonFinite}, []float64{1, -inf}, 1},
+		{"non finite finite", api.StopRule{Metric: "loss", Kind: stopNonFinite}, []float64{1, 1e308, -1e308}, -1},
+		{"above", api.StopRule{Metric: "loss", Kind: stopAbove, Threshold: 10}, []float64{9, 10, 10.5}, 2},
+		{"below", api.StopRule{Metric: "acc", Kind: stopBelow, Threshold: 0.1}, []float64{0.5, 0.1, 0.09}, 2},
+		{"above nan", api.StopRule{Metric: "loss", Kind: stopAbove, Threshold: 10}, []float64{nan, 9}, -1},
+		{"after step", api.StopRule{Metric: "loss", Kind: stopAbove, Threshold: 10, AfterStep: 2}, []float64{50, 50, 50}, 2},
+		{
+			"plateau minimize",
+			api.StopRule{Metric: "loss", Kind: stopPlateau, Patience: 2},
+			[]float64{1, 0.9, 0.95, 0.92}, 3,
+		},
+		{
+			"plateau maximize",
+			api.StopRule{Metric: "acc", Kind: stopPlateau, Patience: 2, Maximize: true},
+			[]float64{0.5, 0.6, 0.55, 0.58}, 3,
+		},
+		{
+			"plateau improvement resets patience",
+			api.StopRule{Metric: "loss", Kind: stopPlateau, Patience: 2},
+			[]float64{1, 1.1, 0.9, 1, 1}, 4,
+		},
+		{
+			"plateau equal is no improvement",
+			api.StopRule{Metric: "loss", Kind: stopPlateau, Patience: 1},
+			[]float64{1, 1}, 1,
+		},
+		{
+			"plateau ignores nan",
+			api.StopRule{Metric: "loss", Kind: stopPlateau, Patience: 2},
+			[]float64{1, nan, nan, inf, 0.5}, -1,
+		},
+		{
+			"plateau after step",
+			api.StopRule{Metric: "loss", Kind: stopPlateau, Patience: 1, AfterStep: 2},
+			[]float64{1, 2, 3, 4}, 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, stop := context.WithCancelCause(context.Background())
+			defer stop(nil)
+			rules := NewStopRules([]api.StopRule{tt.rule}, stop, testLogger)
+
+			fired := -1
+			for step, v := range tt.values {
+				rules.Observe(step, map[string]float64{tt.rule.Metric: v, "other": nan})
+				if fired < 0 && ctx.Err() != nil {
+					fired = step
+				}
+			}
+			if fired != tt.fireAt {
+				t.Fatalf("fired at %d, want %d", fired, tt.fireAt)
+			}
+			if fired < 0 {
+				return
+			}
+			var es *earlyStopped
+			if !errors.As(context.Cause(ctx), &es) || !isCancelled(ctx) {
+				t.Errorf("cause %v, want an early stop", context.Cause(ctx))
+			}
+		})
+	}
+}
+
+func TestStopRulesFireOnce(t *testing.T) {
+	n := 0
+	rules := NewStopRules([]api.StopRule{
+		{Metric: "loss", Kind: stopNonFinite},
+		{Metric: "loss", Kind: stopAbove, Threshold: 1},
+	}, func(error) { n++ }, testLogger)
+	rules.Observe(0, map[string]float64{"loss": math.Inf(1)})
+	rules.Observe(1, map[string]float64{"loss": 5})
+	if n != 1 {
+		t.Errorf("stopped %d times, want once", n)
+	}
+}
+
+func TestStopRulesMissingMetric(t *testing.T) {
+	n := 0
+	rules := NewStopRules([]api.StopRule{{Metric: "loss", Kind: stopNonFinite}}, func(error) { n++ }, testLogger)
+	rules.Observe(0, map[string]float64{"val_loss": math.NaN()})
+	rules.Observe(1, nil)
+	if n != 0 {
+		t.Errorf("stopped on a metric the rule is not about")
+	}
+}
+
+func TestNewStopRulesUnknownKind(t *testing.T) {
+	if rules := NewStopRules([]api.StopRule{{Metric: "loss", Kind: "diverged"}}, func(error) {}, testLogger); rules != nil {
+		t.Error("rules of unknown kinds only should give no checker")
+	}
+}
+
+func TestDescribeStopRule(t *testing.T) {
+	tests := []struct {
+		rule api.StopRule
+		want string
+	}{
+		{api.StopRule{Metric: "loss", Kind: stopNonFinite}, "loss is NaN or infinite"},
+		{api.StopRule{Metric: "val_loss", Kind: stopPlateau, Patience: 5, AfterStep: 1000}, "val_loss did not improve in 5 reports after step 1000"},
+		{api.StopRule{Metric: "loss", Kind: stopAbove, Threshold: 100}, "loss > 100"},
+		{api.StopRule{Metric: "acc", Kind: stopBelow, Threshold: 0.05}, "acc < 0.05"},
+	}
+	for _, tt := range tests {
+		if got := describeStopRule(tt.rule); got != tt.want {
+			t.Errorf("describeStopRule(%+v) = %q, want %q", tt.rule, got, tt.want)
+		}
+	}
+}
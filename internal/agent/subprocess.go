@@ -3,65 +3,411 @@ package agent
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-func RunSubprocess(ctx context.Context, workDir, pythonBin, entrypoint string, batcher *MetricBatcher, logger *slog.Logger) (int, error) {
-	cmd := exec.CommandContext(ctx, pythonBin, entrypoint)
-	cmd.Dir = workDir
+// Files in a run's control dir shared by the agent and the supervisor.
+const (
+	stdoutFile   = "stdout.log"
+	stderrFile   = "stderr.log"
+	exitCodeFile = "exit_code"
 
-	stdout, err := cmd.StdoutPipe()
+	// pgidFile holds the ID of the command's process group
+	pgidFile = "pgid"
+)
+
+const (
+	// followPollInterval is how often console files are checked for new
+	// output once the reader has caught up.
+	followPollInterval = 200 * time.Millisecond
+
+	// attachPollInterval is how often a reattached process is checked for
+	// exit. It isn't the agent's child, so it can't be waited for.
+	attachPollInterval = 1 * time.Second
+
+	// slurmPollInterval is how often squeue is asked whether a job is done.
+	slurmPollInterval = 10 * time.Second
+)
+
+// errDetached is returned by Process.Follow when the agent shuts down while
+// the process keeps running.
+var errDetached = errors.New("detached from running process")
+
+// SubprocessSpec describes the process an Executor starts.
+type SubprocessSpec struct {
+	// Name identifies the run to executors that name what they start, such
+	// as containers and SLURM jobs.
+	Name string
+
+	WorkDir    string
+	PythonBin  string
+	Entrypoint string
+
+	// Command, if set, is run instead of the entrypoint. A bare program name
+	// is looked up on the PATH in Env.
+	Command []string
+
+	// Args are added to the command line.
+	Args []string
+
+	// GPUs are the indices of the host GPUs the run was given, and GPUCount
+	// how many GPUs it asked for, which is what a SLURM job requests.
+	GPUs     []int
+	GPUCount int
+
+	// Image is the container image the container executor runs.
+	Image string
+
+	// ControlDir receives the process's console output and exit code.
+	ControlDir string
+
+	// Env is the run's environment. Processes on this host also get the
+	// agent's own.
+	Env []string
+}
+
+// argv returns the command line: Command, or the entrypoint run by
+// PythonBin, followed by Args.
+func (s SubprocessSpec) argv() []string {
+	argv := s.Command
+	if len(argv) == 0 {
+		argv = []string{s.PythonBin, s.Entrypoint}
+	}
+	return append(slices.Clone(argv), s.Args...)
+}
+
+// SubprocessSinks receive what the process reports on stdout and stderr.
+type SubprocessSinks struct {
+	Metrics   *MetricBatcher
+	Info      *RunInfoBatcher
+	Logs      *LogShipper
+	Artifacts *ArtifactCollector
+
+	// Stderr, if set, keeps the end of stderr for a failure report.
+	Stderr *StderrTail
+
+	// Stop, if set, checks the reported metrics against the run's stop
+	// rules.
+	Stop *StopRules
+}
+
+// route hands a protocol event to the sink for its type.
+func (s SubprocessSinks) route(ev Event, logger *slog.Logger) {
+	switch ev.Type {
+	case EventMetrics:
+		p := ev.Point
+		dropReserved(p.Scalars, logger)
+		dropReserved(p.Histograms, logger)
+		dropReserved(p.Texts, logger)
+		if len(p.Scalars)+len(p.Histograms)+len(p.Texts) == 0 {
+			return
+		}
+		step := s.Metrics.AddPoint(p)
+		if s.Stop != nil {
+			s.Stop.Observe(step, p.Scalars)
+		}
+	case EventParams:
+		s.Info.AddParams(ev.Values)
+	case EventSummary:
+		s.Info.AddSummary(ev.Values)
+	case EventTags:
+		s.Info.AddTags(ev.Tags)
+	case EventArtifact:
+		s.Artifacts.Declare(ev.Path)
+	case EventStatus:
+		s.Info.SetStatus(ev.Message)
+	}
+}
+
+// dropReserved removes metrics under sysMetricPrefix.
+func dropReserved[V any](values map[string]V, logger *slog.Logger) {
+	for name := range values {
+		if strings.HasPrefix(name, sysMetricPrefix) {
+			logger.Debug("dropping metric in reserved namespace", "name", name)
+			delete(values, name)
+		}
+	}
+}
+
+// Process is a training process started by an Executor. For processes on
+// this host PID is the supervisor's (see Supervise); a SLURM job has a JobID
+// instead.
+type Process struct {
+	PID        int
+	StartTime  uint64
+	JobID      string
+	ControlDir string
+
+	executor Executor
+
+	// cmd is nil for a process started by an earlier agent.
+	cmd *exec.Cmd
+
+	stdoutRead atomic.Int64
+	stderrRead atomic.Int64
+}
+
+// startSupervised starts argv under the supervisor with its output going to
+// files in the control dir. env is added to the agent's own environment.
+func startSupervised(e Executor, spec SubprocessSpec, argv, env []string, logger *slog.Logger) (*Process, error) {
+	exe, err := os.Executable()
 	if err != nil {
-		return 1, fmt.Errorf("stdout pipe: %w", err)
+		return nil, fmt.Errorf("locating agent binary: %w", err)
 	}
-	stderr, err := cmd.StderrPipe()
+	stdout, stderr, err := createConsoleFiles(spec.ControlDir)
 	if err != nil {
-		return 1, fmt.Errorf("stderr pipe: %w", err)
+		return nil, err
 	}
+	defer stdout.Close()
+	defer stderr.Close()
 
+	exitFile := filepath.Join(spec.ControlDir, exitCodeFile)
+	cmd := exec.Command(exe, append([]string{SuperviseArg, exitFile}, argv...)...)
+	cmd.Dir = spec.WorkDir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	if err := cmd.Start(); err != nil {
-		return 1, fmt.Errorf("starting process: %w", err)
+		return nil, fmt.Errorf("starting process: %w", err)
 	}
 
-	logger.Info("subprocess started", "pid", cmd.Process.Pid)
+	p := &Process{PID: cmd.Process.Pid, ControlDir: spec.ControlDir, executor: e, cmd: cmd}
+	if st, err := readProcStat(p.PID); err == nil {
+		p.StartTime = st.startTime
+	}
+	logger.Info("subprocess started", "pid", p.PID)
+	return p, nil
+}
+
+// createConsoleFiles prepares the control dir for a new process: it creates
+// empty stdout and stderr files and removes any old exit code.
+func createConsoleFiles(controlDir string) (stdout, stderr *os.File, err error) {
+	if err := os.MkdirAll(controlDir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("creating control dir: %w", err)
+	}
+	os.Remove(filepath.Join(controlDir, exitCodeFile))
+	os.Remove(filepath.Join(controlDir, pgidFile))
+
+	stdout, err = os.Create(filepath.Join(controlDir, stdoutFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating stdout file: %w", err)
+	}
+	stderr, err = os.Create(filepath.Join(controlDir, stderrFile))
+	if err != nil {
+		stdout.Close()
+		return nil, nil, fmt.Errorf("creating stderr file: %w", err)
+	}
+	return stdout, stderr, nil
+}
+
+// AttachProcess returns a process the executor started for an earlier
+// agent. ok is false if the process is gone and never recorded an exit code,
+// which happens when the supervisor itself was killed.
+func AttachProcess(e Executor, controlDir string, pid int, startTime uint64, jobID string) (p *Process, ok bool) {
+	p = &Process{PID: pid, StartTime: startTime, JobID: jobID, ControlDir: controlDir, executor: e}
+	if p.alive() {
+		return p, true
+	}
+	_, ok = readIntFile(filepath.Join(controlDir, exitCodeFile))
+	return p, ok
+}
 
-	// Read stdout — parse __mlflare__ JSON lines
+func (p *Process) alive() bool {
+	return p.executor.Alive(p)
+}
+
+// Offsets returns how many bytes of stdout and stderr have been handled.
+func (p *Process) Offsets() (stdout, stderr int64) {
+	return p.stdoutRead.Load(), p.stderrRead.Load()
+}
+
+// wait blocks until the process exits.
+func (p *Process) wait() {
+	if p.cmd != nil {
+		p.cmd.Wait()
+		return
+	}
+	interval := attachPollInterval
+	if p.JobID != "" {
+		interval = slurmPollInterval
+	}
+	for p.alive() {
+		time.Sleep(interval)
+	}
+}
+
+func (p *Process) signal(sig syscall.Signal) error {
+	return p.executor.Signal(p, sig)
+}
+
+// Follow reads the process's output from the given offsets and routes it to
+// the sinks until the process exits or ctx is done, then returns its exit
+// code. On cancellation the process receives SIGTERM and, if it is still
+// alive after the grace period, SIGKILL. If ctx is done for any other reason
+// the agent is shutting down; the process is left running and errDetached is
+// returned.
+func (p *Process) Follow(ctx context.Context, stdoutFrom, stderrFrom int64, grace time.Duration, sinks SubprocessSinks, logger *slog.Logger) (int, error) {
+	exited := make(chan struct{})
 	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			line := scanner.Text()
+		p.wait()
+		close(exited)
+	}()
+
+	stop := make(chan struct{})
+	var detached atomic.Bool
+	go func() {
+		select {
+		case <-exited:
+			close(stop)
+			return
+		case <-ctx.Done():
+		}
+		if !isCancelled(ctx) {
+			detached.Store(true)
+			close(stop)
+			return
+		}
+
+		logger.Info("sending SIGTERM to subprocess", "pid", p.PID, "grace_period", grace)
+		p.signal(syscall.SIGTERM)
+		select {
+		case <-exited:
+		case <-time.After(grace):
+			logger.Warn("subprocess did not exit in time, killing it", "pid", p.PID)
+			p.signal(syscall.SIGKILL)
+			<-exited
+		}
+		close(stop)
+	}()
+
+	stdout, err := openFrom(filepath.Join(p.ControlDir, stdoutFile), stdoutFrom)
+	if err != nil {
+		return 1, err
+	}
+	defer stdout.Close()
+	stderr, err := openFrom(filepath.Join(p.ControlDir, stderrFile), stderrFrom)
+	if err != nil {
+		return 1, err
+	}
+	defer stderr.Close()
+	p.stdoutRead.Store(stdoutFrom)
+	p.stderrRead.Store(stderrFrom)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	// Read stdout — route protocol lines, ship everything else as logs
+	go func() {
+		defer wg.Done()
+		scanLines(&followReader{f: stdout, stop: stop}, func(line string) {
+			defer p.stdoutRead.Add(int64(len(line)) + 1)
 			logger.Debug("stdout", "line", line)
 
-			var payload struct {
-				MLflare map[string]float64 `json:"__mlflare__"`
-			}
-			if err := json.Unmarshal([]byte(line), &payload); err == nil && payload.MLflare != nil {
-				batcher.Add(payload.MLflare)
+			// Under a launcher, only rank 0 reports
+			rank, msg := splitRank(line)
+			ev, ok, err := ParseEvent(msg)
+			switch {
+			case err != nil:
+				logger.Warn("malformed protocol line", "error", err, "line", line)
+			case ok && rank > 0:
+				logger.Debug("dropping protocol line from rank", "rank", rank)
+				return
+			case ok:
+				sinks.route(ev, logger)
+				return
 			}
-		}
+			sinks.Logs.Add("stdout", line)
+		})
 	}()
 
 	// Read stderr
 	go func() {
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			logger.Warn("stderr", "line", scanner.Text())
-		}
+		defer wg.Done()
+		scanLines(&followReader{f: stderr, stop: stop}, func(line string) {
+			defer p.stderrRead.Add(int64(len(line)) + 1)
+			logger.Debug("stderr", "line", line)
+			sinks.Logs.Add("stderr", line)
+			if sinks.Stderr != nil {
+				sinks.Stderr.Add(line)
+			}
+		})
 	}()
 
-	err = cmd.Wait()
-	exitCode := 0
+	wg.Wait()
+	if detached.Load() {
+		logger.Info("agent shutting down, leaving subprocess running", "pid", p.PID)
+		return 0, errDetached
+	}
+
+	exitCode, ok := readIntFile(filepath.Join(p.ControlDir, exitCodeFile))
+	if !ok {
+		logger.Warn("subprocess exited without an exit code", "pid", p.PID)
+		return -1, fmt.Errorf("supervisor exited without recording an exit code")
+	}
+	logger.Info("subprocess exited", "exit_code", exitCode)
+	if exitCode != 0 {
+		return exitCode, fmt.Errorf("exit status %d", exitCode)
+	}
+	return 0, nil
+}
+
+func openFrom(path string, offset int64) (*os.File, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			exitCode = exitErr.ExitCode()
-		} else {
-			exitCode = 1
+		return nil, fmt.Errorf("opening console output: %w", err)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("opening console output: %w", err)
+	}
+	return f, nil
+}
+
+// followReader reads a file another process is still appending to. At the
+// end of the file it waits for more output until stop is closed, then reads
+// what is left.
+type followReader struct {
+	f    *os.File
+	stop <-chan struct{}
+}
+
+func (r *followReader) Read(b []byte) (int, error) {
+	for {
+		n, err := r.f.Read(b)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-r.stop:
+			return r.f.Read(b)
+		case <-time.After(followPollInterval):
 		}
 	}
+}
 
-	logger.Info("subprocess exited", "exit_code", exitCode)
-	return exitCode, err
+// maxLineSize caps a single console line; progress bars that never emit a
+// newline can otherwise grow without bound.
+const maxLineSize = 1024 * 1024
+
+// scanLines calls fn for every line read from r. Input after an oversized
+// line is drained so the writer never blocks.
+func scanLines(r io.Reader, fn func(string)) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	io.Copy(io.Discard, r)
 }
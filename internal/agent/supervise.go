@@ -0,0 +1,107 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SuperviseArg, as the first argument of the agent binary, makes it run as
+// the supervisor of a training process instead of as the agent:
+//
+//	mlflare-agent __supervise <exit-code-file> <command> [args...]
+//
+// The agent starts every training process through a supervisor, which is what
+// lets a restarted agent reattach to a run: the supervisor outlives the agent
+// that started it, forwards SIGTERM and SIGINT to the command, and writes the
+// command's exit code to a file once it exits.
+//
+// The command leads a process group of its own, which the processes it
+// starts, such as data loader workers and launcher ranks, belong to unless
+// they leave it. Signals go to the whole group, and whatever is left of it
+// when the command exits is killed, so nothing keeps holding GPU memory.
+const SuperviseArg = "__supervise"
+
+// Supervise runs the supervisor and returns its exit code, which is the
+// command's, or 128 plus the signal number if the command was killed by one.
+func Supervise(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s <exit-code-file> <command> [args...]\n", SuperviseArg)
+		return 2
+	}
+	exitFile, argv := args[0], args[1:]
+
+	// Pdeathsig fires when the thread that started the child exits, so keep
+	// this goroutine on one thread for the supervisor's lifetime.
+	runtime.LockOSThread()
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL, Setpgid: true}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		// Shell conventions: 126 for not executable, 127 for not found
+		code := 127
+		if errors.Is(err, os.ErrPermission) {
+			code = 126
+		}
+		writeIntFile(exitFile, code)
+		return code
+	}
+
+	// The group's ID is the command's PID. Recording it lets the agent kill
+	// the group if it has to kill the supervisor.
+	pgid := cmd.Process.Pid
+	writeIntFile(filepath.Join(filepath.Dir(exitFile), pgidFile), pgid)
+
+	go func() {
+		for sig := range sigCh {
+			syscall.Kill(-pgid, sig.(syscall.Signal))
+		}
+	}()
+
+	cmd.Wait()
+	// Kill whatever the command left behind in its group
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	code := cmd.ProcessState.ExitCode()
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		code = 128 + int(ws.Signal())
+	}
+	writeIntFile(exitFile, code)
+	return code
+}
+
+// writeIntFile writes n atomically so a reader never sees a partial file.
+func writeIntFile(path string, n int) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(n)), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "writing %s: %v\n", filepath.Base(path), err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		fmt.Fprintf(os.Stderr, "writing %s: %v\n", filepath.Base(path), err)
+	}
+}
+
+// readIntFile returns the number in a file written by the supervisor or a
+// SLURM job script, such as the exit code, if any.
+func readIntFile(path string) (int, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n, err == nil
+}
@@ -0,0 +1,353 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foundling-ai/mlflare/internal/bundle"
+)
+
+// venvIndexFile, in the pool dir, records the venvs in the pool.
+const venvIndexFile = "index.json"
+
+// VenvPool keeps an environment per dependency set and Python version under
+// <WorkDir>/cache/venvs, so projects with different requirements don't
+// reinstall over each other. Environments are built by the envResolver for
+// the bundle's dependency manifest. Which venvs exist, whether their deps are
+// installed and when each was last used is recorded in index.json there, so
+// it survives restarts. When the pool grows past its disk budget the least
+// recently used venvs not in use by a run are deleted.
+type VenvPool struct {
+	dir      string
+	tools    EnvTools
+	maxBytes int64
+	logger   *slog.Logger
+
+	mu            sync.Mutex
+	pythonVersion string
+	entries       map[string]*venvEntry
+}
+
+type venvEntry struct {
+	Kind          string    `json:"kind"`
+	DepsHash      string    `json:"deps_hash"`
+	PythonVersion string    `json:"python_version"`
+	Installed     bool      `json:"installed"`
+	Size          int64     `json:"size"`
+	LastUsed      time.Time `json:"last_used"`
+
+	// users counts the runs using the venv, which keep it from being evicted
+	users int
+
+	// setup is held while the venv is created or its deps installed
+	setup sync.Mutex
+}
+
+// Venv is a venv in the pool, held by a run until released.
+type Venv struct {
+	Key    string
+	Python string
+	dir    string
+	kind   string
+}
+
+// Env returns the variables that activate the venv for a run, so commands
+// like torchrun or a shell script find its tools first on the PATH.
+func (v *Venv) Env() []string {
+	return []string{
+		"VIRTUAL_ENV=" + v.dir,
+		"PATH=" + filepath.Join(v.dir, "bin") + string(os.PathListSeparator) + os.Getenv("PATH"),
+	}
+}
+
+// OpenVenvPool opens the pool in dir, loading its index. Venvs missing from
+// the index, such as ones a crash left half built, are deleted.
+func OpenVenvPool(dir string, tools EnvTools, maxBytes int64, logger *slog.Logger) (*VenvPool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating venv dir: %w", err)
+	}
+	p := &VenvPool{
+		dir:      dir,
+		tools:    tools,
+		maxBytes: maxBytes,
+		logger:   logger,
+		entries:  make(map[string]*venvEntry),
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, venvIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading venv index: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &p.entries); err != nil {
+			logger.Warn("venv index unreadable, starting empty", "error", err)
+			p.entries = make(map[string]*venvEntry)
+		}
+	}
+
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading venv dir: %w", err)
+	}
+	for _, d := range dirs {
+		if d.IsDir() && p.entries[d.Name()] == nil {
+			os.RemoveAll(filepath.Join(dir, d.Name()))
+		}
+	}
+	for key := range p.entries {
+		if _, err := os.Stat(filepath.Join(dir, key)); err != nil {
+			delete(p.entries, key)
+		}
+	}
+	return p, nil
+}
+
+// Acquire returns the environment for the dependencies in workDir on the
+// given Python version, or the bundle's .python-version, or else the
+// configured python. It is created if needed and held until Release. Deps are
+// installed separately, with Install.
+func (p *VenvPool) Acquire(ctx context.Context, workDir, python string) (*Venv, error) {
+	if python == "" {
+		var err error
+		if python, err = bundle.PythonVersion(workDir); err != nil {
+			return nil, err
+		}
+	} else if err := bundle.ValidatePythonVersion(python); err != nil {
+		return nil, err
+	}
+	pyKey := python
+	if pyKey == "" {
+		var err error
+		if pyKey, err = p.defaultVersion(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	deps := bundle.DetectDeps(workDir)
+	depsHash, err := deps.Hash(workDir)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := newEnvResolver(deps.Kind, p.tools, p.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	key := deps.Kind + "-py" + pyKey
+	if depsHash != "" {
+		key += "-" + depsHash
+	}
+	v := &Venv{Key: key, dir: filepath.Join(p.dir, key), kind: deps.Kind}
+	v.Python = venvPython(v.dir)
+
+	e := p.hold(key, deps.Kind, depsHash, pyKey)
+	e.setup.Lock()
+	defer e.setup.Unlock()
+
+	if _, err := os.Stat(v.Python); err == nil {
+		p.logger.Debug("reusing venv", "path", v.dir)
+		return v, nil
+	}
+
+	os.RemoveAll(v.dir)
+	if err := resolver.create(ctx, v.dir, python); err != nil {
+		os.RemoveAll(v.dir)
+		p.drop(key)
+		return nil, fmt.Errorf("creating %s environment: %w", deps.Kind, err)
+	}
+	size := dirSize(v.dir)
+	p.update(key, func(e *venvEntry) {
+		e.Installed = false
+		e.Size = size
+	})
+	return v, nil
+}
+
+// Hold marks a venv as used by a run that a restarted agent reattached to.
+// It does nothing if the venv is no longer in the pool.
+func (p *VenvPool) Hold(key string) *Venv {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		return nil
+	}
+	e.users++
+	dir := filepath.Join(p.dir, key)
+	return &Venv{Key: key, Python: venvPython(dir), dir: dir, kind: e.Kind}
+}
+
+// Release gives up a run's hold on a venv and evicts venvs if the pool is over
+// its budget.
+func (p *VenvPool) Release(v *Venv) {
+	if v == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[v.Key]; ok {
+		e.users--
+		e.LastUsed = time.Now()
+	}
+	p.evict()
+	p.save()
+}
+
+// Install installs the dependencies in workDir into the environment, writing
+// what the install tools print to out. Locked dependencies, such as fully
+// pinned requirements or a lockfile, are installed once per environment;
+// others are upgraded on every run.
+func (p *VenvPool) Install(ctx context.Context, v *Venv, workDir string, out io.Writer) error {
+	resolver, err := newEnvResolver(v.kind, p.tools, p.logger)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	e := p.entries[v.Key]
+	p.mu.Unlock()
+	e.setup.Lock()
+	defer e.setup.Unlock()
+
+	locked := resolver.locked(workDir)
+	p.mu.Lock()
+	installed := e.Installed
+	p.mu.Unlock()
+	if locked && installed {
+		p.logger.Info("deps already installed, skipping install", "venv", v.Key)
+		return nil
+	}
+
+	err = resolver.install(ctx, v.dir, workDir, out)
+	size := dirSize(v.dir)
+	p.update(v.Key, func(e *venvEntry) {
+		e.Installed = err == nil && locked
+		e.Size = size
+	})
+	return err
+}
+
+// defaultVersion returns the version of the configured python, asking the
+// interpreter once.
+func (p *VenvPool) defaultVersion(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pythonVersion != "" {
+		return p.pythonVersion, nil
+	}
+	out, err := exec.CommandContext(ctx, p.tools.PythonBin, "-c",
+		"import sys; print('%d.%d.%d' % sys.version_info[:3])").Output()
+	if err != nil {
+		return "", fmt.Errorf("getting version of %s: %w", p.tools.PythonBin, err)
+	}
+	p.pythonVersion = strings.TrimSpace(string(out))
+	return p.pythonVersion, nil
+}
+
+// hold adds a user to the venv's entry, creating the entry if needed.
+func (p *VenvPool) hold(key, kind, depsHash, pyVersion string) *venvEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[key]
+	if !ok {
+		e = &venvEntry{Kind: kind, DepsHash: depsHash, PythonVersion: pyVersion}
+		p.entries[key] = e
+	}
+	e.users++
+	e.LastUsed = time.Now()
+	p.save()
+	return e
+}
+
+// drop gives up a hold on an environment that couldn't be created, removing
+// its entry unless another run is waiting on it.
+func (p *VenvPool) drop(key string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[key]; ok {
+		if e.users--; e.users <= 0 {
+			delete(p.entries, key)
+		}
+		p.save()
+	}
+}
+
+func (p *VenvPool) update(key string, fn func(*venvEntry)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[key]; ok {
+		fn(e)
+		p.save()
+	}
+}
+
+// evict deletes the least recently used venvs not in use while the pool is
+// over budget. Callers hold mu.
+func (p *VenvPool) evict() {
+	if p.maxBytes <= 0 {
+		return
+	}
+	var total int64
+	var idle []string
+	for key, e := range p.entries {
+		total += e.Size
+		if e.users <= 0 {
+			idle = append(idle, key)
+		}
+	}
+	slices.SortFunc(idle, func(a, b string) int {
+		return p.entries[a].LastUsed.Compare(p.entries[b].LastUsed)
+	})
+	for _, key := range idle {
+		if total <= p.maxBytes {
+			break
+		}
+		e := p.entries[key]
+		p.logger.Info("evicting venv", "venv", key, "size_mb", e.Size>>20, "last_used", e.LastUsed)
+		if err := os.RemoveAll(filepath.Join(p.dir, key)); err != nil {
+			p.logger.Warn("removing venv failed", "venv", key, "error", err)
+			continue
+		}
+		delete(p.entries, key)
+		total -= e.Size
+	}
+}
+
+// save writes the index atomically. Callers hold mu.
+func (p *VenvPool) save() {
+	data, err := json.MarshalIndent(p.entries, "", "  ")
+	if err == nil {
+		tmp := filepath.Join(p.dir, venvIndexFile+".tmp")
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, filepath.Join(p.dir, venvIndexFile))
+		}
+	}
+	if err != nil {
+		p.logger.Warn("writing venv index failed", "error", err)
+	}
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,198 @@
+package agent
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultProject holds runs submitted without a project.
+const defaultProject = "default"
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// RetentionPolicy decides which finished runs' files the workspace keeps.
+// Zero values disable a limit.
+type RetentionPolicy struct {
+	// KeepRuns is how many finished runs to keep per project.
+	KeepRuns int
+
+	// MaxAge is how long to keep a run's files after it finished.
+	MaxAge time.Duration
+
+	// MaxBytes bounds the size of the whole workspace. Past it the oldest
+	// finished runs are deleted first.
+	MaxBytes int64
+}
+
+// Workspace holds the files of each run in <dir>/<project>/<run_id>. A run's
+// files are kept after it finishes, so they can be inspected, until the
+// retention policy removes them. Runs that still have state in the agent's
+// state dir are active and never removed.
+type Workspace struct {
+	dir      string
+	stateDir string
+	policy   RetentionPolicy
+	logger   *slog.Logger
+}
+
+// WorkspaceRun is a run's directory in the workspace.
+type WorkspaceRun struct {
+	Project string
+	RunID   string
+	Path    string
+	Size    int64
+
+	// ModTime is when the run last changed; for a finished run, when it
+	// finished.
+	ModTime time.Time
+	Active  bool
+}
+
+func NewWorkspace(dir, stateDir string, policy RetentionPolicy, logger *slog.Logger) *Workspace {
+	return &Workspace{
+		dir:      dir,
+		stateDir: stateDir,
+		policy:   policy,
+		logger:   logger,
+	}
+}
+
+// RunDir returns the directory for a run's files.
+func (w *Workspace) RunDir(project, runID string) string {
+	return filepath.Join(w.dir, projectDirName(project), runID)
+}
+
+// Finished marks a run's files as finished now, which is when their
+// retention age starts.
+func (w *Workspace) Finished(dir string) {
+	now := time.Now()
+	if err := os.Chtimes(dir, now, now); err != nil && !os.IsNotExist(err) {
+		w.logger.Warn("marking run dir finished failed", "path", dir, "error", err)
+	}
+}
+
+// List returns every run in the workspace, newest first.
+func (w *Workspace) List() ([]WorkspaceRun, error) {
+	projects, err := os.ReadDir(w.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading workspace: %w", err)
+	}
+
+	var runs []WorkspaceRun
+	for _, p := range projects {
+		if !p.IsDir() {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(w.dir, p.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("reading workspace: %w", err)
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil || !e.IsDir() {
+				continue
+			}
+			path := filepath.Join(w.dir, p.Name(), e.Name())
+			_, err = os.Stat(filepath.Join(w.stateDir, e.Name()))
+			runs = append(runs, WorkspaceRun{
+				Project: p.Name(),
+				RunID:   e.Name(),
+				Path:    path,
+				Size:    dirSize(path),
+				ModTime: info.ModTime(),
+				Active:  err == nil,
+			})
+		}
+	}
+	slices.SortFunc(runs, func(a, b WorkspaceRun) int { return b.ModTime.Compare(a.ModTime) })
+	return runs, nil
+}
+
+// GC deletes the finished runs the retention policy doesn't keep and returns
+// them. With dryRun set it only returns them.
+func (w *Workspace) GC(dryRun bool) ([]WorkspaceRun, error) {
+	runs, err := w.List()
+	if err != nil {
+		return nil, err
+	}
+
+	remove := make(map[string]bool)
+	perProject := make(map[string]int)
+	var total int64
+	for _, r := range runs {
+		total += r.Size
+		if r.Active {
+			continue
+		}
+		perProject[r.Project]++
+		switch {
+		case w.policy.KeepRuns > 0 && perProject[r.Project] > w.policy.KeepRuns:
+			remove[r.Path] = true
+		case w.policy.MaxAge > 0 && time.Since(r.ModTime) > w.policy.MaxAge:
+			remove[r.Path] = true
+		}
+	}
+	for _, r := range runs {
+		if remove[r.Path] {
+			total -= r.Size
+		}
+	}
+
+	// Over quota, drop the oldest remaining finished runs
+	for i := len(runs) - 1; i >= 0 && w.policy.MaxBytes > 0 && total > w.policy.MaxBytes; i-- {
+		r := runs[i]
+		if !r.Active && !remove[r.Path] {
+			remove[r.Path] = true
+			total -= r.Size
+		}
+	}
+
+	var removed []WorkspaceRun
+	for _, r := range runs {
+		if !remove[r.Path] {
+			continue
+		}
+		if !dryRun {
+			w.logger.Info("removing run from workspace", "project", r.Project, "run_id", r.RunID, "size_mb", r.Size>>20)
+			if err := os.RemoveAll(r.Path); err != nil {
+				w.logger.Warn("removing run dir failed", "path", r.Path, "error", err)
+				continue
+			}
+		}
+		removed = append(removed, r)
+	}
+	if !dryRun {
+		w.removeEmptyProjects()
+	}
+	slices.SortFunc(removed, func(a, b WorkspaceRun) int {
+		return cmp.Or(strings.Compare(a.Project, b.Project), a.ModTime.Compare(b.ModTime))
+	})
+	return removed, nil
+}
+
+func (w *Workspace) removeEmptyProjects() {
+	projects, _ := os.ReadDir(w.dir)
+	for _, p := range projects {
+		// Fails unless the dir is empty
+		os.Remove(filepath.Join(w.dir, p.Name()))
+	}
+}
+
+// projectDirName makes a project name safe to use as a directory name.
+func projectDirName(project string) string {
+	name := strings.TrimLeft(unsafeNameChars.ReplaceAllString(project, "_"), ".")
+	if name == "" {
+		return defaultProject
+	}
+	return name
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -33,6 +35,21 @@ func NewClient(baseURL, token string) *Client {
 	}
 }
 
+// StatusError is returned for responses with a 4xx or 5xx status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("API error %d: %s", e.StatusCode, e.Body)
+}
+
+// Retryable reports whether the request may succeed if sent again.
+func (e *StatusError) Retryable() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusRequestTimeout || e.StatusCode == http.StatusTooManyRequests
+}
+
 func (c *Client) do(ctx context.Context, method, path string, body any, result any) error {
 	var bodyReader io.Reader
 	if body != nil {
@@ -63,7 +80,7 @@ func (c *Client) do(ctx context.Context, method, path string, body any, result a
 	}
 
 	if resp.StatusCode >= 400 {
-		return fmt.Errorf("API error %d: %s", resp.StatusCode, string(respBody))
+		return &StatusError{StatusCode: resp.StatusCode, Body: string(respBody)}
 	}
 
 	if result != nil && len(respBody) > 0 {
@@ -80,6 +97,12 @@ func (c *Client) do(ctx context.Context, method, path string, body any, result a
 type CheckinRequest struct {
 	AgentVersion string `json:"agent_version"`
 	Hostname     string `json:"hostname"`
+
+	// GPUs is how many GPUs the machine has, and FreeGPUs how many of them
+	// are not held by a run. An agent without GPUs sends neither and is
+	// given one run at a time.
+	GPUs     int `json:"gpus,omitempty"`
+	FreeGPUs int `json:"free_gpus,omitempty"`
 }
 
 type CheckinResponse struct {
@@ -93,6 +116,59 @@ type Assignment struct {
 	BundleURL    string         `json:"bundle_url"`
 	DepsHash     string         `json:"deps_hash,omitempty"`
 	Config       map[string]any `json:"config,omitempty"`
+	ConfigArgs   bool           `json:"config_args,omitempty"`
+	GPUs         int            `json:"gpus,omitempty"`
+	Python       string         `json:"python,omitempty"`
+
+	// Project names the dir the run's files are kept under on the agent.
+	Project string `json:"project,omitempty"`
+
+	Datasets []Dataset `json:"datasets,omitempty"`
+
+	// Image, if set, is the container image the run executes in.
+	Image string `json:"image,omitempty"`
+
+	// Command, if set, is the argv the run executes instead of the
+	// entrypoint script.
+	Command []string `json:"command,omitempty"`
+
+	// Launcher, if set, starts one process per GPU: torchrun, accelerate
+	// or deepspeed.
+	Launcher string `json:"launcher,omitempty"`
+
+	// Limits the run is stopped at, overriding the agent's defaults. Zero
+	// leaves the default. MaxDuration is in seconds.
+	MaxDuration    int `json:"max_duration,omitempty"`
+	MaxRSSMB       int `json:"max_rss_mb,omitempty"`
+	MaxDiskWriteMB int `json:"max_disk_write_mb,omitempty"`
+
+	// StopRules end the run early when its metrics match one.
+	StopRules []StopRule `json:"stop_rules,omitempty"`
+}
+
+// StopRule ends a run early, as early_stopped, once a metric it reports
+// matches. The rule only applies to values reported from AfterStep on.
+type StopRule struct {
+	Metric string `json:"metric"`
+
+	// Kind is "non_finite" for a NaN or infinite value, "plateau" for no
+	// improvement on the best value in Patience reports, or "above" or
+	// "below" for a value past Threshold.
+	Kind      string  `json:"kind"`
+	Patience  int     `json:"patience,omitempty"`
+	Threshold float64 `json:"threshold,omitempty"`
+
+	// Maximize makes higher values the better ones for a plateau.
+	Maximize  bool `json:"maximize,omitempty"`
+	AfterStep int  `json:"after_step,omitempty"`
+}
+
+// Dataset is input a run reads from R2: the object at Key, or every object
+// under it if Key is a prefix. The run finds it at datasets/<Name> in its
+// work dir.
+type Dataset struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
 }
 
 func (c *Client) Checkin(ctx context.Context, req CheckinRequest) (*CheckinResponse, error) {
@@ -101,8 +177,20 @@ func (c *Client) Checkin(ctx context.Context, req CheckinRequest) (*CheckinRespo
 	return &resp, err
 }
 
-func (c *Client) Heartbeat(ctx context.Context) error {
-	return c.do(ctx, "POST", "/agent/heartbeat", nil, nil)
+type HeartbeatRequest struct {
+	RunID string `json:"run_id,omitempty"`
+}
+
+type HeartbeatResponse struct {
+	Cancel bool `json:"cancel"`
+	// Status is the run's status on the Worker, e.g. "running".
+	Status string `json:"status,omitempty"`
+}
+
+func (c *Client) Heartbeat(ctx context.Context, req HeartbeatRequest) (*HeartbeatResponse, error) {
+	var resp HeartbeatResponse
+	err := c.do(ctx, "POST", "/agent/heartbeat", req, &resp)
+	return &resp, err
 }
 
 type MetricBatch struct {
@@ -110,18 +198,88 @@ type MetricBatch struct {
 	Metrics []MetricPayload `json:"metrics"`
 }
 
+// MetricPayload is one logged point. Values only holds finite numbers since
+// JSON has no NaN or Infinity; those go in NonFinite as "nan", "inf" or
+// "-inf".
 type MetricPayload struct {
-	Step   int                `json:"step"`
-	Values map[string]float64 `json:"values"`
+	Step         int                  `json:"step"`
+	Time         float64              `json:"time"`          // Unix seconds
+	RelativeTime float64              `json:"relative_time"` // seconds since run start
+	Values       map[string]float64   `json:"values"`
+	NonFinite    map[string]string    `json:"non_finite,omitempty"`
+	Histograms   map[string]Histogram `json:"histograms,omitempty"`
+	Texts        map[string]string    `json:"texts,omitempty"`
+}
+
+// Histogram is a distribution with len(Edges) == len(Counts)+1.
+type Histogram struct {
+	Edges  []float64 `json:"edges"`
+	Counts []float64 `json:"counts"`
 }
 
 func (c *Client) SendMetrics(ctx context.Context, batch MetricBatch) error {
 	return c.do(ctx, "POST", "/agent/metrics", batch, nil)
 }
 
+// RunValues carries params or summary values reported by a run.
+type RunValues struct {
+	RunID  string         `json:"run_id"`
+	Values map[string]any `json:"values"`
+}
+
+func (c *Client) SendParams(ctx context.Context, req RunValues) error {
+	return c.do(ctx, "POST", "/agent/params", req, nil)
+}
+
+func (c *Client) SendSummary(ctx context.Context, req RunValues) error {
+	return c.do(ctx, "POST", "/agent/summary", req, nil)
+}
+
+type RunTags struct {
+	RunID string            `json:"run_id"`
+	Tags  map[string]string `json:"tags"`
+}
+
+func (c *Client) SendTags(ctx context.Context, req RunTags) error {
+	return c.do(ctx, "POST", "/agent/tags", req, nil)
+}
+
+// RunStatus is a free-form progress message from a run, such as "evaluating".
+type RunStatus struct {
+	RunID   string `json:"run_id"`
+	Message string `json:"message"`
+}
+
+func (c *Client) SendStatus(ctx context.Context, req RunStatus) error {
+	return c.do(ctx, "POST", "/agent/status", req, nil)
+}
+
+type LogBatch struct {
+	RunID string    `json:"run_id"`
+	Lines []LogLine `json:"lines"`
+}
+
+type LogLine struct {
+	Seq    int    `json:"seq"`
+	Stream string `json:"stream"`
+	Line   string `json:"line"`
+}
+
+func (c *Client) SendLogs(ctx context.Context, batch LogBatch) error {
+	return c.do(ctx, "POST", "/agent/logs", batch, nil)
+}
+
+// Artifact describes a file uploaded from a run's workspace.
+type Artifact struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
 type CompletedRequest struct {
-	RunID    string `json:"run_id"`
-	ExitCode int    `json:"exit_code"`
+	RunID     string     `json:"run_id"`
+	ExitCode  int        `json:"exit_code"`
+	Artifacts []Artifact `json:"artifacts,omitempty"`
 }
 
 func (c *Client) ReportCompleted(ctx context.Context, req CompletedRequest) error {
@@ -129,15 +287,256 @@ func (c *Client) ReportCompleted(ctx context.Context, req CompletedRequest) erro
 }
 
 type FailedRequest struct {
-	RunID    string `json:"run_id"`
-	Error    string `json:"error"`
-	ExitCode int    `json:"exit_code"`
+	RunID string `json:"run_id"`
+	Error string `json:"error"`
+	// Reason is a machine-readable failure category, such as
+	// "agent_restarted".
+	Reason    string     `json:"reason,omitempty"`
+	ExitCode  int        `json:"exit_code"`
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+
+	// Diagnostics, for runs whose process or dependency install failed, say
+	// how.
+	Diagnostics *FailureDiagnostics `json:"diagnostics,omitempty"`
+}
+
+// FailureDiagnostics describe how a run's process failed.
+type FailureDiagnostics struct {
+	// ExitClass is the kind of failure: oom_killed, cuda_oom, nccl_error,
+	// signal, import_error, user_exception or exit_code, or deps_install if
+	// the run's dependencies failed to install and the process never ran.
+	ExitClass string `json:"exit_class"`
+
+	// Signal names the signal that killed the process, if one did.
+	Signal string `json:"signal,omitempty"`
+
+	// Exception is the last Python traceback the process printed.
+	Exception *PythonException `json:"exception,omitempty"`
+
+	// StderrTail holds the last lines the process wrote to stderr, or for
+	// deps_install the last lines the install tools printed.
+	StderrTail []string `json:"stderr_tail,omitempty"`
+}
+
+type PythonException struct {
+	Type    string           `json:"type"`
+	Message string           `json:"message"`
+	Frames  []TracebackFrame `json:"frames,omitempty"`
+}
+
+// TracebackFrame is one frame of a traceback, outermost first.
+type TracebackFrame struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Function string `json:"function"`
+	Code     string `json:"code,omitempty"`
 }
 
 func (c *Client) ReportFailed(ctx context.Context, req FailedRequest) error {
 	return c.do(ctx, "POST", "/agent/failed", req, nil)
 }
 
+// EarlyStoppedRequest reports a run stopped by one of its stop rules. Rule
+// describes the rule that fired.
+type EarlyStoppedRequest struct {
+	RunID     string     `json:"run_id"`
+	Rule      string     `json:"rule"`
+	ExitCode  int        `json:"exit_code"`
+	Artifacts []Artifact `json:"artifacts,omitempty"`
+}
+
+func (c *Client) ReportEarlyStopped(ctx context.Context, req EarlyStoppedRequest) error {
+	return c.do(ctx, "POST", "/agent/early-stopped", req, nil)
+}
+
+// RunEnvironment is what a run ran on, recorded by the agent before it starts
+// the run's process. Python and Packages are left out for runs in a
+// container, whose Image is recorded instead.
+type RunEnvironment struct {
+	Hostname     string `json:"hostname"`
+	AgentVersion string `json:"agent_version"`
+	Kernel       string `json:"kernel,omitempty"`
+	Executor     string `json:"executor"`
+	Image        string `json:"image,omitempty"`
+
+	Python string `json:"python,omitempty"`
+	// Packages are the venv's packages as listed by pip freeze.
+	Packages []string `json:"packages,omitempty"`
+
+	DriverVersion string `json:"driver_version,omitempty"`
+	CUDAVersion   string `json:"cuda_version,omitempty"`
+	// GPUs are the models of the GPUs the run was given.
+	GPUs []string `json:"gpus,omitempty"`
+}
+
+type EnvironmentRequest struct {
+	RunID       string         `json:"run_id"`
+	Environment RunEnvironment `json:"environment"`
+}
+
+func (c *Client) ReportEnvironment(ctx context.Context, req EnvironmentRequest) error {
+	return c.do(ctx, "POST", "/agent/environment", req, nil)
+}
+
+// PhaseRequest reports how long a run spent in a phase of its setup, such as
+// installing_deps. Error is set if the phase failed.
+type PhaseRequest struct {
+	RunID   string  `json:"run_id"`
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+func (c *Client) ReportPhase(ctx context.Context, req PhaseRequest) error {
+	return c.do(ctx, "POST", "/agent/phase", req, nil)
+}
+
+type CancelledRequest struct {
+	RunID    string `json:"run_id"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func (c *Client) ReportCancelled(ctx context.Context, req CancelledRequest) error {
+	return c.do(ctx, "POST", "/agent/cancelled", req, nil)
+}
+
+// DatasetObject is an R2 object of a dataset.
+type DatasetObject struct {
+	Key string `json:"key"`
+
+	// Path is the object's path within the dataset, relative to its prefix.
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+
+	// SHA256 is the object's hex SHA-256, if it was uploaded with one.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// ListDataset returns the objects of the dataset at key.
+func (c *Client) ListDataset(ctx context.Context, key string) ([]DatasetObject, error) {
+	var resp struct {
+		Objects []DatasetObject `json:"objects"`
+	}
+	err := c.do(ctx, "GET", "/agent/datasets?key="+url.QueryEscape(key), nil, &resp)
+	return resp.Objects, err
+}
+
+// DownloadDatasetObject streams a dataset object from R2 through the Worker.
+func (c *Client) DownloadDatasetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	return c.DownloadBundle(ctx, c.baseURL+"/agent/datasets/object/"+escapePath(key))
+}
+
+// artifactPartSize is the multipart chunk size for artifact uploads. The
+// retrying HTTP client buffers each request body, so this also bounds the
+// memory used per upload.
+const artifactPartSize = 32 << 20
+
+// artifactAbortTimeout bounds aborting a failed multipart upload.
+const artifactAbortTimeout = 30 * time.Second
+
+type multipartPart struct {
+	PartNumber int    `json:"part_number"`
+	ETag       string `json:"etag"`
+}
+
+// UploadArtifact streams a file to R2 through the Worker under the run's
+// artifact prefix. Files larger than one part use a multipart upload.
+func (c *Client) UploadArtifact(ctx context.Context, runID, relPath, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("opening artifact: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("stat artifact: %w", err)
+	}
+
+	path := "/agent/artifacts/" + url.PathEscape(runID) + "/" + escapePath(relPath)
+
+	if info.Size() <= artifactPartSize {
+		_, err := c.putRaw(ctx, path, io.NewSectionReader(f, 0, info.Size()), info.Size())
+		return err
+	}
+
+	var created struct {
+		UploadID string `json:"upload_id"`
+	}
+	if err := c.do(ctx, "POST", path+"?uploads", nil, &created); err != nil {
+		return fmt.Errorf("creating multipart upload: %w", err)
+	}
+
+	if err := c.uploadParts(ctx, path, created.UploadID, f, info.Size()); err != nil {
+		// Abort so R2 drops the parts already uploaded, even if ctx is done
+		actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), artifactAbortTimeout)
+		defer cancel()
+		_ = c.do(actx, "DELETE", path+"?upload_id="+url.QueryEscape(created.UploadID), nil, nil)
+		return err
+	}
+	return nil
+}
+
+// uploadParts uploads the parts of a multipart upload and completes it.
+func (c *Client) uploadParts(ctx context.Context, path, uploadID string, f *os.File, size int64) error {
+	var parts []multipartPart
+	for offset, n := int64(0), 1; offset < size; offset, n = offset+artifactPartSize, n+1 {
+		partSize := min(artifactPartSize, size-offset)
+		partPath := fmt.Sprintf("%s?upload_id=%s&part=%d", path, url.QueryEscape(uploadID), n)
+		body, err := c.putRaw(ctx, partPath, io.NewSectionReader(f, offset, partSize), partSize)
+		if err != nil {
+			return fmt.Errorf("uploading part %d: %w", n, err)
+		}
+		var part multipartPart
+		if err := json.Unmarshal(body, &part); err != nil {
+			return fmt.Errorf("unmarshaling part response: %w", err)
+		}
+		parts = append(parts, part)
+	}
+
+	req := struct {
+		Parts []multipartPart `json:"parts"`
+	}{Parts: parts}
+	if err := c.do(ctx, "POST", path+"?upload_id="+url.QueryEscape(uploadID), req, nil); err != nil {
+		return fmt.Errorf("completing multipart upload: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) putRaw(ctx context.Context, path string, body io.Reader, size int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("upload error %d: %s", resp.StatusCode, string(respBody))
+	}
+	return respBody, nil
+}
+
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
 // CLI/API endpoints
 
 type ExperimentSubmission struct {
@@ -149,6 +548,19 @@ type ExperimentSubmission struct {
 	GitDirty   bool           `json:"git_dirty,omitempty"`
 	DepsHash   string         `json:"deps_hash,omitempty"`
 	BundleKey  string         `json:"bundle_key"`
+	ConfigArgs bool           `json:"config_args,omitempty"`
+	GPUs       int            `json:"gpus,omitempty"`
+	Python     string         `json:"python,omitempty"`
+	Datasets   []Dataset      `json:"datasets,omitempty"`
+	Image      string         `json:"image,omitempty"`
+	Command    []string       `json:"command,omitempty"`
+	Launcher   string         `json:"launcher,omitempty"`
+
+	MaxDuration    int `json:"max_duration,omitempty"` // seconds
+	MaxRSSMB       int `json:"max_rss_mb,omitempty"`
+	MaxDiskWriteMB int `json:"max_disk_write_mb,omitempty"`
+
+	StopRules []StopRule `json:"stop_rules,omitempty"`
 }
 
 type SubmitResponse struct {
@@ -167,17 +579,25 @@ type StatusResponse struct {
 	Instance struct {
 		InstanceState string `json:"instance_state"`
 		CurrentRunID  string `json:"current_run_id"`
+		ActiveRuns    []struct {
+			RunID      string `json:"run_id"`
+			GPUs       int    `json:"gpus"`
+			AssignedAt string `json:"assigned_at"`
+		} `json:"active_runs"`
 		QueueDepth    int    `json:"queue_depth"`
 		AgentLastSeen string `json:"agent_last_seen"`
 	} `json:"instance"`
 	RecentRuns []struct {
-		ID          string `json:"id"`
-		Status      string `json:"status"`
-		Project     string `json:"project"`
-		Entrypoint  string `json:"entrypoint"`
-		CreatedAt   string `json:"created_at"`
-		StartedAt   string `json:"started_at"`
-		CompletedAt string `json:"completed_at"`
+		ID            string `json:"id"`
+		Status        string `json:"status"`
+		Project       string `json:"project"`
+		Entrypoint    string `json:"entrypoint"`
+		CreatedAt     string `json:"created_at"`
+		StartedAt     string `json:"started_at"`
+		CompletedAt   string `json:"completed_at"`
+		FailureReason string `json:"failure_reason"`
+		ErrorMessage  string `json:"error_message"`
+		StopRule      string `json:"stop_rule"`
 	} `json:"recent_runs"`
 }
 
@@ -187,6 +607,46 @@ func (c *Client) GetStatus(ctx context.Context) (*StatusResponse, error) {
 	return &resp, err
 }
 
+type CancelResponse struct {
+	RunID  string `json:"run_id"`
+	Status string `json:"status"`
+}
+
+func (c *Client) CancelRun(ctx context.Context, runID string) (*CancelResponse, error) {
+	var resp CancelResponse
+	err := c.do(ctx, "POST", "/sdk/runs/"+runID+"/cancel", nil, &resp)
+	return &resp, err
+}
+
+type DrainResponse struct {
+	Cancelled []string `json:"cancelled"`
+}
+
+func (c *Client) DrainQueue(ctx context.Context) (*DrainResponse, error) {
+	var resp DrainResponse
+	err := c.do(ctx, "POST", "/sdk/queue/drain", nil, &resp)
+	return &resp, err
+}
+
+type LogsResponse struct {
+	Lines  []LogLine `json:"lines"`
+	Status string    `json:"status"`
+}
+
+// GetLogs returns console lines of a run with a sequence number greater than after.
+func (c *Client) GetLogs(ctx context.Context, runID string, after int) (*LogsResponse, error) {
+	var resp LogsResponse
+	err := c.do(ctx, "GET", fmt.Sprintf("/sdk/runs/%s/logs?after=%d", runID, after), nil, &resp)
+	return &resp, err
+}
+
+// GetEnvironment returns the environment recorded for a run.
+func (c *Client) GetEnvironment(ctx context.Context, runID string) (*RunEnvironment, error) {
+	var resp RunEnvironment
+	err := c.do(ctx, "GET", "/sdk/runs/"+runID+"/environment", nil, &resp)
+	return &resp, err
+}
+
 func (c *Client) UploadBundle(ctx context.Context, key, filePath, apiToken string) error {
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestUploadArtifactMultipart(t *testing.T) {
+	tests := []struct {
+		name string
+		// fail answers a request instead of the fake Worker if it returns
+		// true
+		fail    func(w http.ResponseWriter, r *http.Request) bool
+		wantErr bool
+		want    []string
+	}{
+		{
+			name: "completed",
+			want: []string{"POST uploads", "PUT part=1", "PUT part=2", "POST complete"},
+		},
+		{
+			name: "part fails",
+			fail: func(w http.ResponseWriter, r *http.Request) bool {
+				if r.URL.Query().Get("part") != "2" {
+					return false
+				}
+				http.Error(w, "bad part", http.StatusBadRequest)
+				return true
+			},
+			wantErr: true,
+			want:    []string{"POST uploads", "PUT part=1", "PUT part=2", "DELETE abort"},
+		},
+		{
+			name: "bad part response",
+			fail: func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != "PUT" {
+					return false
+				}
+				io.WriteString(w, "<html>")
+				return true
+			},
+			wantErr: true,
+			want:    []string{"POST uploads", "PUT part=1", "DELETE abort"},
+		},
+		{
+			name: "complete fails",
+			fail: func(w http.ResponseWriter, r *http.Request) bool {
+				if r.Method != "POST" || r.URL.Query().Get("upload_id") == "" {
+					return false
+				}
+				http.Error(w, "bad parts", http.StatusBadRequest)
+				return true
+			},
+			wantErr: true,
+			want:    []string{"POST uploads", "PUT part=1", "PUT part=2", "POST complete", "DELETE abort"},
+		},
+	}
+
+	file := filepath.Join(t.TempDir(), "model.pt")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(artifactPartSize + 1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				q := r.URL.Query()
+				var call string
+				switch {
+				case r.Method == "POST" && q.Has("uploads"):
+					call = "POST uploads"
+				case r.Method == "PUT":
+					call = "PUT part=" + q.Get("part")
+				case r.Method == "POST":
+					call = "POST complete"
+				case r.Method == "DELETE":
+					call = "DELETE abort"
+				}
+				mu.Lock()
+				got = append(got, call)
+				mu.Unlock()
+
+				if tt.fail != nil && tt.fail(w, r) {
+					return
+				}
+				switch call {
+				case "POST uploads":
+					io.WriteString(w, `{"upload_id": "u1"}`)
+				case "PUT part=1", "PUT part=2":
+					io.WriteString(w, `{"part_number": 1, "etag": "e"}`)
+				default:
+					io.WriteString(w, `{}`)
+				}
+			}))
+			defer srv.Close()
+
+			err := NewClient(srv.URL, "token").UploadArtifact(context.Background(), "r1", "model.pt", file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UploadArtifact err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("requests %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1 +1,115 @@
 package bundle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Dependency manifest kinds, in the order they are detected.
+const (
+	DepsConda        = "conda"
+	DepsUV           = "uv"
+	DepsPoetry       = "poetry"
+	DepsPyproject    = "pyproject"
+	DepsRequirements = "requirements"
+	DepsNone         = "none"
+)
+
+// pythonVersionFile pins the Python version a project runs on, as used by uv
+// and pyenv.
+const pythonVersionFile = ".python-version"
+
+var pythonVersionRe = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,2}$`)
+
+// Deps describes how a bundle declares its dependencies.
+type Deps struct {
+	Kind string
+
+	// Files are the manifests and lockfiles, relative to the bundle root,
+	// that determine the environment.
+	Files []string
+}
+
+// DetectDeps finds the dependency manifest in a bundle dir:
+//
+//   - environment.yml or environment.yaml: a conda environment
+//   - uv.lock: a uv project
+//   - poetry.lock, or pyproject.toml with a [tool.poetry] table: a Poetry project
+//   - pyproject.toml: [project] dependencies, installed with pip
+//   - requirements.txt: installed with pip
+func DetectDeps(dir string) Deps {
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	pyproject, _ := os.ReadFile(filepath.Join(dir, "pyproject.toml"))
+
+	switch {
+	case exists("environment.yml"):
+		return Deps{Kind: DepsConda, Files: []string{"environment.yml"}}
+	case exists("environment.yaml"):
+		return Deps{Kind: DepsConda, Files: []string{"environment.yaml"}}
+	case exists("uv.lock"):
+		return Deps{Kind: DepsUV, Files: []string{"pyproject.toml", "uv.lock"}}
+	case exists("poetry.lock"):
+		return Deps{Kind: DepsPoetry, Files: []string{"pyproject.toml", "poetry.lock"}}
+	case bytes.Contains(pyproject, []byte("[tool.poetry")):
+		return Deps{Kind: DepsPoetry, Files: []string{"pyproject.toml"}}
+	case pyproject != nil:
+		return Deps{Kind: DepsPyproject, Files: []string{"pyproject.toml"}}
+	case exists("requirements.txt"):
+		return Deps{Kind: DepsRequirements, Files: []string{"requirements.txt"}}
+	}
+	return Deps{Kind: DepsNone}
+}
+
+// Hash returns a short hash of the manifest kind and the contents of its
+// files, or "" if the bundle has no dependencies.
+func (d Deps) Hash(dir string) (string, error) {
+	if d.Kind == DepsNone {
+		return "", nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", d.Kind)
+	for _, name := range d.Files {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("reading %s: %w", name, err)
+		}
+		fmt.Fprintf(h, "%s %d\n", name, len(data))
+		h.Write(data)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)[:8]), nil
+}
+
+// PythonVersion returns the version pinned in the bundle's .python-version
+// file, if any.
+func PythonVersion(dir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, pythonVersionFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", pythonVersionFile, err)
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	version = strings.TrimSpace(version)
+	if err := ValidatePythonVersion(version); err != nil {
+		return "", fmt.Errorf("%s: %w", pythonVersionFile, err)
+	}
+	return version, nil
+}
+
+// ValidatePythonVersion checks that a pinned version looks like 3, 3.11 or
+// 3.11.4.
+func ValidatePythonVersion(version string) error {
+	if !pythonVersionRe.MatchString(version) {
+		return fmt.Errorf("invalid Python version %q, want e.g. 3.11", version)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel [run_id]",
+	Short: "Cancel a run or drain the queue",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  cancelRun,
+}
+
+var cancelDrain bool
+
+func init() {
+	cancelCmd.Flags().BoolVar(&cancelDrain, "drain", false, "Cancel every queued run")
+	rootCmd.AddCommand(cancelCmd)
+}
+
+func cancelRun(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 && !cancelDrain {
+		return fmt.Errorf("specify a run_id or --drain")
+	}
+
+	workerURL := viper.GetString("worker_url")
+	apiToken := viper.GetString("api_token")
+	if workerURL == "" || apiToken == "" {
+		return fmt.Errorf("worker_url and api_token required")
+	}
+
+	client := api.NewClient(workerURL, apiToken)
+	ctx := context.Background()
+
+	if cancelDrain {
+		resp, err := client.DrainQueue(ctx)
+		if err != nil {
+			return fmt.Errorf("draining queue: %w", err)
+		}
+		fmt.Printf("Drained %d queued run(s)\n", len(resp.Cancelled))
+		for _, id := range resp.Cancelled {
+			fmt.Printf("  %s\n", id)
+		}
+	}
+
+	if len(args) == 1 {
+		resp, err := client.CancelRun(ctx, args[0])
+		if err != nil {
+			return fmt.Errorf("cancelling run: %w", err)
+		}
+		switch resp.Status {
+		case "cancelled":
+			fmt.Printf("Run %s removed from queue\n", resp.RunID)
+		case "cancelling":
+			fmt.Printf("Run %s is stopping; the agent will report when it exits\n", resp.RunID)
+		default:
+			fmt.Printf("Run %s: %s\n", resp.RunID, resp.Status)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/foundling-ai/mlflare/internal/api"
+)
+
+var envCmd = &cobra.Command{
+	Use:   "env <run_id> [other_run_id]",
+	Short: "Show what a run ran on, or diff two runs' environments",
+	Long: `Shows the environment the agent recorded for a run before starting it:
+host, agent version, kernel, Python and its packages, and GPUs.
+
+Given two runs, shows only what differs between their environments.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: showEnvironment,
+}
+
+func init() {
+	rootCmd.AddCommand(envCmd)
+}
+
+func showEnvironment(cmd *cobra.Command, args []string) error {
+	workerURL := viper.GetString("worker_url")
+	apiToken := viper.GetString("api_token")
+	if workerURL == "" || apiToken == "" {
+		return fmt.Errorf("worker_url and api_token required")
+	}
+
+	client := api.NewClient(workerURL, apiToken)
+	ctx := context.Background()
+
+	var envs []*api.RunEnvironment
+	for _, runID := range args {
+		env, err := client.GetEnvironment(ctx, runID)
+		if err != nil {
+			return fmt.Errorf("getting environment of %s: %w", runID, err)
+		}
+		envs = append(envs, env)
+	}
+
+	if len(envs) == 1 {
+		printEnvironment(envs[0])
+		return nil
+	}
+	printEnvironmentDiff(args[0], args[1], envs[0], envs[1])
+	return nil
+}
+
+// environmentFields are the fields of an environment other than its
+// packages, as label and value.
+func environmentFields(env *api.RunEnvironment) [][2]string {
+	return [][2]string{
+		{"Host", env.Hostname},
+		{"Agent", env.AgentVersion},
+		{"Kernel", env.Kernel},
+		{"Executor", env.Executor},
+		{"Image", env.Image},
+		{"Python", env.Python},
+		{"Driver", env.DriverVersion},
+		{"CUDA", env.CUDAVersion},
+		{"GPUs", strings.Join(env.GPUs, ", ")},
+	}
+}
+
+func printEnvironment(env *api.RunEnvironment) {
+	for _, f := range environmentFields(env) {
+		fmt.Printf("%-9s %s\n", f[0]+":", valueOrDash(f[1]))
+	}
+	if len(env.Packages) > 0 {
+		fmt.Printf("\nPackages (%d)\n", len(env.Packages))
+		for _, p := range env.Packages {
+			fmt.Printf("  %s\n", p)
+		}
+	}
+}
+
+func printEnvironmentDiff(runA, runB string, a, b *api.RunEnvironment) {
+	fmt.Printf("--- %s\n+++ %s\n", runA, runB)
+	same := true
+
+	fieldsB := environmentFields(b)
+	for i, f := range environmentFields(a) {
+		if f[1] != fieldsB[i][1] {
+			fmt.Printf("%-9s %s -> %s\n", f[0]+":", valueOrDash(f[1]), valueOrDash(fieldsB[i][1]))
+			same = false
+		}
+	}
+
+	pkgsA, pkgsB := packageVersions(a.Packages), packageVersions(b.Packages)
+	var names []string
+	for name := range pkgsA {
+		names = append(names, name)
+	}
+	for name := range pkgsB {
+		if _, ok := pkgsA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		va, inA := pkgsA[name]
+		vb, inB := pkgsB[name]
+		switch {
+		case !inA:
+			fmt.Printf("+ %s\n", vb.line)
+		case !inB:
+			fmt.Printf("- %s\n", va.line)
+		case va.pin != vb.pin:
+			fmt.Printf("- %s\n+ %s\n", va.line, vb.line)
+		default:
+			continue
+		}
+		same = false
+	}
+
+	if same {
+		fmt.Println("Environments are the same")
+	}
+}
+
+// installedPackage is a package as pip freeze lists it: its line, and the
+// pin in it after the name, such as ==1.2.3 or @ url.
+type installedPackage struct {
+	line string
+	pin  string
+}
+
+// packageVersions maps the name of each package in pip freeze output to how
+// it is installed.
+func packageVersions(lines []string) map[string]installedPackage {
+	pkgs := make(map[string]installedPackage, len(lines))
+	for _, line := range lines {
+		name, pin := line, ""
+		if i := strings.IndexAny(line, "=@ "); i >= 0 {
+			name, pin = line[:i], strings.TrimSpace(line[i:])
+		}
+		// pip compares names case-insensitively, with - and _ the same
+		name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+		pkgs[name] = installedPackage{line: line, pin: pin}
+	}
+	return pkgs
+}
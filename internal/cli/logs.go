@@ -6,21 +6,33 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/foundling-ai/mlflare/internal/api"
 )
 
 var logsCmd = &cobra.Command{
 	Use:   "logs [run_id]",
 	Short: "Stream live metrics from a run via SSE",
-	Args:  cobra.ExactArgs(1),
-	RunE:  streamLogs,
+	Long: `Streams live metrics from a run via SSE.
+
+With --output, prints the run's console output (stdout and stderr) instead,
+following it until the run finishes.`,
+	Args: cobra.ExactArgs(1),
+	RunE: streamLogs,
 }
 
+var logsOutput bool
+
+const outputPollInterval = 2 * time.Second
+
 func init() {
+	logsCmd.Flags().BoolVar(&logsOutput, "output", false, "Show console output instead of metrics")
 	rootCmd.AddCommand(logsCmd)
 }
 
@@ -32,12 +44,47 @@ func streamLogs(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("worker_url and api_token required")
 	}
 
-	url := fmt.Sprintf("%s/api/runs/%s/stream?token=%s", workerURL, runID, apiToken)
-
 	ctx := context.Background()
+
+	if logsOutput {
+		return tailOutput(ctx, api.NewClient(workerURL, apiToken), runID)
+	}
+
+	url := fmt.Sprintf("%s/api/runs/%s/stream?token=%s", workerURL, runID, apiToken)
 	return connectSSE(ctx, url)
 }
 
+// tailOutput polls the run's console lines until the run reaches a terminal
+// state and no lines remain.
+func tailOutput(ctx context.Context, client *api.Client, runID string) error {
+	after := 0
+	for {
+		resp, err := client.GetLogs(ctx, runID, after)
+		if err != nil {
+			return fmt.Errorf("fetching logs: %w", err)
+		}
+
+		for _, l := range resp.Lines {
+			if l.Stream == "stderr" {
+				fmt.Fprintln(os.Stderr, l.Line)
+			} else {
+				fmt.Println(l.Line)
+			}
+			after = l.Seq
+		}
+
+		if len(resp.Lines) > 0 {
+			continue
+		}
+		switch resp.Status {
+		case "completed", "failed", "cancelled", "early_stopped":
+			fmt.Printf("\nRun %s\n", resp.Status)
+			return nil
+		}
+		time.Sleep(outputPollInterval)
+	}
+}
+
 func connectSSE(ctx context.Context, url string) error {
 	maxRetries := 5
 	for attempt := 0; attempt < maxRetries; attempt++ {
@@ -4,36 +4,85 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
-	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
 
 	"github.com/foundling-ai/mlflare/internal/api"
+	"github.com/foundling-ai/mlflare/internal/bundle"
 )
 
 var runCmd = &cobra.Command{
-	Use:   "run",
+	Use:   "run [flags] [-- command...]",
 	Short: "Bundle and submit an experiment",
-	RunE:  runExperiment,
+	Long: `Bundle and submit an experiment.
+
+The run executes the --entrypoint script with the venv's Python, or the
+command given after --, with the venv's bin dir first on the PATH:
+
+  mlflare run --project demo -- python -m pkg.train --epochs 3
+  mlflare run --project demo -- make train
+
+--stop-if ends the run early, as early_stopped, when a metric it reports
+matches. Each rule is the metric name followed by one of
+
+  nonfinite            the value is NaN or infinite
+  plateau N [max]      the value hasn't improved on its best in N reports;
+                       lower is better unless max is given
+  > X, < X             the value is above or below X
+
+and optionally "after STEP" to ignore values reported before that step:
+
+  mlflare run --project demo --stop-if "loss nonfinite" \
+    --stop-if "val_loss plateau 5" --stop-if "loss > 10 after 1000"`,
+	RunE: runExperiment,
 }
 
 var (
 	runDir        string
 	runEntrypoint string
 	runProject    string
+	runConfigFile string
+	runSet        []string
+	runConfigArgs bool
+	runGPUs       int
+	runPython     string
+	runDatasets   []string
+	runImage      string
+	runLauncher   string
+	runTimeout    time.Duration
+	runMaxRSS     int
+	runMaxWrite   int
+	runStopIf     []string
 )
 
 func init() {
 	runCmd.Flags().StringVar(&runDir, "dir", ".", "Directory to bundle")
 	runCmd.Flags().StringVar(&runEntrypoint, "entrypoint", "train.py", "Python entrypoint script")
 	runCmd.Flags().StringVar(&runProject, "project", "", "Project name")
+	runCmd.Flags().StringVar(&runConfigFile, "config-file", "", "Experiment config file (JSON or YAML)")
+	runCmd.Flags().StringArrayVar(&runSet, "set", nil, "Set a config value (key=value, dots for nesting); repeatable")
+	runCmd.Flags().BoolVar(&runConfigArgs, "config-args", false, "Also pass the config to the entrypoint as --key=value arguments")
+	runCmd.Flags().IntVar(&runGPUs, "gpus", 0, "Number of GPUs the run needs (default 1)")
+	runCmd.Flags().StringVar(&runPython, "python", "", "Python version to run on, e.g. 3.11 (default: .python-version, else the agent's python)")
+	runCmd.Flags().StringArrayVar(&runDatasets, "dataset", nil, "R2 key or prefix (ending in /) the run reads, as [name=]key; found at datasets/<name> in its work dir; repeatable")
+	runCmd.Flags().StringVar(&runImage, "image", "", "Container image to run in; it must provide Python and the run's dependencies")
+	runCmd.Flags().StringVar(&runLauncher, "launcher", "", "Start one process per GPU with torchrun, accelerate or deepspeed")
+	runCmd.Flags().DurationVar(&runTimeout, "timeout", 0, "Stop the run as failed after this long, e.g. 6h (default: the agent's max_run_duration)")
+	runCmd.Flags().IntVar(&runMaxRSS, "max-rss-mb", 0, "Stop the run as failed if its processes use more memory than this (default: the agent's max_run_rss_mb)")
+	runCmd.Flags().IntVar(&runMaxWrite, "max-disk-write-mb", 0, "Stop the run as failed if its processes write more than this to disk (default: the agent's max_run_disk_write_mb)")
+	runCmd.Flags().StringArrayVar(&runStopIf, "stop-if", nil, `Stop the run early when a metric matches, e.g. "val_loss plateau 5" (see above); repeatable`)
 	runCmd.MarkFlagRequired("project")
 	rootCmd.AddCommand(runCmd)
 }
@@ -48,6 +97,44 @@ func runExperiment(cmd *cobra.Command, args []string) error {
 	ctx := context.Background()
 	client := api.NewClient(workerURL, apiToken)
 
+	config, err := loadRunConfig(runConfigFile, runSet)
+	if err != nil {
+		return err
+	}
+	if runPython != "" {
+		if err := bundle.ValidatePythonVersion(runPython); err != nil {
+			return err
+		}
+	}
+	datasets, err := parseDatasets(runDatasets)
+	if err != nil {
+		return err
+	}
+	command, err := runCommand(cmd, args)
+	if err != nil {
+		return err
+	}
+	stopRules, err := parseStopRules(runStopIf)
+	if err != nil {
+		return err
+	}
+	if runTimeout < 0 || runMaxRSS < 0 || runMaxWrite < 0 {
+		return fmt.Errorf("--timeout, --max-rss-mb and --max-disk-write-mb can't be negative")
+	}
+	// Sent in seconds, rounded up so the run gets at least as long as asked
+	maxDuration := int((runTimeout + time.Second - 1) / time.Second)
+
+	switch runLauncher {
+	case "", "torchrun", "accelerate", "deepspeed":
+	default:
+		return fmt.Errorf("invalid --launcher %q, expected torchrun, accelerate or deepspeed", runLauncher)
+	}
+	entrypoint := runEntrypoint
+	if len(command) > 0 {
+		// Shown in place of the entrypoint in experiment listings
+		entrypoint = strings.Join(command, " ")
+	}
+
 	// Resolve directory
 	absDir, err := filepath.Abs(runDir)
 	if err != nil {
@@ -61,12 +148,14 @@ func runExperiment(cmd *cobra.Command, args []string) error {
 	gitCommit := gitOutput(absDir, "rev-parse", "HEAD")
 	gitDirty := gitOutput(absDir, "status", "--porcelain") != ""
 
-	// Hash requirements.txt if exists
-	depsHash := ""
-	reqFile := filepath.Join(absDir, "requirements.txt")
-	if data, err := os.ReadFile(reqFile); err == nil {
-		h := sha256.Sum256(data)
-		depsHash = fmt.Sprintf("%x", h[:8])
+	// Hash the dependency manifest and lockfile, if any
+	deps := bundle.DetectDeps(absDir)
+	depsHash, err := deps.Hash(absDir)
+	if err != nil {
+		return fmt.Errorf("hashing dependencies: %w", err)
+	}
+	if deps.Kind != bundle.DepsNone {
+		fmt.Printf("Dependencies: %s (%s)\n", deps.Kind, strings.Join(deps.Files, ", "))
 	}
 
 	// Create tar.gz bundle
@@ -88,12 +177,25 @@ func runExperiment(cmd *cobra.Command, args []string) error {
 	fmt.Println("Submitting experiment...")
 	resp, err := client.SubmitExperiment(ctx, api.ExperimentSubmission{
 		Project:    runProject,
-		Entrypoint: runEntrypoint,
+		Entrypoint: entrypoint,
+		Command:    command,
+		Config:     config,
+		ConfigArgs: runConfigArgs,
+		GPUs:       runGPUs,
+		Python:     runPython,
+		Datasets:   datasets,
+		Image:      runImage,
+		Launcher:   runLauncher,
 		GitBranch:  gitBranch,
 		GitCommit:  gitCommit,
 		GitDirty:   gitDirty,
 		DepsHash:   depsHash,
 		BundleKey:  bundleKey,
+
+		MaxDuration:    maxDuration,
+		MaxRSSMB:       runMaxRSS,
+		MaxDiskWriteMB: runMaxWrite,
+		StopRules:      stopRules,
 	})
 	if err != nil {
 		return fmt.Errorf("submitting experiment: %w", err)
@@ -108,6 +210,141 @@ func runExperiment(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// loadRunConfig reads the config file, if any, and applies --set overrides on
+// top of it.
+func loadRunConfig(path string, sets []string) (map[string]any, error) {
+	config := map[string]any{}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		// YAML is a superset of JSON, so one decoder handles both
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("parsing config file: %w", err)
+		}
+	}
+
+	for _, kv := range sets {
+		key, raw, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --set %q, expected key=value", kv)
+		}
+		var value any
+		if err := yaml.Unmarshal([]byte(raw), &value); err != nil || value == nil {
+			value = raw
+		}
+
+		m := config
+		parts := strings.Split(key, ".")
+		for _, p := range parts[:len(parts)-1] {
+			next, ok := m[p].(map[string]any)
+			if !ok {
+				next = map[string]any{}
+				m[p] = next
+			}
+			m = next
+		}
+		m[parts[len(parts)-1]] = value
+	}
+
+	if len(config) == 0 {
+		return nil, nil
+	}
+	return config, nil
+}
+
+// runCommand returns the command given after --, if any.
+func runCommand(cmd *cobra.Command, args []string) ([]string, error) {
+	dash := cmd.ArgsLenAtDash()
+	if dash != 0 && len(args) > 0 {
+		return nil, fmt.Errorf("unexpected argument %q; give the command to run after --", args[0])
+	}
+	if len(args) > 0 && cmd.Flags().Changed("entrypoint") {
+		return nil, fmt.Errorf("--entrypoint and a command after -- can't both be given")
+	}
+	return args, nil
+}
+
+// datasetNameRe matches names datasets can be given in the run's work dir.
+var datasetNameRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// parseDatasets parses --dataset values, [name=]key. Without a name a dataset
+// is named after the last segment of its key.
+func parseDatasets(values []string) ([]api.Dataset, error) {
+	var datasets []api.Dataset
+	seen := make(map[string]bool)
+	for _, v := range values {
+		name, key, ok := strings.Cut(v, "=")
+		if !ok || !datasetNameRe.MatchString(name) {
+			name, key = path.Base(strings.TrimSuffix(v, "/")), v
+		}
+		if key == "" || key == "/" || !datasetNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid --dataset %q, expected [name=]key", v)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("dataset name %q used twice, name them with name=key", name)
+		}
+		seen[name] = true
+		datasets = append(datasets, api.Dataset{Name: name, Key: key})
+	}
+	return datasets, nil
+}
+
+// parseStopRules parses --stop-if values: a metric name, a condition and
+// optionally "after STEP", separated by spaces.
+func parseStopRules(values []string) ([]api.StopRule, error) {
+	var rules []api.StopRule
+	for _, v := range values {
+		rule, err := parseStopRule(strings.Fields(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --stop-if %q: %w", v, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseStopRule(f []string) (api.StopRule, error) {
+	if len(f) < 2 {
+		return api.StopRule{}, fmt.Errorf("expected a metric and a condition")
+	}
+	rule := api.StopRule{Metric: f[0]}
+	if n := len(f); n >= 4 && f[n-2] == "after" {
+		step, err := strconv.Atoi(f[n-1])
+		if err != nil || step < 0 {
+			return api.StopRule{}, fmt.Errorf("invalid step %q", f[n-1])
+		}
+		rule.AfterStep = step
+		f = f[:n-2]
+	}
+
+	cond, args := f[1], f[2:]
+	switch {
+	case cond == "nonfinite" && len(args) == 0:
+		rule.Kind = "non_finite"
+	case cond == "plateau" && (len(args) == 1 || len(args) == 2 && (args[1] == "min" || args[1] == "max")):
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return api.StopRule{}, fmt.Errorf("invalid patience %q", args[0])
+		}
+		rule.Kind, rule.Patience = "plateau", n
+		rule.Maximize = len(args) == 2 && args[1] == "max"
+	case (cond == ">" || cond == "<") && len(args) == 1:
+		x, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return api.StopRule{}, fmt.Errorf("invalid threshold %q", args[0])
+		}
+		rule.Kind, rule.Threshold = "above", x
+		if cond == "<" {
+			rule.Kind = "below"
+		}
+	default:
+		return api.StopRule{}, fmt.Errorf(`expected "nonfinite", "plateau N [max]", "> X" or "< X" after the metric`)
+	}
+	return rule, nil
+}
+
 func gitOutput(dir string, args ...string) string {
 	cmd := exec.Command("git", args...)
 	cmd.Dir = dir
@@ -38,7 +38,16 @@ func showStatus(cmd *cobra.Command, args []string) error {
 	fmt.Println("MLflare Status")
 	fmt.Println("==============")
 	fmt.Printf("  Instance:    %s\n", status.Instance.InstanceState)
-	fmt.Printf("  Current run: %s\n", valueOrDash(status.Instance.CurrentRunID))
+	if len(status.Instance.ActiveRuns) == 0 {
+		fmt.Printf("  Active runs: %s\n", valueOrDash(status.Instance.CurrentRunID))
+	}
+	for i, r := range status.Instance.ActiveRuns {
+		label := ""
+		if i == 0 {
+			label = "Active runs:"
+		}
+		fmt.Printf("  %-12s %s (%d GPU)\n", label, r.RunID, r.GPUs)
+	}
 	fmt.Printf("  Queue depth: %d\n", status.Instance.QueueDepth)
 	fmt.Printf("  Agent seen:  %s\n", valueOrDash(status.Instance.AgentLastSeen))
 	fmt.Println()
@@ -47,8 +56,14 @@ func showStatus(cmd *cobra.Command, args []string) error {
 		fmt.Println("Recent Runs")
 		fmt.Println("-----------")
 		for _, r := range status.RecentRuns {
-			fmt.Printf("  %s  %-10s  %s/%s  %s\n",
+			fmt.Printf("  %s  %-13s  %s/%s  %s\n",
 				r.ID[:12], r.Status, r.Project, r.Entrypoint, r.CreatedAt)
+			if r.Status == "failed" && r.ErrorMessage != "" {
+				fmt.Printf("                %s: %s\n", valueOrDash(r.FailureReason), r.ErrorMessage)
+			}
+			if r.Status == "early_stopped" && r.StopRule != "" {
+				fmt.Printf("                stopped early: %s\n", r.StopRule)
+			}
 		}
 	}
 
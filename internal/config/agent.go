@@ -3,16 +3,97 @@ package config
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type AgentConfig struct {
-	WorkerURL  string `mapstructure:"worker_url"`
-	APIToken   string `mapstructure:"api_token"`
-	Hostname   string `mapstructure:"hostname"`
-	WorkDir    string `mapstructure:"work_dir"`
-	PythonBin  string `mapstructure:"python_bin"`
+	WorkerURL string `mapstructure:"worker_url"`
+	APIToken  string `mapstructure:"api_token"`
+	Hostname  string `mapstructure:"hostname"`
+	WorkDir   string `mapstructure:"work_dir"`
+	PythonBin string `mapstructure:"python_bin"`
+
+	// CancelGracePeriod is how long a cancelled run has to exit after SIGTERM
+	// before it is killed.
+	CancelGracePeriod time.Duration `mapstructure:"cancel_grace_period"`
+
+	// ArtifactDir, relative to the run's work dir, is uploaded to R2 when a
+	// run exits.
+	ArtifactDir string `mapstructure:"artifact_dir"`
+
+	// TelemetryInterval is how often sys/* metrics are sampled during a run.
+	// Zero disables sampling.
+	TelemetryInterval time.Duration `mapstructure:"telemetry_interval"`
+	NvidiaSMIBin      string        `mapstructure:"nvidia_smi_bin"`
+
+	// SpoolMaxMB bounds the on-disk spool of reports waiting for the Worker.
+	// When it is full the oldest reports are dropped.
+	SpoolMaxMB int `mapstructure:"spool_max_mb"`
+
+	// GPUs, if set, is the list of GPU indices runs are scheduled onto, e.g.
+	// "0,1,2,3". By default every GPU nvidia-smi reports is used.
+	GPUs string `mapstructure:"gpus"`
+
+	// VenvCacheMB bounds the disk used by the per-dependency-set venvs under
+	// <work_dir>/cache/venvs. Past it the least recently used are deleted.
+	VenvCacheMB int `mapstructure:"venv_cache_mb"`
+
+	// Tools used to build environments for bundles with a uv lockfile, a
+	// Poetry project or a conda environment.yml.
+	UVBin     string `mapstructure:"uv_bin"`
+	PoetryBin string `mapstructure:"poetry_bin"`
+	CondaBin  string `mapstructure:"conda_bin"`
+
+	// DepsFailure says what to do when a run's dependencies fail to
+	// install: "fail" the run, or "warn" and run it anyway.
+	DepsFailure string `mapstructure:"deps_failure"`
+
+	// WorkspaceDir holds each run's files in <project>/<run_id>. Defaults to
+	// <work_dir>/workspace.
+	WorkspaceDir string `mapstructure:"workspace_dir"`
+
+	// Finished runs' files are kept until there are more than
+	// WorkspaceKeepRuns newer runs of the same project, they are older than
+	// WorkspaceMaxAge, or the workspace is over WorkspaceMaxMB. Zero disables
+	// a limit.
+	WorkspaceKeepRuns int           `mapstructure:"workspace_keep_runs"`
+	WorkspaceMaxAge   time.Duration `mapstructure:"workspace_max_age"`
+	WorkspaceMaxMB    int           `mapstructure:"workspace_max_mb"`
+
+	// Default limits a run is stopped at, if it wasn't submitted with its
+	// own: wall-clock time, memory use and bytes written to disk by its
+	// processes. Zero disables a limit.
+	MaxRunDuration    time.Duration `mapstructure:"max_run_duration"`
+	MaxRunRSSMB       int           `mapstructure:"max_run_rss_mb"`
+	MaxRunDiskWriteMB int           `mapstructure:"max_run_disk_write_mb"`
+
+	// A run that writes nothing to stdout and reports no metrics for
+	// StallTimeout is stalled; with StallIdleGPU only while its GPUs are at
+	// 0% use too. The agent dumps its Python stacks, then StallAction says
+	// whether to "alert" or "kill". Zero disables stall detection.
+	StallTimeout time.Duration `mapstructure:"stall_timeout"`
+	StallIdleGPU bool          `mapstructure:"stall_idle_gpu"`
+	StallAction  string        `mapstructure:"stall_action"`
+
+	// Executor runs training processes: "local" as processes on this host,
+	// "container" in a container, or "slurm" as SLURM batch jobs. Runs
+	// submitted with an image run in a container with the local executor too.
+	Executor string `mapstructure:"executor"`
+
+	// ContainerRuntime is docker or podman, and ContainerImage the image for
+	// runs submitted without one.
+	ContainerRuntime string `mapstructure:"container_runtime"`
+	ContainerImage   string `mapstructure:"container_image"`
+
+	// SlurmBinDir holds sbatch, squeue and scancel; by default they are found
+	// on PATH. SlurmArgs are added to every sbatch, e.g. "--account=ml
+	// --time=24:00:00".
+	SlurmBinDir    string `mapstructure:"slurm_bin_dir"`
+	SlurmPartition string `mapstructure:"slurm_partition"`
+	SlurmArgs      string `mapstructure:"slurm_args"`
 }
 
 func LoadAgentConfig() (*AgentConfig, error) {
@@ -33,9 +114,53 @@ func LoadAgentConfig() (*AgentConfig, error) {
 	v.BindEnv("hostname")
 	v.BindEnv("work_dir")
 	v.BindEnv("python_bin")
+	v.BindEnv("cancel_grace_period")
+	v.BindEnv("artifact_dir")
+	v.BindEnv("telemetry_interval")
+	v.BindEnv("nvidia_smi_bin")
+	v.BindEnv("spool_max_mb")
+	v.BindEnv("gpus")
+	v.BindEnv("venv_cache_mb")
+	v.BindEnv("uv_bin")
+	v.BindEnv("poetry_bin")
+	v.BindEnv("conda_bin")
+	v.BindEnv("deps_failure")
+	v.BindEnv("workspace_dir")
+	v.BindEnv("workspace_keep_runs")
+	v.BindEnv("workspace_max_age")
+	v.BindEnv("workspace_max_mb")
+	v.BindEnv("max_run_duration")
+	v.BindEnv("max_run_rss_mb")
+	v.BindEnv("max_run_disk_write_mb")
+	v.BindEnv("stall_timeout")
+	v.BindEnv("stall_idle_gpu")
+	v.BindEnv("stall_action")
+	v.BindEnv("executor")
+	v.BindEnv("container_runtime")
+	v.BindEnv("container_image")
+	v.BindEnv("slurm_bin_dir")
+	v.BindEnv("slurm_partition")
+	v.BindEnv("slurm_args")
 
 	v.SetDefault("work_dir", "/tmp/mlflare-workspace")
 	v.SetDefault("python_bin", "python3")
+	v.SetDefault("cancel_grace_period", "30s")
+	v.SetDefault("artifact_dir", "outputs")
+	v.SetDefault("telemetry_interval", "15s")
+	v.SetDefault("nvidia_smi_bin", "nvidia-smi")
+	v.SetDefault("spool_max_mb", 1024)
+	v.SetDefault("venv_cache_mb", 20480)
+	v.SetDefault("uv_bin", "uv")
+	v.SetDefault("poetry_bin", "poetry")
+	v.SetDefault("conda_bin", "conda")
+	v.SetDefault("deps_failure", "fail")
+	v.SetDefault("workspace_keep_runs", 10)
+	v.SetDefault("workspace_max_age", "168h")
+	v.SetDefault("workspace_max_mb", 51200)
+	v.SetDefault("stall_timeout", "30m")
+	v.SetDefault("stall_action", "alert")
+	v.SetDefault("executor", "local")
+	v.SetDefault("container_runtime", "docker")
 
 	hostname, _ := os.Hostname()
 	v.SetDefault("hostname", hostname)
@@ -58,5 +183,9 @@ func LoadAgentConfig() (*AgentConfig, error) {
 		return nil, fmt.Errorf("api_token is required (set MLFLARE_API_TOKEN or in config)")
 	}
 
+	if cfg.WorkspaceDir == "" {
+		cfg.WorkspaceDir = filepath.Join(cfg.WorkDir, "workspace")
+	}
+
 	return cfg, nil
 }
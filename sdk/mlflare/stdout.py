@@ -3,7 +3,10 @@
 from __future__ import annotations
 
 import json
+import os
 import sys
+import time
+from typing import Any, Sequence
 
 
 def log_metrics(**kwargs: float) -> None:
@@ -13,5 +16,99 @@ def log_metrics(**kwargs: float) -> None:
         from mlflare.stdout import log_metrics
         log_metrics(loss=0.5, accuracy=0.8)
     """
-    payload = json.dumps({"__mlflare__": kwargs})
-    print(payload, flush=True)
+    _print({"__mlflare__": kwargs})
+
+
+PROTOCOL_VERSION = 2
+
+
+def _emit(event_type: str, **fields: Any) -> None:
+    _print({"_mlflare": {"v": PROTOCOL_VERSION, "type": event_type, **fields}})
+
+
+def _print(message: dict[str, Any]) -> None:
+    # Under torchrun, accelerate or deepspeed every rank runs this; only
+    # rank 0 reports, so the run's metrics aren't repeated per process.
+    if os.environ.get("RANK", "0") != "0":
+        return
+    print(json.dumps(message), flush=True)
+
+
+def log(values: dict[str, Any], step: int | None = None) -> None:
+    """Emit metrics stamped with the current time, optionally at an explicit step.
+
+    Values may be numbers (NaN and infinities included), strings, or
+    histograms built with histogram().
+
+    Usage:
+        from mlflare.stdout import histogram, log
+        log({"loss": 0.5, "grads": histogram(grads)}, step=100)
+    """
+    fields: dict[str, Any] = {"values": values, "time": time.time()}
+    if step is not None:
+        fields["step"] = step
+    _emit("metrics", **fields)
+
+
+def histogram(
+    values: Sequence[float] | None = None,
+    bins: int | None = None,
+    *,
+    edges: Sequence[float] | None = None,
+    counts: Sequence[float] | None = None,
+) -> dict[str, Any]:
+    """Build a histogram metric value from raw samples, which the agent bins,
+    or from precomputed bucket edges and counts."""
+    if edges is not None and counts is not None:
+        return {"type": "histogram", "edges": list(edges), "counts": list(counts)}
+    if values is None:
+        raise ValueError("histogram needs values or edges and counts")
+    hist: dict[str, Any] = {"type": "histogram", "values": [float(v) for v in values]}
+    if bins is not None:
+        hist["bins"] = bins
+    return hist
+
+
+def log_params(**params: Any) -> None:
+    """Record run params (hyperparameters)."""
+    _emit("params", values=params)
+
+
+def log_summary(**values: Any) -> None:
+    """Record summary values such as the best validation score."""
+    _emit("summary", values=values)
+
+
+def set_tags(**tags: str) -> None:
+    """Set run tags."""
+    _emit("tags", values=tags)
+
+
+def set_status(message: str) -> None:
+    """Set a free-form status message, such as "evaluating"."""
+    _emit("status", message=message)
+
+
+def log_artifact(path: str) -> None:
+    """Declare a file for the agent to upload when the run exits.
+
+    Paths are relative to the run's working directory. Everything under
+    ``outputs/`` is uploaded without being declared.
+
+    Usage:
+        from mlflare.stdout import log_artifact
+        log_artifact("checkpoints/best.pt")
+    """
+    _emit("artifact", path=path)
+
+
+def load_config() -> dict[str, Any]:
+    """Return the experiment config passed in by the agent.
+
+    Reads the ``MLFLARE_CONFIG`` environment variable set for agent-run
+    experiments. Returns an empty dict when running outside the agent.
+    """
+    raw = os.environ.get("MLFLARE_CONFIG")
+    if not raw:
+        return {}
+    return json.loads(raw)
@@ -2,7 +2,7 @@ import json
 import io
 import sys
 
-from mlflare.stdout import log_metrics
+from mlflare.stdout import histogram, load_config, log, log_artifact, log_metrics, log_params, set_status, set_tags
 
 
 def test_log_metrics_outputs_json(capsys):
@@ -31,3 +31,67 @@ def test_log_metrics_multiple_calls(capsys):
     d2 = json.loads(lines[1])
     assert d1["__mlflare__"]["loss"] == 1.0
     assert d2["__mlflare__"]["loss"] == 0.5
+
+
+def test_log_artifact_outputs_json(capsys):
+    log_artifact("checkpoints/best.pt")
+    captured = capsys.readouterr()
+    data = json.loads(captured.out.strip())
+    assert data == {"_mlflare": {"v": 2, "type": "artifact", "path": "checkpoints/best.pt"}}
+
+
+def test_log_with_step(capsys):
+    log({"loss": 0.25}, step=10)
+    data = json.loads(capsys.readouterr().out.strip())
+    event = data["_mlflare"]
+    assert isinstance(event.pop("time"), float)
+    assert event == {"v": 2, "type": "metrics", "step": 10, "values": {"loss": 0.25}}
+
+
+def test_log_without_step(capsys):
+    log({"loss": 0.25})
+    data = json.loads(capsys.readouterr().out.strip())
+    assert "step" not in data["_mlflare"]
+
+
+def test_log_non_finite_and_histogram(capsys):
+    log({"loss": float("nan"), "note": "warmup", "w": histogram([1.0, 2.0], bins=4)})
+    out = capsys.readouterr().out.strip()
+    assert '"loss": NaN' in out
+    values = json.loads(out)["_mlflare"]["values"]
+    assert values["note"] == "warmup"
+    assert values["w"] == {"type": "histogram", "values": [1.0, 2.0], "bins": 4}
+
+
+def test_histogram_from_counts():
+    assert histogram(edges=[0, 1, 2], counts=[3, 4]) == {"type": "histogram", "edges": [0, 1, 2], "counts": [3, 4]}
+
+
+def test_typed_events(capsys):
+    log_params(lr=0.001, optimizer="adam")
+    set_tags(stage="pretrain")
+    set_status("evaluating")
+    lines = [json.loads(l)["_mlflare"] for l in capsys.readouterr().out.strip().split("\n")]
+    assert lines[0] == {"v": 2, "type": "params", "values": {"lr": 0.001, "optimizer": "adam"}}
+    assert lines[1] == {"v": 2, "type": "tags", "values": {"stage": "pretrain"}}
+    assert lines[2] == {"v": 2, "type": "status", "message": "evaluating"}
+
+
+def test_only_rank_zero_emits(monkeypatch, capsys):
+    monkeypatch.setenv("RANK", "1")
+    log_metrics(loss=0.5)
+    log({"loss": 0.5})
+    assert capsys.readouterr().out == ""
+    monkeypatch.setenv("RANK", "0")
+    log_metrics(loss=0.5)
+    assert json.loads(capsys.readouterr().out) == {"__mlflare__": {"loss": 0.5}}
+
+
+def test_load_config_from_env(monkeypatch):
+    monkeypatch.setenv("MLFLARE_CONFIG", '{"lr": 0.001, "optim": {"beta": 0.9}}')
+    assert load_config() == {"lr": 0.001, "optim": {"beta": 0.9}}
+
+
+def test_load_config_without_agent(monkeypatch):
+    monkeypatch.delenv("MLFLARE_CONFIG", raising=False)
+    assert load_config() == {}